@@ -12,14 +12,34 @@ import (
 
 	"github.com/go-chi/chi/v5"
 	"github.com/go-chi/chi/v5/middleware"
+	"github.com/jackc/pgx/v5/pgxpool"
 
+	"github.com/NieRVoid/emqx-pg-bridge/internal/admin"
+	"github.com/NieRVoid/emqx-pg-bridge/internal/alert"
+	"github.com/NieRVoid/emqx-pg-bridge/internal/command"
 	"github.com/NieRVoid/emqx-pg-bridge/internal/config"
 	"github.com/NieRVoid/emqx-pg-bridge/internal/database"
 	"github.com/NieRVoid/emqx-pg-bridge/internal/handler"
+	"github.com/NieRVoid/emqx-pg-bridge/internal/lifecycle"
+	"github.com/NieRVoid/emqx-pg-bridge/internal/models"
+	"github.com/NieRVoid/emqx-pg-bridge/internal/occupancy"
 	"github.com/NieRVoid/emqx-pg-bridge/internal/processor"
+	"github.com/NieRVoid/emqx-pg-bridge/internal/ratelimit"
+	"github.com/NieRVoid/emqx-pg-bridge/internal/rollup"
+	"github.com/NieRVoid/emqx-pg-bridge/internal/shadow"
+	"github.com/NieRVoid/emqx-pg-bridge/internal/sink"
+	"github.com/NieRVoid/emqx-pg-bridge/internal/spool"
+	"github.com/NieRVoid/emqx-pg-bridge/internal/state"
+	"github.com/NieRVoid/emqx-pg-bridge/internal/stream"
+	"github.com/NieRVoid/emqx-pg-bridge/internal/tenant"
+	"github.com/NieRVoid/emqx-pg-bridge/internal/tracing"
 	"github.com/NieRVoid/emqx-pg-bridge/pkg/logger"
 )
 
+// webhookTimeout bounds processing a webhook, whether right away or once a
+// rate limit released it
+const webhookTimeout = 30 * time.Second
+
 func main() {
 	// Define command line flags
 	configPath := flag.String("config", "", "Path to configuration file")
@@ -49,7 +69,7 @@ func main() {
 	}
 
 	// Initialize logger
-	log := logger.NewLogger(cfg.Logging.Level, cfg.Logging.Format)
+	log := logger.NewWithOptions(cfg.GetLoggerOptions())
 	log.Info("Starting EMQX-PostgreSQL Bridge",
 		"version", cfg.Meta.Version,
 		"buildDate", cfg.Meta.BuildDate)
@@ -58,22 +78,418 @@ func main() {
 	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
 	defer cancel()
 
-	// Connect to PostgreSQL
-	db, err := database.NewPostgres(ctx, cfg, log)
+	// Initialize tracing before the database so the pgx tracer is exported
+	shutdownTracing, err := tracing.Setup(ctx, cfg, log)
 	if err != nil {
-		log.Fatal("Failed to connect to database", "error", err)
+		log.Fatal("Failed to initialize tracing", "error", err)
+	}
+
+	// Open the database selected by the scheme of the database URL. Only
+	// PostgreSQL supports the features beyond storing room and device status.
+	var db *database.Postgres
+	var store processor.StatusStore
+	var pgStore *processor.PostgresStore
+	// Processor statements prepared on every connection, nil when disabled
+	var statements *processor.StatementRegistry
+	// Statements of the tenants with a database of their own, by tenant
+	tenantStatements := make(map[string]*processor.StatementRegistry)
+	// Databases closed last at shutdown, in reverse order
+	var closeDatabases []func()
+	if cfg.Database.Driver() == config.DriverSQLite {
+		lite, err := database.NewSQLite(ctx, cfg, log)
+		if err != nil {
+			log.Fatal("Failed to open database", "error", err)
+		}
+		closeDatabases = append(closeDatabases, lite.Close)
+
+		if !cfg.Database.SkipMigrations {
+			if err := lite.Migrate(ctx); err != nil {
+				log.Fatal("Failed to apply database migrations", "error", err)
+			}
+		}
+		store = processor.NewSQLiteStore(lite.DB)
+	} else {
+		var preparer database.StatementPreparer
+		if !cfg.Database.SkipPreparedStatements {
+			statements = processor.NewStatementRegistry()
+			preparer = statements
+		}
+		db, err = database.NewPostgres(ctx, cfg, preparer, log)
+		if err != nil {
+			log.Fatal("Failed to connect to database", "error", err)
+		}
+		closeDatabases = append(closeDatabases, db.Close)
+
+		// Apply embedded schema migrations
+		if !cfg.Database.SkipMigrations {
+			if err := db.Migrate(ctx); err != nil {
+				log.Fatal("Failed to apply database migrations", "error", err)
+			}
+		}
+		pgStore = processor.NewPostgresStore(db.Pool, log)
+		pgStore.SetRetryPolicy(cfg.GetDatabaseRetryPolicy())
+		if statements != nil {
+			pgStore.SetStatements(statements)
+		}
+		store = pgStore
 	}
-	defer db.Close()
 
 	// Initialize processor registry
 	registry := processor.NewProcessorRegistry(log)
 
 	// Initialize and register processors
-	centerProcessor := processor.NewCenterProcessor(db.Pool, log)
-	normalProcessor := processor.NewNormalProcessor(db.Pool, log)
+	centerProcessor := processor.NewCenterProcessor(store, log)
+	normalProcessor := processor.NewNormalProcessor(store, log)
+
+	// Keep occupancy history and hourly rollups
+	var historyStorage *rollup.Storage
+	if cfg.Rollups.Enabled {
+		// Converting existing history may outlast the initialization timeout
+		historyStorage = rollup.NewStorage(db.Pool, cfg.GetRollupStorageOptions(), log)
+		if err := historyStorage.Setup(context.Background()); err != nil {
+			log.Fatal("Failed to set up history storage", "error", err)
+		}
+		recorder := rollup.NewRecorder(db.Pool, cfg.GetRollupMaxGap(), log)
+		if statements != nil {
+			recorder.SetStatements(statements)
+		}
+		pgStore.SetHistoryRecorder(recorder)
+	}
+
+	// Environment sensors write the remaining room_status columns
+	var envProcessor *processor.EnvProcessor
+	if cfg.EnvSensor.Enabled {
+		envProcessor = newEnvProcessor(cfg, db.Pool, statements, log)
+	}
+
+	// Publish committed state changes with pg_notify
+	if cfg.Notify.Enabled {
+		notifier := processor.NewNotifier(cfg.Notify.RoomChannel, cfg.Notify.DeviceChannel)
+		if statements != nil {
+			notifier.SetStatements(statements)
+		}
+		pgStore.SetNotifier(notifier)
+		if envProcessor != nil {
+			envProcessor.SetNotifier(notifier)
+		}
+		log.Info("NOTIFY publication enabled",
+			"roomChannel", cfg.Notify.RoomChannel,
+			"deviceChannel", cfg.Notify.DeviceChannel)
+	}
+
+	// With tenants, the primary tenant may be limited to some device types
+	primaryTenant := cfg.PrimaryTenant()
+	register := func(p processor.Processor) {
+		if !cfg.Tenants.Enabled || primaryTenant.Serves(p.Type()) {
+			registry.Register(p)
+		}
+	}
+
+	register(centerProcessor)
+	register(normalProcessor)
+	if envProcessor != nil {
+		register(envProcessor)
+	}
+	applyUpdateModes(cfg, registry, log)
+
+	// Track client connections from EMQX client and session events
+	var presenceProcessor *processor.PresenceProcessor
+	if cfg.Presence.Enabled {
+		presenceProcessor = processor.NewPresenceProcessor(db.Pool, cfg.Presence.ClientIDMatch, log)
+		presenceProcessor.SetRetryPolicy(cfg.GetDatabaseRetryPolicy())
+		if statements != nil {
+			presenceProcessor.SetStatements(statements)
+		}
+		register(presenceProcessor)
+	}
+
+	// Serve further properties from their own database or schema, each with
+	// its own processors. Tenants sharing the main database share its breaker.
+	var tenants *tenant.Resolver
+	var sharedTenants, separateTenants []*tenant.Tenant
+	if cfg.Tenants.Enabled {
+		tenants = tenant.NewResolver(cfg.Tenants.UserProperty)
+		primary := &tenant.Tenant{
+			ID:       primaryTenant.ID,
+			Registry: registry,
+			AuthKeys: primaryTenant.AuthKeys,
+		}
+		if presenceProcessor != nil && primaryTenant.Serves(processor.PresenceType) {
+			primary.Presence = presenceProcessor
+		}
+		tenants.Add(primary, primaryTenant.TopicPrefixes, primaryTenant.Usernames)
+		sharedTenants = append(sharedTenants, primary)
+		if !cfg.Tenants.Strict {
+			tenants.SetFallback(primary)
+		}
+
+		for i := range cfg.Tenants.List {
+			tc := &cfg.Tenants.List[i]
+			if tc.ID == primaryTenant.ID {
+				continue
+			}
+			t, tdb, err := newTenant(ctx, cfg, tc, db, statements, log)
+			if err != nil {
+				log.Fatal("Failed to initialize tenant", "tenant", tc.ID, "error", err)
+			}
+			tenants.Add(t, tc.TopicPrefixes, tc.Usernames)
+			if tdb != nil {
+				closeDatabases = append(closeDatabases, tdb.db.Close)
+				separateTenants = append(separateTenants, t)
+				tenantStatements[t.ID] = tdb.statements
+			} else {
+				sharedTenants = append(sharedTenants, t)
+			}
+			log.Info("Tenant enabled", "tenant", tc.ID,
+				"processors", t.Registry.Statuses(), "separateDatabase", tdb != nil)
+		}
+	}
+
+	// Initialize the dead-letter spool for webhooks that fail processing
+	var deadLetter *spool.Spool
+	if cfg.DeadLetter.Enabled {
+		deadLetter, err = spool.NewSpool("dead-letter", cfg.DeadLetter.Dir, log)
+		if err != nil {
+			log.Fatal("Failed to initialize dead-letter spool", "error", err)
+		}
+		deadLetter.SetQuarantine(processor.IsPermanent, cfg.DeadLetter.MaxAttempts)
+		// Replayed webhooks must not overwrite status written since
+		deadLetter.SetReceivedAt(processor.WithReportedAt)
+	}
+
+	// Write only the latest state per key of high-frequency processors
+	var coalescers []*processor.Coalescer
+	tenantCoalescers := make(map[string][]*processor.Coalescer)
+	if tenants != nil {
+		for _, t := range tenants.Tenants() {
+			tenantCoalescers[t.ID] = applyCoalescing(cfg, t.ID, t.Registry, deadLetter, log.With("tenant", t.ID))
+			coalescers = append(coalescers, tenantCoalescers[t.ID]...)
+		}
+	} else {
+		coalescers = applyCoalescing(cfg, "", registry, deadLetter, log)
+	}
+
+	// Background workers stop when this context is cancelled at shutdown
+	bgCtx, stopBackground := context.WithCancel(context.Background())
+	defer stopBackground()
+
+	if historyStorage != nil {
+		go historyStorage.Run(bgCtx, cfg.GetRollupMaintenanceInterval())
+	}
+
+	for _, c := range coalescers {
+		go c.Run(bgCtx)
+	}
+
+	if presenceProcessor != nil {
+		go presenceProcessor.Run(bgCtx, cfg.GetPresenceHeartbeat(), cfg.GetPresenceSweepInterval())
+	}
+	for _, t := range separateTenants {
+		if t.Presence != nil {
+			go t.Presence.Run(bgCtx, cfg.GetPresenceHeartbeat(), cfg.GetPresenceSweepInterval())
+		}
+	}
+
+	// Alert on rooms and devices that stopped reporting
+	if cfg.Alerts.Enabled {
+		var notifiers []alert.Notifier
+		if cfg.Alerts.Webhook.URL != "" {
+			notifiers = append(notifiers, alert.NewWebhookNotifier(cfg.Alerts.Webhook.URL,
+				cfg.Alerts.Webhook.Headers, time.Duration(cfg.Alerts.Webhook.TimeoutSeconds)*time.Second))
+		}
+		if cfg.Alerts.SMTP.Addr != "" {
+			notifiers = append(notifiers, alert.NewSMTPNotifier(cfg.Alerts.SMTP.Addr, cfg.Alerts.SMTP.From,
+				cfg.Alerts.SMTP.To, cfg.Alerts.SMTP.Username, cfg.Alerts.SMTP.Password))
+		}
+		detector := alert.NewDetector(db.Pool, cfg.GetAlertThresholds(), notifiers, log)
+		go detector.Run(bgCtx, cfg.GetAlertScanInterval())
+	}
+
+	// Keep current room and device state in memory for the read API
+	var stateCache *state.Cache
+	if cfg.ReadAPI.Enabled {
+		stateCache = state.NewCache(db.ReadPool, log)
+		if err := stateCache.Load(ctx); err != nil {
+			log.Fatal("Failed to load state cache", "error", err)
+		}
+		centerProcessor.AddListener(stateCache)
+		normalProcessor.AddListener(stateCache)
+		if envProcessor != nil {
+			envProcessor.AddListener(stateCache)
+		}
+		go stateCache.Run(bgCtx, cfg.GetCacheRefreshInterval())
+	}
+
+	// Derive rooms.occupancy from the reported room status
+	if cfg.Occupancy.Enabled {
+		occupancyEngine := occupancy.NewEngine(db.Pool, cfg.GetOccupancyRules(), log)
+		if stateCache != nil {
+			occupancyEngine.AddListener(stateCache)
+		}
+		centerProcessor.AddListener(occupancyEngine)
+		go occupancyEngine.Run(bgCtx, cfg.GetOccupancyEvaluateInterval())
+	}
+
+	// Push occupancy changes to connected stream clients
+	var streamHub *stream.Hub
+	if cfg.Stream.Enabled {
+		streamHub = stream.NewHub(cfg.Stream.BufferSize, log)
+		centerProcessor.AddListener(streamHub)
+	}
+
+	// Send desired state to devices and acknowledge it from their reports
+	var commandService *command.Service
+	if cfg.Commands.Enabled {
+		publisher := command.NewEMQXPublisher(cfg.Commands.EMQX.APIURL,
+			cfg.Commands.EMQX.APIKey, cfg.Commands.EMQX.APISecret, cfg.GetEMQXTimeout())
+		commandService = command.NewService(db.Pool, publisher, cfg.Commands.TopicTemplate,
+			cfg.Commands.QoS, cfg.GetCommandAckTimeout(), log)
+		if statements != nil {
+			commandService.SetStatements(statements)
+		}
+		normalProcessor.AddListener(commandService)
+		go commandService.Run(bgCtx, cfg.GetCommandExpireInterval())
+	}
+
+	// Reconcile desired and reported device state
+	var shadowService *shadow.Service
+	if commandService != nil && cfg.Commands.Shadow.Enabled {
+		shadowService = shadow.NewService(db.Pool, commandService,
+			cfg.GetShadowResyncAfter(), cfg.Commands.Shadow.MaxAttempts, log)
+		if statements != nil {
+			shadowService.SetStatements(statements)
+		}
+		go shadowService.Run(bgCtx, cfg.GetShadowReconcileInterval())
+	}
+
+	// Check the processor statements against the live schema before any
+	// webhook is served
+	if statements != nil {
+		if err := statements.Validate(ctx, db.Pool); err != nil {
+			log.Fatal("Processor statements do not match the database schema", "error", err)
+		}
+		log.Info("Prepared processor statements", "statements", statements.Len())
+	}
+
+	// Fan processed records out to the configured sinks
+	var sinkDispatcher *sink.Dispatcher
+	if len(cfg.Sinks) > 0 {
+		sinkDispatcher = sink.NewDispatcher(log)
+		for i := range cfg.Sinks {
+			sc := &cfg.Sinks[i]
+			s, err := newSink(ctx, sc)
+			if err != nil {
+				log.Fatal("Failed to initialize sink", "sink", sc.Name, "type", sc.Type, "error", err)
+			}
+			sinkDispatcher.Add(s, sc.GetSinkOptions())
+			log.Info("Sink enabled", "sink", sc.Name, "type", sc.Type, "deviceTypes", sc.DeviceTypes)
+		}
+
+		for deviceType, p := range registry.GetProcessors() {
+			if !sinkDispatcher.Selects(deviceType) {
+				continue
+			}
+			switch p := processor.Unwrap(p).(type) {
+			case processor.RoomStatusSource:
+				p.AddListener(sinkDispatcher.For(deviceType))
+			case processor.DeviceStatusSource:
+				p.AddListener(sinkDispatcher.For(deviceType))
+			}
+		}
+		sinkDispatcher.Start()
+	}
+
+	// Spool webhooks instead of writing to a database that is down, and
+	// replay them once it is back
+	// Spooled webhooks are replayed to the processors of their tenant
+	dispatch := registry.Dispatch
+	if tenants != nil {
+		dispatch = tenants.Dispatch
+	}
+
+	var breaker *database.Breaker
+	if db != nil && cfg.Database.CircuitBreaker.Enabled {
+		// A breaker guards the database of some tenants and replays only
+		// their spooled webhooks when it recovers; without tenants, all
+		newBreaker := func(tenantIDs []string) *database.Breaker {
+			b := database.NewBreaker(cfg.Database.CircuitBreaker.FailureThreshold,
+				cfg.GetBreakerOpenDuration(), log)
+			replay := func(ctx context.Context) (spool.ReplayResult, error) {
+				if tenants == nil {
+					return deadLetter.Replay(ctx, dispatch)
+				}
+				return deadLetter.ReplayTenants(ctx, tenantIDs, dispatch)
+			}
+			if deadLetter != nil {
+				b.SetOnRecover(func() {
+					// Webhooks held meanwhile are spooled behind the replayed
+					// ones; replay until a pass saw no new arrivals
+					for bgCtx.Err() == nil {
+						res, err := replay(bgCtx)
+						if err != nil {
+							if bgCtx.Err() == nil {
+								log.Error("Failed to replay dead-letter spool after recovery", "error", err)
+							}
+							return
+						}
+						if deadLetter.Depth() <= res.Remaining {
+							return
+						}
+					}
+				})
+			}
+			return b
+		}
+		// Entries spooled without a tenant belong to the main database
+		sharedIDs := []string{""}
+		for _, t := range sharedTenants {
+			sharedIDs = append(sharedIDs, t.ID)
+		}
+		breaker = newBreaker(sharedIDs)
+		for _, t := range sharedTenants {
+			t.Breaker = breaker
+		}
+		for _, t := range separateTenants {
+			t.Breaker = newBreaker([]string{t.ID})
+		}
+	}
 
-	registry.Register(centerProcessor)
-	registry.Register(normalProcessor)
+	// Throttle clients flooding the webhook endpoint
+	var limiter *ratelimit.Limiter
+	if cfg.RateLimits.Enabled {
+		limiter = ratelimit.NewLimiter(cfg.GetRateLimitRules(), log)
+		limiter.SetTimeout(webhookTimeout)
+		limiter.SetDispatch(func(ctx context.Context, deviceType string, data *models.WebhookData) error {
+			// Released webhooks pass the breaker of their database as the
+			// handler's do
+			tenantID, b := "", breaker
+			if tenants != nil {
+				if t, terr := tenants.Resolve(data); terr == nil {
+					tenantID, b = t.ID, t.Breaker
+				}
+			}
+			var err error
+			if b != nil && !b.Allow() {
+				err = handler.ErrCircuitOpen
+			} else {
+				err = dispatch(ctx, deviceType, data)
+				if b != nil {
+					b.Record(err)
+				}
+			}
+			if err != nil && deadLetter != nil && !processor.IsPermanent(err) {
+				if spoolErr := deadLetter.Put(tenantID, deviceType, data, err); spoolErr != nil {
+					log.Error("Failed to dead-letter coalesced webhook", "deviceType", deviceType, "error", spoolErr)
+				}
+			}
+			return err
+		})
+		go limiter.Run(bgCtx, cfg.GetRateLimitFlushInterval())
+		log.Info("Rate limiting enabled", "limits", len(cfg.RateLimits.Limits))
+	}
+
+	// Readiness and the ordered shutdown of everything started below
+	lc := lifecycle.NewManager(log)
 
 	// Setup HTTP router
 	r := chi.NewRouter()
@@ -83,19 +499,60 @@ func main() {
 	r.Use(middleware.RealIP)
 	r.Use(middleware.Logger)
 	r.Use(middleware.Recoverer)
-	r.Use(middleware.Timeout(30 * time.Second))
 
-	// Create webhook handler
-	webhookHandler := handler.NewWebhookHandler(registry, log)
+	// Long-lived stream connections must not be cut off by the request timeout
+	if streamHub != nil {
+		streamHandler := stream.NewHandler(streamHub, cfg.GetStreamHeartbeat(), cfg.Stream.AllowedOrigins, log)
+		streamHandler.Routes(r)
+	}
+
+	r.Group(func(r chi.Router) {
+		r.Use(middleware.Timeout(webhookTimeout))
+
+		// Create webhook handler
+		webhookHandler := handler.NewWebhookHandler(registry, deadLetter, log)
+		if breaker != nil {
+			webhookHandler.SetBreaker(breaker)
+		}
+		if presenceProcessor != nil {
+			webhookHandler.SetPresence(presenceProcessor)
+		}
+		if tenants != nil {
+			webhookHandler.SetTenants(tenants)
+		}
+		if limiter != nil {
+			webhookHandler.SetLimiter(limiter)
+		}
+
+		// Register routes
+		r.Post("/webhook", webhookHandler.Handle)
+
+		// Read API served from the state cache
+		if stateCache != nil {
+			stateHandler := handler.NewStateHandler(stateCache,
+				cfg.ReadAPI.DefaultPageSize, cfg.ReadAPI.MaxPageSize, cfg.GetStaleAfter(), log)
+			stateHandler.Routes(r)
+		}
+
+		// Downlink command API
+		if commandService != nil {
+			commandHandler := handler.NewCommandHandler(commandService, cfg.Commands.APIToken, log)
+			commandHandler.Routes(r)
+		}
+		if shadowService != nil {
+			shadowHandler := handler.NewShadowHandler(shadowService, cfg.Commands.APIToken, log)
+			shadowHandler.Routes(r)
+		}
 
-	// Register routes
-	r.Post("/webhook", webhookHandler.Handle)
+		// Readiness turns false as soon as shutdown begins
+		r.Get("/ready", lc.ReadyHandler)
 
-	// Health check endpoint
-	r.Get("/health", func(w http.ResponseWriter, r *http.Request) {
-		w.Header().Set("Content-Type", "application/json")
-		fmt.Fprintf(w, `{"status":"healthy","version":"%s","time":"%s"}`,
-			cfg.Meta.Version, time.Now().Format(time.RFC3339))
+		// Health check endpoint
+		r.Get("/health", func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "application/json")
+			fmt.Fprintf(w, `{"status":"healthy","version":"%s","time":"%s"}`,
+				cfg.Meta.Version, time.Now().Format(time.RFC3339))
+		})
 	})
 
 	// Start HTTP server
@@ -115,21 +572,328 @@ func main() {
 		}
 	}()
 
+	// Start the admin server on its own listener
+	var adminSrv *http.Server
+	if cfg.Admin.Enabled {
+		adminHandler := admin.NewHandler(cfg, registry, deadLetter, log)
+		if sinkDispatcher != nil {
+			for _, q := range sinkDispatcher.Queues() {
+				adminHandler.AddQueue(q)
+			}
+		}
+		if statements != nil {
+			adminHandler.AddStatements(primaryTenant.ID, statements)
+		}
+		for id, ts := range tenantStatements {
+			adminHandler.AddStatements(id, ts)
+		}
+		if tenants != nil {
+			adminHandler.SetTenants(tenants)
+			for _, t := range tenants.Tenants() {
+				for _, c := range tenantCoalescers[t.ID] {
+					adminHandler.AddTenantQueue(t.ID, c)
+				}
+			}
+		} else {
+			for _, c := range coalescers {
+				adminHandler.AddQueue(c)
+			}
+		}
+		if limiter != nil {
+			adminHandler.AddQueue(limiter)
+			adminHandler.SetRateLimiter(limiter)
+		}
+		adminSrv = &http.Server{
+			Addr:         cfg.GetAdminAddr(),
+			Handler:      adminHandler.Router(),
+			ReadTimeout:  cfg.GetReadTimeout(),
+			WriteTimeout: cfg.GetWriteTimeout(),
+			IdleTimeout:  cfg.GetIdleTimeout(),
+		}
+
+		go func() {
+			log.Info("Starting admin server", "addr", cfg.GetAdminAddr())
+			if err := adminSrv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+				log.Fatal("Admin server error", "error", err)
+			}
+		}()
+	}
+
+	// Shut down in phases: stop taking webhooks, write what is pending and
+	// replay the dead-letter spool, and close the databases last
+	lc.SetReadyDelay(cfg.GetShutdownReadyDelay())
+	lc.AddPhase("http", cfg.GetShutdownHTTPTimeout())
+	lc.AddPhase("drain", cfg.GetShutdownDrainTimeout()+cfg.GetShutdownSpoolTimeout())
+	lc.AddPhase("close", cfg.GetShutdownCloseTimeout())
+
+	// Close stream connections first, Shutdown does not wait for them otherwise
+	if streamHub != nil {
+		lc.AddStep("http", "stream", func(ctx context.Context) (int, error) {
+			streamHub.Close()
+			return 0, nil
+		})
+	}
+	lc.AddStep("http", "server", func(ctx context.Context) (int, error) {
+		return 0, srv.Shutdown(ctx)
+	})
+
+	// Background workers stop before the work they feed is drained
+	lc.AddStep("drain", "background", func(ctx context.Context) (int, error) {
+		stopBackground()
+		return 0, nil
+	})
+	// Write the latest state of throttled clients, then the final state of
+	// every coalesced key
+	if limiter != nil {
+		lc.AddStep("drain", limiter.Name(), func(ctx context.Context) (int, error) {
+			return limiter.Flush(ctx), nil
+		})
+	}
+	for _, c := range coalescers {
+		lc.AddStep("drain", c.Name(), func(ctx context.Context) (int, error) {
+			return c.Flush(ctx), nil
+		})
+	}
+	// Replay the dead-letter spool after the pending messages, which are
+	// newer, were written; replayed webhooks older than the stored status
+	// are skipped, and the sinks still run. Spooled webhooks are kept on
+	// disk, so a replay cut short loses nothing.
+	if deadLetter != nil && db != nil {
+		lc.AddStep("drain", deadLetter.Name(), func(ctx context.Context) (int, error) {
+			if deadLetter.Depth() == 0 || (breaker != nil && breaker.State() != database.BreakerClosed) {
+				return 0, nil
+			}
+			ctx, cancel := context.WithTimeout(ctx, cfg.GetShutdownSpoolTimeout())
+			defer cancel()
+			res, err := deadLetter.Replay(ctx, dispatch)
+			if res.Remaining > 0 {
+				log.Info("Dead-letter entries kept for the next start", "remaining", res.Remaining)
+			}
+			return 0, err
+		})
+	}
+	if sinkDispatcher != nil {
+		lc.AddStep("drain", "sinks", func(ctx context.Context) (int, error) {
+			err := sinkDispatcher.Close(ctx)
+			return sinkDispatcher.Abandoned(), err
+		})
+	}
+
+	if adminSrv != nil {
+		lc.AddStep("close", "admin", func(ctx context.Context) (int, error) {
+			return 0, adminSrv.Shutdown(ctx)
+		})
+	}
+	// Flush any spans still buffered by the exporter
+	lc.AddStep("close", "tracing", func(ctx context.Context) (int, error) {
+		return 0, shutdownTracing(ctx)
+	})
+	// Steps left behind by their timeout may still write to the databases
+	lc.AddClosingStep("close", "database", func(ctx context.Context) (int, error) {
+		for i := len(closeDatabases) - 1; i >= 0; i-- {
+			closeDatabases[i]()
+		}
+		return 0, nil
+	})
+
+	lc.SetReady()
+
 	// Wait for interrupt signal to gracefully shut down the server
 	quit := make(chan os.Signal, 1)
 	signal.Notify(quit, syscall.SIGINT, syscall.SIGTERM)
 	<-quit
 
 	log.Info("Shutting down server...")
+	lc.Shutdown()
 
-	// Create shutdown context with 10 second timeout
-	ctx, cancel = context.WithTimeout(context.Background(), 10*time.Second)
-	defer cancel()
+	log.Info("Server exited properly")
+}
+
+// newSink creates the sink described by sc
+func newSink(ctx context.Context, sc *config.SinkConfig) (sink.Sink, error) {
+	switch sc.Type {
+	case "ndjson":
+		return sink.NewNDJSONSink(sc.Name, sc.Path)
+	case "http":
+		return sink.NewHTTPSink(sc.Name, sc.URL, sc.Headers, sc.GetTimeout()), nil
+	case "kafka":
+		return sink.NewKafkaSink(sc.Name, sc.Brokers, sc.Topic, sc.GetTimeout()), nil
+	case "postgres":
+		return sink.NewPostgresSink(ctx, sc.Name, sc.DatabaseURL, sc.Table)
+	default:
+		return nil, fmt.Errorf("unknown sink type: %s", sc.Type)
+	}
+}
 
-	// Shutdown the server
-	if err := srv.Shutdown(ctx); err != nil {
-		log.Fatal("Server forced to shutdown", "error", err)
+// newEnvProcessor creates the environment sensor processor of a database
+func newEnvProcessor(cfg *config.Config, pool *pgxpool.Pool, statements *processor.StatementRegistry, log *logger.Logger) *processor.EnvProcessor {
+	ranges := make(map[string]processor.Range, len(cfg.EnvSensor.Ranges))
+	for reading, rng := range cfg.EnvSensor.Ranges {
+		ranges[reading] = processor.Range{Min: rng.Min, Max: rng.Max}
+	}
+	smoother := processor.NewSmoother(cfg.EnvSensor.Smoothing.Method,
+		cfg.EnvSensor.Smoothing.Alpha, cfg.EnvSensor.Smoothing.Window)
+	p := processor.NewEnvProcessor(pool, cfg.EnvSensor.DeviceType, ranges, smoother, log)
+	p.SetRetryPolicy(cfg.GetDatabaseRetryPolicy())
+	if statements != nil {
+		p.SetStatements(statements)
 	}
+	return p
+}
 
-	log.Info("Server exited properly")
+// applyUpdateModes applies the per-processor update modes to the processors
+// of a registry
+func applyUpdateModes(cfg *config.Config, registry *processor.ProcessorRegistry, log *logger.Logger) {
+	for deviceType, pc := range cfg.Processors {
+		if pc.UpdateMode == "" {
+			continue
+		}
+		p, ok := registry.Get(deviceType)
+		setter, supported := processor.Unwrap(p).(processor.UpdateModeSetter)
+		if !ok || !supported {
+			log.Warn("Update mode configured for a processor that does not support it", "deviceType", deviceType)
+			continue
+		}
+		mode := cfg.GetUpdateMode(deviceType)
+		setter.SetUpdateMode(mode)
+		log.Info("Processor update mode", "deviceType", deviceType,
+			"mode", mode.Mode, "arrayStrategy", mode.ArrayStrategy)
+	}
+}
+
+// applyCoalescing wraps the processors of a tenant's registry configured for
+// last-value coalescing and returns the coalescers. Coalesced messages
+// failing permanently go to deadLetter, if enabled.
+func applyCoalescing(cfg *config.Config, tenantID string, registry *processor.ProcessorRegistry, deadLetter *spool.Spool, log *logger.Logger) []*processor.Coalescer {
+	var coalescers []*processor.Coalescer
+	for deviceType, pc := range cfg.Processors {
+		if !pc.Coalesce.Enabled {
+			continue
+		}
+		p, ok := registry.GetProcessors()[deviceType]
+		if !ok {
+			continue
+		}
+		c := processor.NewCoalescer(p, pc.Coalesce.Key, cfg.GetCoalesceInterval(deviceType), log)
+		if deadLetter != nil {
+			c.SetOnFailure(func(deviceType string, data *models.WebhookData, err error) {
+				if spoolErr := deadLetter.Put(tenantID, deviceType, data, err); spoolErr != nil {
+					log.Error("Failed to dead-letter coalesced message", "deviceType", deviceType, "error", spoolErr)
+				}
+			})
+		}
+		registry.Register(c)
+		coalescers = append(coalescers, c)
+		log.Info("Processor coalescing", "deviceType", deviceType,
+			"key", pc.Coalesce.Key, "interval", cfg.GetCoalesceInterval(deviceType))
+	}
+	return coalescers
+}
+
+// tenantDatabase is the database a tenant does not share with the primary
+// tenant
+type tenantDatabase struct {
+	db         *database.Postgres
+	statements *processor.StatementRegistry
+}
+
+// newTenant builds the processors of a secondary tenant. A tenant with its
+// own database URL or schema gets its own pool, returned so it can be
+// closed; others share mainDB and its statements.
+func newTenant(ctx context.Context, cfg *config.Config, tc *config.TenantConfig, mainDB *database.Postgres, mainStatements *processor.StatementRegistry, log *logger.Logger) (*tenant.Tenant, *tenantDatabase, error) {
+	log = log.With("tenant", tc.ID)
+
+	db, statements := mainDB, mainStatements
+	var tdb *tenantDatabase
+	if tc.DatabaseURL != "" || tc.Schema != "" {
+		tenantCfg, err := cfg.ForTenant(tc)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		var preparer database.StatementPreparer
+		statements = nil
+		if !cfg.Database.SkipPreparedStatements {
+			statements = processor.NewStatementRegistry()
+			preparer = statements
+		}
+		if db, err = database.NewPostgres(ctx, tenantCfg, preparer, log); err != nil {
+			return nil, nil, err
+		}
+		tdb = &tenantDatabase{db: db, statements: statements}
+
+		if !cfg.Database.SkipMigrations {
+			if tc.Schema != "" {
+				if err := db.CreateSchema(ctx, tc.Schema); err != nil {
+					db.Close()
+					return nil, nil, err
+				}
+			}
+			if err := db.Migrate(ctx); err != nil {
+				db.Close()
+				return nil, nil, fmt.Errorf("failed to apply database migrations: %w", err)
+			}
+		}
+		// Only the tenant schema is on the search path, so a schema that
+		// was never migrated must not start serving
+		if err := db.CheckBaseSchema(ctx); err != nil {
+			db.Close()
+			return nil, nil, err
+		}
+	}
+
+	store := processor.NewPostgresStore(db.Pool, log)
+	store.SetRetryPolicy(cfg.GetDatabaseRetryPolicy())
+	if statements != nil {
+		store.SetStatements(statements)
+	}
+
+	processors := []processor.Processor{
+		processor.NewCenterProcessor(store, log),
+		processor.NewNormalProcessor(store, log),
+	}
+	var envProcessor *processor.EnvProcessor
+	if cfg.EnvSensor.Enabled {
+		envProcessor = newEnvProcessor(cfg, db.Pool, statements, log)
+		processors = append(processors, envProcessor)
+	}
+	if cfg.Notify.Enabled {
+		notifier := processor.NewNotifier(cfg.Notify.RoomChannel, cfg.Notify.DeviceChannel)
+		if statements != nil {
+			notifier.SetStatements(statements)
+		}
+		store.SetNotifier(notifier)
+		if envProcessor != nil {
+			envProcessor.SetNotifier(notifier)
+		}
+	}
+
+	t := &tenant.Tenant{
+		ID:       tc.ID,
+		Registry: processor.NewProcessorRegistry(log),
+		AuthKeys: tc.AuthKeys,
+	}
+	if cfg.Presence.Enabled && tc.Serves(processor.PresenceType) {
+		t.Presence = processor.NewPresenceProcessor(db.Pool, cfg.Presence.ClientIDMatch, log)
+		t.Presence.SetRetryPolicy(cfg.GetDatabaseRetryPolicy())
+		if statements != nil {
+			t.Presence.SetStatements(statements)
+		}
+		processors = append(processors, t.Presence)
+	}
+	for _, p := range processors {
+		if tc.Serves(p.Type()) {
+			t.Registry.Register(p)
+		}
+	}
+	applyUpdateModes(cfg, t.Registry, log)
+
+	// Statements on the main database are validated with the primary tenant's
+	if tdb != nil && statements != nil {
+		if err := statements.Validate(ctx, db.Pool); err != nil {
+			db.Close()
+			return nil, nil, fmt.Errorf("processor statements do not match the database schema: %w", err)
+		}
+	}
+	return t, tdb, nil
 }
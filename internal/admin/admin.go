@@ -0,0 +1,295 @@
+package admin
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/chi/v5/middleware"
+	"gopkg.in/yaml.v3"
+
+	"github.com/NieRVoid/emqx-pg-bridge/internal/config"
+	"github.com/NieRVoid/emqx-pg-bridge/internal/processor"
+	"github.com/NieRVoid/emqx-pg-bridge/internal/ratelimit"
+	"github.com/NieRVoid/emqx-pg-bridge/internal/spool"
+	"github.com/NieRVoid/emqx-pg-bridge/internal/tenant"
+	"github.com/NieRVoid/emqx-pg-bridge/pkg/logger"
+)
+
+// DepthReporter is implemented by anything holding work in a queue or spool
+type DepthReporter interface {
+	Name() string
+	Depth() int
+}
+
+// QueueDepth is one entry of the queue depth listing
+type QueueDepth struct {
+	// Tenant is set for the queues of a single tenant
+	Tenant string `json:"tenant,omitempty"`
+	Name   string `json:"name"`
+	Depth  int    `json:"depth"`
+}
+
+// Handler serves the admin API
+type Handler struct {
+	cfg        *config.Config
+	registry   *processor.ProcessorRegistry
+	deadLetter *spool.Spool
+	dispatch   spool.DispatchFunc
+	tenants    *tenant.Resolver
+	limiter    *ratelimit.Limiter
+	rootLog    *logger.Logger
+	log        *logger.Logger
+
+	mu         sync.RWMutex
+	queues     []tenantQueue
+	statements []tenantStatements
+}
+
+// tenantQueue is a reported queue and the tenant it belongs to, if any
+type tenantQueue struct {
+	tenant string
+	queue  DepthReporter
+}
+
+// tenantStatements are the prepared statements of one database
+type tenantStatements struct {
+	tenant   string
+	registry *processor.StatementRegistry
+}
+
+// NewHandler creates a new admin API handler. deadLetter may be nil when the
+// dead-letter spool is disabled.
+func NewHandler(cfg *config.Config, registry *processor.ProcessorRegistry, deadLetter *spool.Spool, log *logger.Logger) *Handler {
+	h := &Handler{
+		cfg:        cfg,
+		registry:   registry,
+		deadLetter: deadLetter,
+		dispatch:   registry.Dispatch,
+		rootLog:    log,
+		log:        log.Component("admin"),
+	}
+	if deadLetter != nil {
+		h.AddQueue(deadLetter)
+	}
+	return h
+}
+
+// AddQueue registers a queue or spool whose depth is reported by the API
+func (h *Handler) AddQueue(q DepthReporter) {
+	h.AddTenantQueue("", q)
+}
+
+// AddTenantQueue registers a queue of a single tenant, reported with the
+// tenant id
+func (h *Handler) AddTenantQueue(tenant string, q DepthReporter) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.queues = append(h.queues, tenantQueue{tenant: tenant, queue: q})
+}
+
+// AddStatements adds prepared processor statements to the latency report.
+// tenant labels them when statements of several tenants are added.
+func (h *Handler) AddStatements(tenant string, r *processor.StatementRegistry) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.statements = append(h.statements, tenantStatements{tenant: tenant, registry: r})
+}
+
+// SetTenants reports and switches the processors of every tenant of r and
+// replays the dead-letter spool through r instead of the registry. It must
+// be called before the handler serves requests.
+func (h *Handler) SetTenants(r *tenant.Resolver) {
+	h.tenants = r
+	h.dispatch = r.Dispatch
+}
+
+// SetRateLimiter reports the traffic counters of l. It must be called
+// before the handler serves requests.
+func (h *Handler) SetRateLimiter(l *ratelimit.Limiter) {
+	h.limiter = l
+}
+
+// Router returns the admin routes, all behind token authentication
+func (h *Handler) Router() http.Handler {
+	r := chi.NewRouter()
+	r.Use(middleware.RequestID)
+	r.Use(middleware.Recoverer)
+	r.Use(h.authenticate)
+
+	r.Get("/processors", h.listProcessors)
+	r.Post("/processors/{type}/enable", h.setProcessorEnabled(true))
+	r.Post("/processors/{type}/disable", h.setProcessorEnabled(false))
+	r.Get("/log/level", h.getLogLevel)
+	r.Put("/log/level", h.setLogLevel)
+	r.Get("/queues", h.listQueues)
+	r.Get("/statements", h.listStatements)
+	r.Get("/rate-limits", h.listRateLimits)
+	r.Get("/config", h.dumpConfig)
+	r.Post("/dead-letter/replay", h.replayDeadLetter)
+
+	return r
+}
+
+// authenticate requires "Authorization: Bearer <admin token>"
+func (h *Handler) authenticate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || subtle.ConstantTimeCompare([]byte(token), []byte(h.cfg.Admin.Token)) != 1 {
+			h.log.Warn("Rejected admin request", "path", r.URL.Path, "remoteAddr", r.RemoteAddr)
+			w.Header().Set("WWW-Authenticate", `Bearer realm="admin"`)
+			writeError(w, http.StatusUnauthorized, "unauthorized")
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (h *Handler) listProcessors(w http.ResponseWriter, r *http.Request) {
+	if h.tenants == nil {
+		writeJSON(w, http.StatusOK, h.registry.Statuses())
+		return
+	}
+
+	statuses := []processor.Status{}
+	for _, t := range h.tenants.Tenants() {
+		for _, st := range t.Registry.Statuses() {
+			st.Tenant = t.ID
+			statuses = append(statuses, st)
+		}
+	}
+	writeJSON(w, http.StatusOK, statuses)
+}
+
+// setProcessorEnabled switches a processor of the primary tenant, or of the
+// tenant named by the tenant query parameter
+func (h *Handler) setProcessorEnabled(enabled bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		deviceType := chi.URLParam(r, "type")
+		registry := h.registry
+		tenantID := r.URL.Query().Get("tenant")
+		if tenantID != "" {
+			t, ok := h.tenantByID(tenantID)
+			if !ok {
+				writeError(w, http.StatusNotFound, tenant.ErrUnknownTenant.Error())
+				return
+			}
+			registry = t.Registry
+		}
+
+		if err := registry.SetEnabled(deviceType, enabled); err != nil {
+			if errors.Is(err, processor.ErrUnknownProcessor) {
+				writeError(w, http.StatusNotFound, err.Error())
+				return
+			}
+			writeError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		h.log.Info("Processor state changed via admin API", "tenant", tenantID, "type", deviceType, "enabled", enabled)
+		writeJSON(w, http.StatusOK, processor.Status{Tenant: tenantID, Type: deviceType, Enabled: enabled})
+	}
+}
+
+func (h *Handler) tenantByID(id string) (*tenant.Tenant, bool) {
+	if h.tenants == nil {
+		return nil, false
+	}
+	return h.tenants.Get(id)
+}
+
+type logLevelBody struct {
+	Level string `json:"level"`
+}
+
+func (h *Handler) getLogLevel(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, logLevelBody{Level: h.rootLog.Level()})
+}
+
+func (h *Handler) setLogLevel(w http.ResponseWriter, r *http.Request) {
+	var body logLevelBody
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 4096)).Decode(&body); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid request body")
+		return
+	}
+	if err := h.rootLog.SetLevel(body.Level); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	h.log.Info("Log level changed via admin API", "level", h.rootLog.Level())
+	writeJSON(w, http.StatusOK, logLevelBody{Level: h.rootLog.Level()})
+}
+
+func (h *Handler) listQueues(w http.ResponseWriter, r *http.Request) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	depths := make([]QueueDepth, 0, len(h.queues))
+	for _, tq := range h.queues {
+		depths = append(depths, QueueDepth{Tenant: tq.tenant, Name: tq.queue.Name(), Depth: tq.queue.Depth()})
+	}
+	writeJSON(w, http.StatusOK, depths)
+}
+
+func (h *Handler) listStatements(w http.ResponseWriter, r *http.Request) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	stats := []processor.StatementStats{}
+	for _, ts := range h.statements {
+		for _, st := range ts.registry.Stats() {
+			if len(h.statements) > 1 {
+				st.Tenant = ts.tenant
+			}
+			stats = append(stats, st)
+		}
+	}
+	writeJSON(w, http.StatusOK, stats)
+}
+
+func (h *Handler) listRateLimits(w http.ResponseWriter, r *http.Request) {
+	if h.limiter == nil {
+		writeJSON(w, http.StatusOK, []ratelimit.Stats{})
+		return
+	}
+	writeJSON(w, http.StatusOK, h.limiter.Stats())
+}
+
+func (h *Handler) dumpConfig(w http.ResponseWriter, r *http.Request) {
+	out, err := yaml.Marshal(h.cfg.Masked())
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "failed to encode configuration")
+		return
+	}
+	w.Header().Set("Content-Type", "application/yaml")
+	w.WriteHeader(http.StatusOK)
+	w.Write(out)
+}
+
+func (h *Handler) replayDeadLetter(w http.ResponseWriter, r *http.Request) {
+	if h.deadLetter == nil {
+		writeError(w, http.StatusNotFound, "dead-letter spool is disabled")
+		return
+	}
+
+	// Replay runs to completion even if the admin client disconnects midway
+	result, err := h.deadLetter.Replay(context.WithoutCancel(r.Context()), h.dispatch)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, result)
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, status int, msg string) {
+	writeJSON(w, status, map[string]string{"error": msg})
+}
@@ -0,0 +1,256 @@
+package alert
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+
+	"github.com/NieRVoid/emqx-pg-bridge/pkg/logger"
+)
+
+// Incident subjects
+const (
+	SubjectRoom   = "room"
+	SubjectDevice = "device"
+)
+
+// Thresholds defines how long rooms and devices may stay silent
+type Thresholds struct {
+	// Room applies to room_status.updated_at; zero disables room checks
+	Room time.Duration
+	// DeviceDefault applies to device types without their own threshold;
+	// zero only checks the listed types
+	DeviceDefault time.Duration
+	// DeviceTypes maps devices.type to its threshold
+	DeviceTypes map[string]time.Duration
+}
+
+// Detector scans for rooms and devices that stopped reporting, records
+// incidents and notifies when they open and resolve
+type Detector struct {
+	db         *pgxpool.Pool
+	thresholds Thresholds
+	notifiers  []Notifier
+	timeout    time.Duration
+	log        *logger.Logger
+}
+
+// NewDetector creates a new staleness detector
+func NewDetector(db *pgxpool.Pool, thresholds Thresholds, notifiers []Notifier, log *logger.Logger) *Detector {
+	return &Detector{
+		db:         db,
+		thresholds: thresholds,
+		notifiers:  notifiers,
+		timeout:    30 * time.Second,
+		log:        log.Component("alert"),
+	}
+}
+
+// Run scans every interval until ctx is cancelled
+func (d *Detector) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := d.Scan(ctx); err != nil && ctx.Err() == nil {
+				d.log.Error("Staleness scan failed", "error", err)
+			}
+		}
+	}
+}
+
+// Scan opens incidents for silent rooms and devices, resolves incidents of
+// those reporting again and sends any pending notifications
+func (d *Detector) Scan(ctx context.Context) error {
+	if err := d.openIncidents(ctx); err != nil {
+		return err
+	}
+	if err := d.resolveIncidents(ctx); err != nil {
+		return err
+	}
+	return d.notifyPending(ctx)
+}
+
+func (d *Detector) openIncidents(ctx context.Context) error {
+	if d.thresholds.Room > 0 {
+		tag, err := d.db.Exec(ctx, `
+			INSERT INTO incidents (subject, subject_id, threshold_seconds, last_seen_at)
+			SELECT $1, rs.room_id, $2::integer, rs.updated_at
+			FROM room_status rs
+			WHERE rs.updated_at < NOW() - $2::integer * interval '1 second'
+			ON CONFLICT (subject, subject_id) WHERE resolved_at IS NULL DO NOTHING`,
+			SubjectRoom, int(d.thresholds.Room.Seconds()))
+		if err != nil {
+			return err
+		}
+		if tag.RowsAffected() > 0 {
+			d.log.Warn("Rooms stopped reporting", "count", tag.RowsAffected())
+		}
+	}
+
+	types := make([]string, 0, len(d.thresholds.DeviceTypes))
+	seconds := make([]int32, 0, len(d.thresholds.DeviceTypes))
+	for t, threshold := range d.thresholds.DeviceTypes {
+		types = append(types, t)
+		seconds = append(seconds, int32(threshold.Seconds()))
+	}
+
+	tag, err := d.db.Exec(ctx, `
+		WITH thresholds AS (
+			SELECT * FROM unnest($2::text[], $3::integer[]) AS t(type, seconds)
+		)
+		INSERT INTO incidents (subject, subject_id, threshold_seconds, last_seen_at)
+		SELECT $1, ds.device_id, COALESCE(t.seconds, $4::integer), ds.last_reported_at
+		FROM device_status ds
+		JOIN devices dv ON dv.id = ds.device_id
+		LEFT JOIN thresholds t ON t.type = dv.type
+		WHERE COALESCE(t.seconds, $4::integer) > 0
+			AND ds.last_reported_at < NOW() - COALESCE(t.seconds, $4::integer) * interval '1 second'
+		ON CONFLICT (subject, subject_id) WHERE resolved_at IS NULL DO NOTHING`,
+		SubjectDevice, types, seconds, int(d.thresholds.DeviceDefault.Seconds()))
+	if err != nil {
+		return err
+	}
+	if tag.RowsAffected() > 0 {
+		d.log.Warn("Devices stopped reporting", "count", tag.RowsAffected())
+	}
+	return nil
+}
+
+// resolveIncidents closes incidents whose subject reported after it went silent
+func (d *Detector) resolveIncidents(ctx context.Context) error {
+	tag, err := d.db.Exec(ctx, `
+		UPDATE incidents i SET resolved_at = NOW()
+		FROM room_status rs
+		WHERE i.subject = $1 AND i.resolved_at IS NULL
+			AND rs.room_id = i.subject_id
+			AND rs.updated_at > i.last_seen_at`, SubjectRoom)
+	if err != nil {
+		return err
+	}
+	resolved := tag.RowsAffected()
+
+	tag, err = d.db.Exec(ctx, `
+		UPDATE incidents i SET resolved_at = NOW()
+		FROM device_status ds
+		WHERE i.subject = $1 AND i.resolved_at IS NULL
+			AND ds.device_id = i.subject_id
+			AND ds.last_reported_at > i.last_seen_at`, SubjectDevice)
+	if err != nil {
+		return err
+	}
+	resolved += tag.RowsAffected()
+
+	if resolved > 0 {
+		d.log.Info("Incidents resolved", "count", resolved)
+	}
+	return nil
+}
+
+// pendingQuery selects the next incident whose stale or recovery notification
+// has not been delivered yet, skipping the ids in $1. Rows are locked so that several bridge instances never
+// send the same notification; an incident resolved before its stale alert
+// went out gets no recovery message either.
+const pendingQuery = `
+	SELECT i.id, i.subject, i.subject_id, COALESCE(r.name, dv.name, ''), COALESCE(dv.type, ''),
+		i.last_seen_at, i.threshold_seconds, i.opened_at, i.resolved_at
+	FROM incidents i
+	LEFT JOIN rooms r ON i.subject = 'room' AND r.id = i.subject_id
+	LEFT JOIN devices dv ON i.subject = 'device' AND dv.id = i.subject_id
+	WHERE ((i.resolved_at IS NULL AND i.notified_at IS NULL)
+			OR (i.resolved_at IS NOT NULL AND i.notified_at IS NOT NULL AND i.recovery_notified_at IS NULL))
+		AND NOT (i.id = ANY($1::bigint[]))
+	ORDER BY i.id
+	LIMIT 1
+	FOR UPDATE OF i SKIP LOCKED`
+
+// notifyPending delivers pending notifications one incident at a time
+func (d *Detector) notifyPending(ctx context.Context) error {
+	if len(d.notifiers) == 0 {
+		return nil
+	}
+
+	// Incidents whose notification fails stay pending and are retried on
+	// the next scan rather than blocking the others
+	skip := make(map[int64]bool)
+	for ctx.Err() == nil {
+		sent, id, err := d.notifyNext(ctx, skip)
+		if err != nil {
+			return err
+		}
+		if id == 0 {
+			return nil
+		}
+		if !sent {
+			skip[id] = true
+		}
+	}
+	return nil
+}
+
+func (d *Detector) notifyNext(ctx context.Context, skip map[int64]bool) (bool, int64, error) {
+	tx, err := d.db.Begin(ctx)
+	if err != nil {
+		return false, 0, err
+	}
+	defer tx.Rollback(ctx)
+
+	skipped := make([]int64, 0, len(skip))
+	for id := range skip {
+		skipped = append(skipped, id)
+	}
+
+	var a Alert
+	err = tx.QueryRow(ctx, pendingQuery, skipped).Scan(&a.IncidentID, &a.Subject, &a.SubjectID, &a.Name, &a.Type,
+		&a.LastSeenAt, &a.ThresholdSeconds, &a.OpenedAt, &a.ResolvedAt)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return false, 0, nil
+	}
+	if err != nil {
+		return false, 0, err
+	}
+
+	a.Kind = KindStale
+	column := "notified_at"
+	if a.ResolvedAt != nil {
+		a.Kind = KindRecovered
+		column = "recovery_notified_at"
+	}
+
+	log := d.log.With("incidentId", a.IncidentID, "subject", a.Subject, "subjectId", a.SubjectID, "event", a.Kind)
+	if !d.deliver(ctx, &a, log) {
+		return false, a.IncidentID, nil
+	}
+
+	if _, err := tx.Exec(ctx, `UPDATE incidents SET `+column+` = NOW() WHERE id = $1`, a.IncidentID); err != nil {
+		return false, 0, err
+	}
+	if err := tx.Commit(ctx); err != nil {
+		return false, 0, err
+	}
+	log.Info("Alert sent", "summary", a.Summary())
+	return true, a.IncidentID, nil
+}
+
+// deliver sends the alert to every notifier and reports whether all succeeded.
+// A partial failure is retried on all notifiers, so channels may see repeats.
+func (d *Detector) deliver(ctx context.Context, a *Alert, log *logger.Logger) bool {
+	ctx, cancel := context.WithTimeout(ctx, d.timeout)
+	defer cancel()
+
+	ok := true
+	for _, n := range d.notifiers {
+		if err := n.Notify(ctx, a); err != nil {
+			log.Error("Failed to send alert", "notifier", n.Name(), "error", err)
+			ok = false
+		}
+	}
+	return ok
+}
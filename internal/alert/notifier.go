@@ -0,0 +1,151 @@
+package alert
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/smtp"
+	"strings"
+	"time"
+)
+
+// Alert kinds
+const (
+	KindStale     = "stale"
+	KindRecovered = "recovered"
+)
+
+// Alert describes an incident being opened or resolved
+type Alert struct {
+	Kind             string     `json:"event"`
+	IncidentID       int64      `json:"incidentId"`
+	Subject          string     `json:"subject"`
+	SubjectID        int        `json:"id"`
+	Name             string     `json:"name"`
+	Type             string     `json:"type,omitempty"`
+	LastSeenAt       time.Time  `json:"lastSeenAt"`
+	ThresholdSeconds int        `json:"thresholdSeconds"`
+	OpenedAt         time.Time  `json:"openedAt"`
+	ResolvedAt       *time.Time `json:"resolvedAt,omitempty"`
+}
+
+// Summary returns a one-line description of the alert
+func (a *Alert) Summary() string {
+	if a.Kind == KindRecovered {
+		return fmt.Sprintf("%s %s (#%d) is reporting again", a.Subject, a.Name, a.SubjectID)
+	}
+	return fmt.Sprintf("%s %s (#%d) silent since %s", a.Subject, a.Name, a.SubjectID,
+		a.LastSeenAt.Format(time.RFC3339))
+}
+
+// Notifier delivers alerts to an outbound channel
+type Notifier interface {
+	Name() string
+	Notify(ctx context.Context, a *Alert) error
+}
+
+// WebhookNotifier posts alerts as JSON to a URL
+type WebhookNotifier struct {
+	url     string
+	headers map[string]string
+	client  *http.Client
+}
+
+// NewWebhookNotifier creates a notifier posting to url with the given extra headers
+func NewWebhookNotifier(url string, headers map[string]string, timeout time.Duration) *WebhookNotifier {
+	return &WebhookNotifier{
+		url:     url,
+		headers: headers,
+		client:  &http.Client{Timeout: timeout},
+	}
+}
+
+// Name implements Notifier
+func (n *WebhookNotifier) Name() string {
+	return "webhook"
+}
+
+// Notify implements Notifier
+func (n *WebhookNotifier) Notify(ctx context.Context, a *Alert) error {
+	body, err := json.Marshal(a)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, n.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range n.headers {
+		req.Header.Set(k, v)
+	}
+
+	resp, err := n.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 4096))
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("alert webhook returned %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// SMTPNotifier mails alerts through an SMTP relay
+type SMTPNotifier struct {
+	addr string
+	from string
+	to   []string
+	auth smtp.Auth
+}
+
+// NewSMTPNotifier creates a notifier sending through the relay at addr
+// (host:port). Authentication is only used when username is set.
+func NewSMTPNotifier(addr, from string, to []string, username, password string) *SMTPNotifier {
+	n := &SMTPNotifier{addr: addr, from: from, to: to}
+	if username != "" {
+		host, _, _ := strings.Cut(addr, ":")
+		n.auth = smtp.PlainAuth("", username, password, host)
+	}
+	return n
+}
+
+// Name implements Notifier
+func (n *SMTPNotifier) Name() string {
+	return "smtp"
+}
+
+// Notify implements Notifier
+func (n *SMTPNotifier) Notify(ctx context.Context, a *Alert) error {
+	details, err := json.MarshalIndent(a, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	var msg bytes.Buffer
+	fmt.Fprintf(&msg, "From: %s\r\n", n.from)
+	fmt.Fprintf(&msg, "To: %s\r\n", strings.Join(n.to, ", "))
+	fmt.Fprintf(&msg, "Subject: [emqx-pg-bridge] %s: %s\r\n", strings.ToUpper(a.Kind), a.Summary())
+	fmt.Fprintf(&msg, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	fmt.Fprintf(&msg, "Content-Type: text/plain; charset=utf-8\r\n\r\n")
+	fmt.Fprintf(&msg, "%s\r\n\r\n%s\r\n", a.Summary(), details)
+
+	// net/smtp has no context support; run it so a hung relay does not
+	// outlive the scan
+	done := make(chan error, 1)
+	go func() {
+		done <- smtp.SendMail(n.addr, n.auth, n.from, n.to, msg.Bytes())
+	}()
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,18 @@
+package backoff
+
+import (
+	"math/rand"
+	"time"
+)
+
+// Delay returns the delay before the given retry (1-based): initial doubled
+// with every retry and capped at max, with equal jitter. Half of the delay is
+// kept and the other half drawn at random, so retries of many clients spread
+// out while none comes sooner than half the nominal delay.
+func Delay(retry int, initial, max time.Duration) time.Duration {
+	d := initial << (retry - 1)
+	if d <= 0 || d > max {
+		d = max
+	}
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+}
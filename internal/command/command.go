@@ -0,0 +1,315 @@
+package command
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+
+	"github.com/NieRVoid/emqx-pg-bridge/internal/models"
+	"github.com/NieRVoid/emqx-pg-bridge/internal/processor"
+	"github.com/NieRVoid/emqx-pg-bridge/pkg/logger"
+)
+
+// Command statuses
+const (
+	StatusPending    = "pending"
+	StatusPublished  = "published"
+	StatusAcked      = "acked"
+	StatusFailed     = "failed"
+	StatusExpired    = "expired"
+	StatusSuperseded = "superseded"
+)
+
+// Common errors
+var (
+	ErrDeviceNotFound  = errors.New("device not found")
+	ErrCommandNotFound = errors.New("command not found")
+	ErrInvalidDesired  = errors.New("desired state must be a JSON object")
+)
+
+// Command is a desired state sent to a device
+type Command struct {
+	ID          int64           `json:"id"`
+	DeviceID    int             `json:"deviceId"`
+	Desired     json.RawMessage `json:"desired"`
+	Topic       string          `json:"topic"`
+	Status      string          `json:"status"`
+	Error       *string         `json:"error,omitempty"`
+	CreatedAt   time.Time       `json:"createdAt"`
+	PublishedAt *time.Time      `json:"publishedAt,omitempty"`
+	AckedAt     *time.Time      `json:"ackedAt,omitempty"`
+	ExpiresAt   *time.Time      `json:"expiresAt,omitempty"`
+}
+
+const commandColumns = `id, device_id, desired, topic, status, error, created_at, published_at, acked_at, expires_at`
+
+// Statements of the command service
+var (
+	stmtLookupDevice = processor.Statement{Name: "device_commands.lookup_device", SQL: `
+		SELECT d.id, d.uuid::text, d.name, r.id, r.name, r.number
+		FROM devices d
+		JOIN rooms r ON r.id = d.room_id
+		WHERE d.id = $1`}
+
+	stmtSupersede = processor.Statement{Name: "device_commands.supersede", SQL: `
+		UPDATE device_commands SET status = $2
+		WHERE device_id = $1 AND status IN ($3, $4)`}
+
+	stmtInsert = processor.Statement{Name: "device_commands.insert", SQL: `
+		INSERT INTO device_commands (device_id, desired, topic, status, expires_at)
+		VALUES ($1, $2, $3, $4, NOW() + $5::float8 * interval '1 second')
+		RETURNING ` + commandColumns}
+
+	stmtFail = processor.Statement{Name: "device_commands.fail", SQL: `
+		UPDATE device_commands SET status = $2, error = $3
+		WHERE id = $1
+		RETURNING ` + commandColumns}
+
+	// stmtPublished only moves forward from pending; a fast device may
+	// already have acked
+	stmtPublished = processor.Statement{Name: "device_commands.published", SQL: `
+		UPDATE device_commands
+		SET status = CASE WHEN status = $2 THEN $3 ELSE status END,
+			published_at = NOW()
+		WHERE id = $1
+		RETURNING ` + commandColumns}
+
+	stmtGet = processor.Statement{Name: "device_commands.get", SQL: `
+		SELECT ` + commandColumns + ` FROM device_commands
+		WHERE id = $1 AND device_id = $2`}
+
+	stmtList = processor.Statement{Name: "device_commands.list", SQL: `
+		SELECT ` + commandColumns + ` FROM device_commands
+		WHERE device_id = $1
+		ORDER BY id DESC
+		LIMIT $2`}
+
+	stmtAck = processor.Statement{Name: "device_commands.ack", SQL: `
+		UPDATE device_commands SET status = $3, acked_at = NOW()
+		WHERE device_id = $1
+			AND status IN ($4, $5)
+			AND $2::jsonb @> desired
+		RETURNING id`}
+
+	stmtExpire = processor.Statement{Name: "device_commands.expire", SQL: `
+		UPDATE device_commands SET status = $1
+		WHERE status IN ($2, $3) AND expires_at < NOW()`}
+)
+
+func scanCommand(row pgx.Row) (*Command, error) {
+	var c Command
+	err := row.Scan(&c.ID, &c.DeviceID, &c.Desired, &c.Topic, &c.Status, &c.Error,
+		&c.CreatedAt, &c.PublishedAt, &c.AckedAt, &c.ExpiresAt)
+	if err != nil {
+		return nil, err
+	}
+	return &c, nil
+}
+
+// Service records desired-state commands, publishes them to devices and
+// acknowledges them when a device reports a matching status
+type Service struct {
+	db            *pgxpool.Pool
+	publisher     Publisher
+	topicTemplate string
+	qos           int
+	ackTimeout    time.Duration
+	log           *logger.Logger
+	stmts         *processor.StatementRegistry
+}
+
+// NewService creates a new command service
+func NewService(db *pgxpool.Pool, publisher Publisher, topicTemplate string, qos int, ackTimeout time.Duration, log *logger.Logger) *Service {
+	return &Service{
+		db:            db,
+		publisher:     publisher,
+		topicTemplate: topicTemplate,
+		qos:           qos,
+		ackTimeout:    ackTimeout,
+		log:           log.Component("command"),
+	}
+}
+
+// SetStatements registers the service statements, which are executed
+// prepared once the registry is validated
+func (s *Service) SetStatements(r *processor.StatementRegistry) {
+	r.Register(stmtLookupDevice, stmtSupersede, stmtInsert, stmtFail, stmtPublished,
+		stmtGet, stmtList, stmtAck, stmtExpire)
+	s.stmts = r
+}
+
+// deviceInfo holds what is needed to address a device
+type deviceInfo struct {
+	ID         int
+	UUID       string
+	Name       string
+	RoomID     int
+	RoomName   string
+	RoomNumber string
+}
+
+func (s *Service) lookupDevice(ctx context.Context, deviceID int) (*deviceInfo, error) {
+	var d deviceInfo
+	err := s.db.QueryRow(ctx, s.stmts.Text(stmtLookupDevice), deviceID).
+		Scan(&d.ID, &d.UUID, &d.Name, &d.RoomID, &d.RoomName, &d.RoomNumber)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, ErrDeviceNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &d, nil
+}
+
+// Topic renders the command topic of a device. Supported placeholders are
+// {roomId}, {roomName}, {roomNumber}, {deviceId}, {deviceName} and {deviceUuid}.
+func (s *Service) topic(d *deviceInfo) string {
+	return strings.NewReplacer(
+		"{roomId}", strconv.Itoa(d.RoomID),
+		"{roomName}", d.RoomName,
+		"{roomNumber}", d.RoomNumber,
+		"{deviceId}", strconv.Itoa(d.ID),
+		"{deviceName}", d.Name,
+		"{deviceUuid}", d.UUID,
+	).Replace(s.topicTemplate)
+}
+
+// Create records a desired state for a device and publishes it. Older
+// commands still waiting for an acknowledgement are superseded. A publish
+// failure is recorded on the command, which is returned with status failed.
+func (s *Service) Create(ctx context.Context, deviceID int, desired json.RawMessage) (*Command, error) {
+	var obj map[string]interface{}
+	if err := json.Unmarshal(desired, &obj); err != nil || obj == nil {
+		return nil, ErrInvalidDesired
+	}
+
+	device, err := s.lookupDevice(ctx, deviceID)
+	if err != nil {
+		return nil, err
+	}
+	topic := s.topic(device)
+
+	tx, err := s.db.Begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback(ctx)
+
+	if _, err := tx.Exec(ctx, s.stmts.Text(stmtSupersede),
+		deviceID, StatusSuperseded, StatusPending, StatusPublished); err != nil {
+		return nil, err
+	}
+
+	cmd, err := scanCommand(tx.QueryRow(ctx, s.stmts.Text(stmtInsert),
+		deviceID, desired, topic, StatusPending, s.ackTimeout.Seconds()))
+	if err != nil {
+		return nil, err
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return nil, err
+	}
+
+	return s.publish(ctx, cmd)
+}
+
+// publish sends a recorded command and stores the outcome
+func (s *Service) publish(ctx context.Context, cmd *Command) (*Command, error) {
+	msg := &Message{
+		Topic:   cmd.Topic,
+		Payload: cmd.Desired,
+		QoS:     s.qos,
+		UserProperties: map[string]string{
+			"commandId": strconv.FormatInt(cmd.ID, 10),
+			"deviceId":  strconv.Itoa(cmd.DeviceID),
+		},
+	}
+
+	pubErr := s.publisher.Publish(ctx, msg)
+
+	var updated *Command
+	var err error
+	if pubErr != nil {
+		s.log.Error("Failed to publish command", "commandId", cmd.ID, "topic", cmd.Topic, "error", pubErr)
+		updated, err = scanCommand(s.db.QueryRow(ctx, s.stmts.Text(stmtFail),
+			cmd.ID, StatusFailed, pubErr.Error()))
+	} else {
+		s.log.Info("Published command", "commandId", cmd.ID, "deviceId", cmd.DeviceID, "topic", cmd.Topic)
+		updated, err = scanCommand(s.db.QueryRow(ctx, s.stmts.Text(stmtPublished),
+			cmd.ID, StatusPending, StatusPublished))
+	}
+	if err != nil {
+		return nil, err
+	}
+	return updated, nil
+}
+
+// Get returns a command of a device
+func (s *Service) Get(ctx context.Context, deviceID int, commandID int64) (*Command, error) {
+	cmd, err := scanCommand(s.db.QueryRow(ctx, s.stmts.Text(stmtGet), commandID, deviceID))
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, ErrCommandNotFound
+	}
+	return cmd, err
+}
+
+// List returns the most recent commands of a device, newest first
+func (s *Service) List(ctx context.Context, deviceID, limit int) ([]*Command, error) {
+	rows, err := s.db.Query(ctx, s.stmts.Text(stmtList), deviceID, limit)
+	if err != nil {
+		return nil, err
+	}
+	return pgx.CollectRows(rows, func(row pgx.CollectableRow) (*Command, error) {
+		return scanCommand(row)
+	})
+}
+
+// DeviceStatusChanged implements processor.DeviceStatusListener. A command is
+// acknowledged once the reported status contains every desired key/value.
+func (s *Service) DeviceStatusChanged(ctx context.Context, change *models.DeviceStatusChange) {
+	rows, err := s.db.Query(ctx, s.stmts.Text(stmtAck),
+		change.New.DeviceID, change.New.Status, StatusAcked, StatusPending, StatusPublished)
+	if err != nil {
+		s.log.WithContext(ctx).Error("Failed to acknowledge commands", "deviceId", change.New.DeviceID, "error", err)
+		return
+	}
+	ids, err := pgx.CollectRows(rows, pgx.RowTo[int64])
+	if err != nil {
+		s.log.WithContext(ctx).Error("Failed to acknowledge commands", "deviceId", change.New.DeviceID, "error", err)
+		return
+	}
+	for _, id := range ids {
+		s.log.WithContext(ctx).Info("Command acknowledged", "commandId", id, "deviceId", change.New.DeviceID)
+	}
+}
+
+// Run expires commands that were not acknowledged in time until ctx is cancelled
+func (s *Service) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			tag, err := s.db.Exec(ctx, s.stmts.Text(stmtExpire),
+				StatusExpired, StatusPending, StatusPublished)
+			if err != nil {
+				if ctx.Err() == nil {
+					s.log.Error("Failed to expire commands", "error", err)
+				}
+				continue
+			}
+			if tag.RowsAffected() > 0 {
+				s.log.Warn("Commands expired without acknowledgement", "count", tag.RowsAffected())
+			}
+		}
+	}
+}
@@ -0,0 +1,98 @@
+package command
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Publisher sends a message to devices over MQTT
+type Publisher interface {
+	Publish(ctx context.Context, msg *Message) error
+}
+
+// Message is an MQTT message to publish
+type Message struct {
+	Topic          string
+	Payload        []byte
+	QoS            int
+	Retain         bool
+	UserProperties map[string]string
+}
+
+// EMQXPublisher publishes through the EMQX v5 HTTP API (POST /api/v5/publish)
+type EMQXPublisher struct {
+	baseURL   string
+	apiKey    string
+	apiSecret string
+	client    *http.Client
+}
+
+// NewEMQXPublisher creates a publisher for the EMQX REST API at baseURL,
+// authenticated with an API key and secret
+func NewEMQXPublisher(baseURL, apiKey, apiSecret string, timeout time.Duration) *EMQXPublisher {
+	return &EMQXPublisher{
+		baseURL:   strings.TrimRight(baseURL, "/"),
+		apiKey:    apiKey,
+		apiSecret: apiSecret,
+		client:    &http.Client{Timeout: timeout},
+	}
+}
+
+type emqxPublishRequest struct {
+	Topic           string            `json:"topic"`
+	Payload         string            `json:"payload"`
+	PayloadEncoding string            `json:"payload_encoding"`
+	QoS             int               `json:"qos"`
+	Retain          bool              `json:"retain"`
+	Properties      *emqxPublishProps `json:"properties,omitempty"`
+}
+
+type emqxPublishProps struct {
+	UserProperties map[string]string `json:"user_properties,omitempty"`
+}
+
+// Publish implements Publisher
+func (p *EMQXPublisher) Publish(ctx context.Context, msg *Message) error {
+	body := emqxPublishRequest{
+		Topic:           msg.Topic,
+		Payload:         string(msg.Payload),
+		PayloadEncoding: "plain",
+		QoS:             msg.QoS,
+		Retain:          msg.Retain,
+	}
+	if len(msg.UserProperties) > 0 {
+		body.Properties = &emqxPublishProps{UserProperties: msg.UserProperties}
+	}
+
+	raw, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, p.baseURL+"/api/v5/publish", bytes.NewReader(raw))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.SetBasicAuth(p.apiKey, p.apiSecret)
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("EMQX publish request failed: %w", err)
+	}
+	defer resp.Body.Close()
+
+	// EMQX answers 200 when the message was delivered to at least one
+	// subscriber and 202 when it was accepted without matching subscribers
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusAccepted {
+		detail, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("EMQX publish returned %d: %s", resp.StatusCode, strings.TrimSpace(string(detail)))
+	}
+	return nil
+}
@@ -0,0 +1,81 @@
+package config_test
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/NieRVoid/emqx-pg-bridge/internal/config"
+	"github.com/NieRVoid/emqx-pg-bridge/internal/processor"
+)
+
+// loadConfig loads a configuration file holding yaml, with the defaults
+// applied
+func loadConfig(t *testing.T, yaml string) *config.Config {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	if err := os.WriteFile(path, []byte(yaml), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := config.LoadFromFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cfg
+}
+
+// TestCoalesceKeyDefaults checks that processors keeping a row per device
+// coalesce by device and the others by room
+func TestCoalesceKeyDefaults(t *testing.T) {
+	cfg := loadConfig(t, `
+database:
+  url: "postgres://localhost/bridge"
+env_sensor:
+  enabled: true
+processors:
+  device-center:
+    coalesce: {enabled: true}
+  normal:
+    coalesce: {enabled: true}
+  device-env:
+    coalesce: {enabled: true}
+`)
+	if err := cfg.Validate(); err != nil {
+		t.Fatalf("Validate: %v", err)
+	}
+
+	want := map[string]string{
+		processor.CenterType:     processor.CoalesceKeyRoomID,
+		processor.NormalType:     processor.CoalesceKeyDeviceID,
+		cfg.EnvSensor.DeviceType: processor.CoalesceKeyDeviceID,
+	}
+	for deviceType, key := range want {
+		if got := cfg.Processors[deviceType].Coalesce.Key; got != key {
+			t.Errorf("%s: coalesce key = %q, want %q", deviceType, got, key)
+		}
+	}
+}
+
+// TestCoalesceKeyRoomRejected checks that processors keeping a row per
+// device cannot coalesce the messages of a whole room into one
+func TestCoalesceKeyRoomRejected(t *testing.T) {
+	for _, deviceType := range []string{processor.NormalType, "air-sensor"} {
+		t.Run(deviceType, func(t *testing.T) {
+			cfg := loadConfig(t, `
+database:
+  url: "postgres://localhost/bridge"
+env_sensor:
+  enabled: true
+  device_type: "air-sensor"
+processors:
+  `+deviceType+`:
+    coalesce: {enabled: true, key: "roomId"}
+`)
+			err := cfg.Validate()
+			if err == nil || !strings.Contains(err.Error(), "would drop device states") {
+				t.Fatalf("Validate = %v, want the room key rejected", err)
+			}
+		})
+	}
+}
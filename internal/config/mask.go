@@ -0,0 +1,89 @@
+package config
+
+import (
+	"net/url"
+	"regexp"
+)
+
+// maskedValue replaces secrets in a masked configuration
+const maskedValue = "REDACTED"
+
+var dsnPasswordPattern = regexp.MustCompile(`(password\s*=\s*)('[^']*'|\S+)`)
+
+// Masked returns a copy of the configuration with secrets replaced, suitable
+// for logging or returning from the admin API
+func (c *Config) Masked() *Config {
+	masked := *c
+	masked.Database.URL = MaskURL(c.Database.URL)
+	masked.Database.ReadURL = MaskURL(c.Database.ReadURL)
+	if masked.Admin.Token != "" {
+		masked.Admin.Token = maskedValue
+	}
+	if masked.Commands.APIToken != "" {
+		masked.Commands.APIToken = maskedValue
+	}
+	if masked.Commands.EMQX.APISecret != "" {
+		masked.Commands.EMQX.APISecret = maskedValue
+	}
+	if masked.Alerts.SMTP.Password != "" {
+		masked.Alerts.SMTP.Password = maskedValue
+	}
+	if len(c.Alerts.Webhook.Headers) > 0 {
+		// Headers usually carry the credentials of the alert endpoint
+		masked.Alerts.Webhook.Headers = make(map[string]string, len(c.Alerts.Webhook.Headers))
+		for k := range c.Alerts.Webhook.Headers {
+			masked.Alerts.Webhook.Headers[k] = maskedValue
+		}
+	}
+	if len(c.Sinks) > 0 {
+		masked.Sinks = make([]SinkConfig, len(c.Sinks))
+		for i, sc := range c.Sinks {
+			sc.DatabaseURL = MaskURL(sc.DatabaseURL)
+			if len(sc.Headers) > 0 {
+				headers := make(map[string]string, len(sc.Headers))
+				for k := range sc.Headers {
+					headers[k] = maskedValue
+				}
+				sc.Headers = headers
+			}
+			masked.Sinks[i] = sc
+		}
+	}
+	if len(c.Tenants.List) > 0 {
+		masked.Tenants.List = make([]TenantConfig, len(c.Tenants.List))
+		for i, tc := range c.Tenants.List {
+			tc.DatabaseURL = MaskURL(tc.DatabaseURL)
+			if len(tc.AuthKeys) > 0 {
+				keys := make([]string, len(tc.AuthKeys))
+				for j := range keys {
+					keys[j] = maskedValue
+				}
+				tc.AuthKeys = keys
+			}
+			masked.Tenants.List[i] = tc
+		}
+	}
+	return &masked
+}
+
+// MaskURL hides the password of a connection URL or key/value DSN
+func MaskURL(raw string) string {
+	if raw == "" {
+		return raw
+	}
+
+	u, err := url.Parse(raw)
+	if err == nil && u.Scheme != "" && u.Host != "" {
+		if _, ok := u.User.Password(); ok {
+			u.User = url.UserPassword(u.User.Username(), maskedValue)
+		}
+		q := u.Query()
+		if q.Has("password") {
+			q.Set("password", maskedValue)
+			u.RawQuery = q.Encode()
+		}
+		return u.String()
+	}
+
+	return dsnPasswordPattern.ReplaceAllString(raw, "${1}"+maskedValue)
+}
@@ -0,0 +1,132 @@
+package database
+
+import (
+	"sync"
+	"time"
+
+	"github.com/NieRVoid/emqx-pg-bridge/pkg/logger"
+)
+
+// Circuit breaker states
+const (
+	BreakerClosed   = "closed"
+	BreakerOpen     = "open"
+	BreakerHalfOpen = "half-open"
+	// BreakerRecovering holds writes while the recovery function runs
+	BreakerRecovering = "recovering"
+)
+
+// Breaker stops sending writes to an unavailable database. After threshold
+// consecutive unavailability errors it opens and rejects writes for openFor;
+// then a single probe is let through, which closes the breaker on success,
+// once the recovery function returned, and reopens it otherwise.
+type Breaker struct {
+	threshold int
+	openFor   time.Duration
+	log       *logger.Logger
+	onRecover func()
+
+	mu       sync.Mutex
+	state    string
+	failures int
+	openedAt time.Time
+	probing  bool
+}
+
+// NewBreaker creates a closed circuit breaker
+func NewBreaker(threshold int, openFor time.Duration, log *logger.Logger) *Breaker {
+	return &Breaker{
+		threshold: threshold,
+		openFor:   openFor,
+		log:       log.Component("database.breaker"),
+		state:     BreakerClosed,
+	}
+}
+
+// SetOnRecover registers a function run in its own goroutine whenever the
+// database is available again, e.g. to replay what was spooled meanwhile.
+// Writes are not allowed until it returns, so nothing it replays can
+// overwrite a newer write. It must be called before the breaker is used.
+func (b *Breaker) SetOnRecover(fn func()) {
+	b.onRecover = fn
+}
+
+// State returns the current breaker state
+func (b *Breaker) State() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.state
+}
+
+// Allow reports whether a write may be attempted. Every allowed write must
+// be followed by Record.
+func (b *Breaker) Allow() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	switch b.state {
+	case BreakerOpen:
+		if time.Since(b.openedAt) < b.openFor {
+			return false
+		}
+		b.state = BreakerHalfOpen
+		b.probing = true
+		b.log.Info("Probing database availability")
+		return true
+	case BreakerHalfOpen:
+		if b.probing {
+			return false
+		}
+		b.probing = true
+		return true
+	case BreakerRecovering:
+		return false
+	default:
+		return true
+	}
+}
+
+// Record reports the outcome of an allowed write. Errors other than
+// unavailability count as success, the database did answer.
+func (b *Breaker) Record(err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.probing = false
+	if IsUnavailable(err) {
+		b.failures++
+		if b.state == BreakerHalfOpen || (b.state == BreakerClosed && b.failures >= b.threshold) {
+			if b.state == BreakerClosed {
+				b.log.Warn("Database unavailable, opening circuit breaker",
+					"failures", b.failures, "openFor", b.openFor, "error", err)
+			}
+			b.state = BreakerOpen
+			b.openedAt = time.Now()
+		}
+		return
+	}
+
+	b.failures = 0
+	switch {
+	case b.state == BreakerClosed || b.state == BreakerRecovering:
+	case b.onRecover != nil:
+		b.state = BreakerRecovering
+		b.log.Info("Database available again, holding writes until recovery completes")
+		go b.recover()
+	default:
+		b.state = BreakerClosed
+		b.log.Info("Database available again, closing circuit breaker")
+	}
+}
+
+// recover runs the recovery function and closes the breaker afterwards
+func (b *Breaker) recover() {
+	b.onRecover()
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.state == BreakerRecovering {
+		b.state = BreakerClosed
+		b.log.Info("Recovery completed, closing circuit breaker")
+	}
+}
@@ -0,0 +1,162 @@
+package database
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+// minResetInterval limits pool resets while a failover is in progress
+const minResetInterval = 5 * time.Second
+
+// IsReadOnly reports whether err was raised for a write sent to a server in
+// read-only mode, e.g. a primary demoted to a standby
+func IsReadOnly(err error) bool {
+	var pgErr *pgconn.PgError
+	return errors.As(err, &pgErr) && pgErr.Code == "25006"
+}
+
+// IsUnavailable reports whether err means the database cannot take writes
+// right now, as opposed to a problem with the data being written. A context
+// that expired or was cancelled, e.g. by a slow webhook caller or shutdown,
+// says nothing about the database.
+func IsUnavailable(err error) bool {
+	if err == nil || errors.Is(err, context.DeadlineExceeded) || errors.Is(err, context.Canceled) {
+		return false
+	}
+	if IsReadOnly(err) {
+		return true
+	}
+
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) {
+		// Connection exceptions, and shutdown or startup of the server
+		return strings.HasPrefix(pgErr.Code, "08") ||
+			pgErr.Code == "57P01" || pgErr.Code == "57P02" || pgErr.Code == "57P03"
+	}
+
+	var netErr net.Error
+	return errors.As(err, &netErr)
+}
+
+// setHosts replaces the host of a parsed connection config with several
+// host:port entries, which pgx tries in order. Every host is tried with the
+// TLS settings parsed for the original one, e.g. TLS then plain text for
+// sslmode=prefer; a missing port keeps the original port.
+func setHosts(cfg *pgconn.Config, hosts []string) error {
+	variants := append([]*pgconn.FallbackConfig{{
+		Host:      cfg.Host,
+		Port:      cfg.Port,
+		TLSConfig: cfg.TLSConfig,
+	}}, cfg.Fallbacks...)
+
+	var targets []*pgconn.FallbackConfig
+	for _, hostPort := range hosts {
+		host, port := hostPort, cfg.Port
+		if h, p, err := net.SplitHostPort(hostPort); err == nil {
+			n, err := strconv.ParseUint(p, 10, 16)
+			if err != nil {
+				return fmt.Errorf("invalid database host %q: %w", hostPort, err)
+			}
+			host, port = h, uint16(n)
+		}
+
+		for _, v := range variants {
+			// Only the TLS variants of the original host are repeated
+			if v.Host != cfg.Host || v.Port != cfg.Port {
+				continue
+			}
+			target := &pgconn.FallbackConfig{Host: host, Port: port}
+			if v.TLSConfig != nil {
+				target.TLSConfig = v.TLSConfig.Clone()
+				if target.TLSConfig.ServerName != "" {
+					target.TLSConfig.ServerName = host
+				}
+			}
+			targets = append(targets, target)
+		}
+	}
+
+	cfg.Host, cfg.Port, cfg.TLSConfig = targets[0].Host, targets[0].Port, targets[0].TLSConfig
+	cfg.Fallbacks = targets[1:]
+	return nil
+}
+
+// sessionValidator returns the connect check of a target_session_attrs
+// value; nil accepts any server
+func sessionValidator(attrs string) (pgconn.ValidateConnectFunc, error) {
+	switch attrs {
+	case "", "any":
+		return nil, nil
+	case "read-write":
+		return pgconn.ValidateConnectTargetSessionAttrsReadWrite, nil
+	case "read-only":
+		return pgconn.ValidateConnectTargetSessionAttrsReadOnly, nil
+	case "primary":
+		return pgconn.ValidateConnectTargetSessionAttrsPrimary, nil
+	case "standby":
+		return pgconn.ValidateConnectTargetSessionAttrsStandby, nil
+	case "prefer-standby":
+		return pgconn.ValidateConnectTargetSessionAttrsPreferStandby, nil
+	default:
+		return nil, fmt.Errorf("invalid target_session_attrs: %s", attrs)
+	}
+}
+
+// readOnlyTracer resets the pool when a query hits a read-only server, so
+// the next connections are made to the host that is primary now instead of
+// reusing connections to the demoted one
+type readOnlyTracer struct {
+	p         *Postgres
+	lastReset atomic.Int64
+}
+
+// TraceQueryStart implements pgx.QueryTracer
+func (t *readOnlyTracer) TraceQueryStart(ctx context.Context, conn *pgx.Conn, data pgx.TraceQueryStartData) context.Context {
+	return ctx
+}
+
+// TraceQueryEnd implements pgx.QueryTracer
+func (t *readOnlyTracer) TraceQueryEnd(ctx context.Context, conn *pgx.Conn, data pgx.TraceQueryEndData) {
+	if !IsReadOnly(data.Err) {
+		return
+	}
+
+	now := time.Now().UnixNano()
+	last := t.lastReset.Load()
+	if now-last < int64(minResetInterval) || !t.lastReset.CompareAndSwap(last, now) {
+		return
+	}
+
+	t.p.log.Warn("Database is read-only, reconnecting to find the primary",
+		"host", conn.Config().Host)
+	// The connection running this query is still acquired; Reset closes it
+	// once it is released
+	go t.p.Pool.Reset()
+}
+
+// multiTracer fans query traces out to several tracers
+type multiTracer []pgx.QueryTracer
+
+// TraceQueryStart implements pgx.QueryTracer
+func (m multiTracer) TraceQueryStart(ctx context.Context, conn *pgx.Conn, data pgx.TraceQueryStartData) context.Context {
+	for _, t := range m {
+		ctx = t.TraceQueryStart(ctx, conn, data)
+	}
+	return ctx
+}
+
+// TraceQueryEnd implements pgx.QueryTracer
+func (m multiTracer) TraceQueryEnd(ctx context.Context, conn *pgx.Conn, data pgx.TraceQueryEndData) {
+	for i := len(m) - 1; i >= 0; i-- {
+		m[i].TraceQueryEnd(ctx, conn, data)
+	}
+}
@@ -0,0 +1,153 @@
+package database
+
+import (
+	"context"
+	"embed"
+	"errors"
+	"fmt"
+	"io/fs"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/jackc/pgx/v5"
+)
+
+//go:embed migrations/*.sql migrations/sqlite/*.sql
+var migrationFiles embed.FS
+
+// migrationLockID is the advisory lock key serializing migrations between
+// bridge instances starting at the same time
+const migrationLockID = 7244021
+
+// Dialects of the migration set
+const (
+	dialectPostgres = "postgres"
+	dialectSQLite   = "sqlite"
+)
+
+// migration is one version of the migration set
+type migration struct {
+	version string
+	script  string
+}
+
+// loadMigrations returns the ordered migration set for a dialect. Every
+// dialect applies the same versions, starting with the base schema of
+// doc/schema.sql; migrations/<dialect>/<version>.sql replaces the shared
+// script of a version where the dialect needs different SQL.
+func loadMigrations(dialect string) ([]migration, error) {
+	names, err := fs.Glob(migrationFiles, "migrations/*.sql")
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(names)
+
+	migrations := make([]migration, 0, len(names))
+	for _, name := range names {
+		script, err := migrationFiles.ReadFile(path.Join("migrations", dialect, path.Base(name)))
+		if errors.Is(err, fs.ErrNotExist) {
+			script, err = migrationFiles.ReadFile(name)
+		}
+		if err != nil {
+			return nil, err
+		}
+		migrations = append(migrations, migration{
+			version: strings.TrimSuffix(path.Base(name), ".sql"),
+			script:  string(script),
+		})
+	}
+	return migrations, nil
+}
+
+// Migrate applies the embedded SQL migrations that have not been applied yet,
+// including the base schema on an empty database
+func (p *Postgres) Migrate(ctx context.Context) error {
+	migrations, err := loadMigrations(dialectPostgres)
+	if err != nil {
+		return err
+	}
+
+	if _, err := p.Pool.Exec(ctx, `
+		CREATE TABLE IF NOT EXISTS schema_migrations (
+			version    text primary key,
+			applied_at timestamp default now() not null
+		)`); err != nil {
+		return fmt.Errorf("failed to create schema_migrations: %w", err)
+	}
+
+	for _, m := range migrations {
+		applied, err := p.applyMigration(ctx, m)
+		if err != nil {
+			return fmt.Errorf("migration %s failed: %w", m.version, err)
+		}
+		if applied {
+			p.log.Info("Applied migration", "version", m.version)
+		}
+	}
+
+	return nil
+}
+
+// CreateSchema creates a schema if it does not exist yet. schema must be a
+// plain identifier.
+func (p *Postgres) CreateSchema(ctx context.Context, schema string) error {
+	if _, err := p.Pool.Exec(ctx, `CREATE SCHEMA IF NOT EXISTS `+pgx.Identifier{schema}.Sanitize()); err != nil {
+		return fmt.Errorf("failed to create schema %s: %w", schema, err)
+	}
+	return nil
+}
+
+// baseTables are the tables of the base schema the processors write to
+var baseTables = []string{"rooms", "devices", "room_status", "device_status"}
+
+// CheckBaseSchema fails unless the base schema tables resolve on the search
+// path, e.g. in the schema of a tenant whose migrations are skipped
+func (p *Postgres) CheckBaseSchema(ctx context.Context) error {
+	var missing []string
+	for _, table := range baseTables {
+		var found bool
+		if err := p.Pool.QueryRow(ctx, `SELECT to_regclass($1) IS NOT NULL`, table).Scan(&found); err != nil {
+			return fmt.Errorf("failed to check table %s: %w", table, err)
+		}
+		if !found {
+			missing = append(missing, table)
+		}
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("base schema tables missing: %s", strings.Join(missing, ", "))
+	}
+	return nil
+}
+
+func (p *Postgres) applyMigration(ctx context.Context, m migration) (bool, error) {
+	tx, err := p.Pool.Begin(ctx)
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback(ctx)
+
+	if _, err := tx.Exec(ctx, `SELECT pg_advisory_xact_lock($1)`, migrationLockID); err != nil {
+		return false, err
+	}
+
+	var exists bool
+	if err := tx.QueryRow(ctx,
+		`SELECT EXISTS (SELECT 1 FROM schema_migrations WHERE version = $1)`, m.version,
+	).Scan(&exists); err != nil {
+		return false, err
+	}
+	if exists {
+		return false, nil
+	}
+
+	// Simple protocol so a file may contain several statements
+	if _, err := tx.Exec(ctx, m.script, pgx.QueryExecModeSimpleProtocol); err != nil {
+		return false, err
+	}
+	if _, err := tx.Exec(ctx, `INSERT INTO schema_migrations (version) VALUES ($1)`, m.version); err != nil {
+		return false, err
+	}
+
+	return true, tx.Commit(ctx)
+}
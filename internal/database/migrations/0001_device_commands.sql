@@ -0,0 +1,23 @@
+-- Desired-state commands sent to devices through the downlink API
+create table if not exists device_commands
+(
+    id           bigserial
+        primary key,
+    device_id    integer                           not null
+        constraint device_commands_device_id_devices_id_fk
+            references devices,
+    desired      jsonb                             not null,
+    topic        text                              not null,
+    status       text      default 'pending'::text not null,
+    error        text,
+    created_at   timestamp default now()           not null,
+    published_at timestamp,
+    acked_at     timestamp,
+    expires_at   timestamp
+);
+
+create index if not exists device_commands_device_id_status_idx
+    on device_commands (device_id, status);
+
+create index if not exists device_commands_status_expires_at_idx
+    on device_commands (status, expires_at);
@@ -0,0 +1,62 @@
+-- Desired state per device; the reported side is device_status.status
+create table if not exists device_shadow
+(
+    device_id          integer                 not null
+        primary key
+        constraint device_shadow_device_id_devices_id_fk
+            references devices,
+    desired            jsonb   default '{}'::jsonb not null,
+    version            bigint  default 0       not null,
+    desired_updated_at timestamp default now() not null,
+    last_sync_at       timestamp,
+    sync_attempts      integer default 0       not null
+);
+
+-- shadow_delta returns the parts of desired that reported does not match yet.
+-- Nested objects are compared key by key, everything else by value.
+create or replace function shadow_delta(desired jsonb, reported jsonb)
+    returns jsonb
+    language plpgsql
+    immutable
+as
+$$
+declare
+    result jsonb := '{}'::jsonb;
+    item   record;
+    nested jsonb;
+begin
+    if desired is null or jsonb_typeof(desired) <> 'object' then
+        return result;
+    end if;
+
+    for item in select key, value from jsonb_each(desired)
+        loop
+            if reported is null or jsonb_typeof(reported) <> 'object' or not reported ? item.key then
+                result := result || jsonb_build_object(item.key, item.value);
+            elsif jsonb_typeof(item.value) = 'object' and jsonb_typeof(reported -> item.key) = 'object' then
+                nested := shadow_delta(item.value, reported -> item.key);
+                if nested <> '{}'::jsonb then
+                    result := result || jsonb_build_object(item.key, nested);
+                end if;
+            elsif reported -> item.key <> item.value then
+                result := result || jsonb_build_object(item.key, item.value);
+            end if;
+        end loop;
+
+    return result;
+end
+$$;
+
+create or replace view device_shadow_view as
+select d.id                                   as device_id,
+       coalesce(s.desired, '{}'::jsonb)       as desired,
+       coalesce(ds.status, '{}'::jsonb)       as reported,
+       shadow_delta(s.desired, ds.status)     as delta,
+       coalesce(s.version, 0)                 as version,
+       s.desired_updated_at,
+       ds.last_reported_at                    as reported_at,
+       s.last_sync_at,
+       coalesce(s.sync_attempts, 0)           as sync_attempts
+from devices d
+         left join device_shadow s on s.device_id = d.id
+         left join device_status ds on ds.device_id = d.id;
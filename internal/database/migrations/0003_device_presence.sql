@@ -0,0 +1,22 @@
+-- MQTT connection state per client, fed by EMQX client and session events
+create table if not exists device_presence
+(
+    client_id            text                    not null
+        primary key,
+    device_id            integer
+        constraint device_presence_device_id_devices_id_fk
+            references devices,
+    online               boolean default false   not null,
+    stale                boolean default false   not null,
+    last_connected_at    timestamp,
+    last_disconnected_at timestamp,
+    disconnect_reason    text,
+    peer_host            text,
+    username             text,
+    node                 text,
+    last_message_at      timestamp,
+    updated_at           timestamp default now() not null
+);
+
+create index if not exists device_presence_device_id_idx
+    on device_presence (device_id);
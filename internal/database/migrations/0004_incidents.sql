@@ -0,0 +1,21 @@
+-- Rooms and devices that stopped reporting; at most one open incident each
+create table if not exists incidents
+(
+    id                   bigserial
+        primary key,
+    subject              text                    not null,
+    subject_id           integer                 not null,
+    threshold_seconds    integer                 not null,
+    last_seen_at         timestamp               not null,
+    opened_at            timestamp default now() not null,
+    resolved_at          timestamp,
+    notified_at          timestamp,
+    recovery_notified_at timestamp
+);
+
+create unique index if not exists incidents_open_subject_unique_idx
+    on incidents (subject, subject_id)
+    where resolved_at is null;
+
+create index if not exists incidents_opened_at_idx
+    on incidents (opened_at);
@@ -0,0 +1,34 @@
+-- Rule engine state per room; candidate is a state waiting out its dwell time
+create table if not exists room_occupancy_state
+(
+    room_id         integer                           not null
+        primary key
+        constraint room_occupancy_state_room_id_rooms_id_fk
+            references rooms,
+    state           text      default 'unknown'::text not null,
+    candidate       text,
+    candidate_since timestamp,
+    changed_at      timestamp default now()           not null
+);
+
+create table if not exists occupancy_transitions
+(
+    id                  bigserial
+        primary key,
+    room_id             integer                 not null
+        constraint occupancy_transitions_room_id_rooms_id_fk
+            references rooms,
+    from_state          text                    not null,
+    to_state            text                    not null,
+    probability         integer                 not null,
+    occupied            boolean                 not null,
+    occupied_confidence integer                 not null,
+    occupant_count      integer                 not null,
+    count_confidence    integer                 not null,
+    change_source       text                    not null,
+    reason              text                    not null,
+    created_at          timestamp default now() not null
+);
+
+create index if not exists occupancy_transitions_room_id_created_at_idx
+    on occupancy_transitions (room_id, created_at);
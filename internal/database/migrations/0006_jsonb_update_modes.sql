@@ -0,0 +1,202 @@
+-- JSON document update functions used by the device_status update modes.
+-- Invalid patches raise invalid_parameter_value (22023).
+
+-- RFC 7386 JSON merge patch
+create or replace function jsonb_merge_patch(target jsonb, patch jsonb)
+    returns jsonb
+    language plpgsql
+    immutable
+as
+$$
+declare
+    result jsonb;
+    item   record;
+begin
+    if patch is null or jsonb_typeof(patch) <> 'object' then
+        return patch;
+    end if;
+
+    result := case when jsonb_typeof(target) = 'object' then target else '{}'::jsonb end;
+    for item in select key, value from jsonb_each(patch)
+        loop
+            if jsonb_typeof(item.value) = 'null' then
+                result := result - item.key;
+            else
+                result := jsonb_set(result, array [item.key], jsonb_merge_patch(result -> item.key, item.value));
+            end if;
+        end loop;
+    return result;
+end
+$$;
+
+-- Recursive merge of objects; null values are stored, not removed. Arrays
+-- are handled by array_strategy: replace, append or union (append values not
+-- present yet).
+create or replace function jsonb_deep_merge(target jsonb, patch jsonb, array_strategy text default 'replace')
+    returns jsonb
+    language plpgsql
+    immutable
+as
+$$
+declare
+    result jsonb;
+    item   record;
+begin
+    if target is null then
+        return patch;
+    end if;
+
+    if jsonb_typeof(target) = 'object' and jsonb_typeof(patch) = 'object' then
+        result := target;
+        for item in select key, value from jsonb_each(patch)
+            loop
+                result := jsonb_set(result, array [item.key],
+                                    jsonb_deep_merge(result -> item.key, item.value, array_strategy));
+            end loop;
+        return result;
+    end if;
+
+    if jsonb_typeof(target) = 'array' and jsonb_typeof(patch) = 'array' then
+        case array_strategy
+            when 'replace' then return patch;
+            when 'append' then return target || patch;
+            when 'union' then return target || coalesce(
+                    (select jsonb_agg(e order by ord)
+                     from jsonb_array_elements(patch) with ordinality as p(e, ord)
+                     where not target @> jsonb_build_array(e)), '[]'::jsonb);
+            else raise exception 'unknown array strategy: %', array_strategy using errcode = '22023';
+            end case;
+    end if;
+
+    return patch;
+end
+$$;
+
+-- Splits an RFC 6901 JSON pointer into a path for the jsonb path operators
+create or replace function jsonb_pointer_path(pointer text)
+    returns text[]
+    language plpgsql
+    immutable
+as
+$$
+begin
+    if pointer = '' then
+        return array []::text[];
+    end if;
+    if left(pointer, 1) <> '/' then
+        raise exception 'invalid JSON pointer: %', pointer using errcode = '22023';
+    end if;
+    return array(select replace(replace(p, '~1', '/'), '~0', '~')
+                 from unnest(string_to_array(substr(pointer, 2), '/')) with ordinality as t(p, ord)
+                 order by ord);
+end
+$$;
+
+-- Adds value at path following RFC 6902 "add" semantics
+create or replace function jsonb_patch_add(target jsonb, path text[], value jsonb)
+    returns jsonb
+    language plpgsql
+    immutable
+as
+$$
+declare
+    parent_path text[];
+    parent      jsonb;
+    last        text;
+begin
+    if cardinality(path) = 0 then
+        return value;
+    end if;
+
+    parent_path := path[1:cardinality(path) - 1];
+    last := path[cardinality(path)];
+    parent := target #> parent_path;
+
+    if jsonb_typeof(parent) = 'object' then
+        return jsonb_set(target, path, value, true);
+    elsif jsonb_typeof(parent) = 'array' then
+        if last <> '-' then
+            if last !~ '^[0-9]+$' then
+                raise exception 'invalid array index: %', array_to_string(path, '/') using errcode = '22023';
+            end if;
+            if last::int > jsonb_array_length(parent) then
+                raise exception 'array index out of bounds: %', array_to_string(path, '/') using errcode = '22023';
+            end if;
+            if last::int < jsonb_array_length(parent) then
+                return jsonb_insert(target, path, value);
+            end if;
+        end if;
+        -- Append: "-" or the index just past the end
+        if cardinality(parent_path) = 0 then
+            return target || jsonb_build_array(value);
+        end if;
+        return jsonb_set(target, parent_path, parent || jsonb_build_array(value));
+    end if;
+
+    raise exception 'path not found: %', array_to_string(path, '/') using errcode = '22023';
+end
+$$;
+
+-- RFC 6902 JSON patch
+create or replace function jsonb_apply_patch(target jsonb, patch jsonb)
+    returns jsonb
+    language plpgsql
+    immutable
+as
+$$
+declare
+    op        jsonb;
+    path      text[];
+    from_path text[];
+    moved     jsonb;
+begin
+    if jsonb_typeof(patch) <> 'array' then
+        raise exception 'JSON patch must be an array' using errcode = '22023';
+    end if;
+
+    target := coalesce(target, '{}'::jsonb);
+    for op in select value from jsonb_array_elements(patch)
+        loop
+            path := jsonb_pointer_path(op ->> 'path');
+            if path is null then
+                raise exception 'JSON patch operation without path' using errcode = '22023';
+            end if;
+
+            case op ->> 'op'
+                when 'add' then
+                    target := jsonb_patch_add(target, path, op -> 'value');
+                when 'remove' then
+                    if cardinality(path) = 0 or target #> path is null then
+                        raise exception 'path not found: %', op ->> 'path' using errcode = '22023';
+                    end if;
+                    target := target #- path;
+                when 'replace' then
+                    if target #> path is null then
+                        raise exception 'path not found: %', op ->> 'path' using errcode = '22023';
+                    end if;
+                    if cardinality(path) = 0 then
+                        target := op -> 'value';
+                    else
+                        target := jsonb_set(target, path, op -> 'value', false);
+                    end if;
+                when 'move', 'copy' then
+                    from_path := jsonb_pointer_path(op ->> 'from');
+                    moved := target #> from_path;
+                    if moved is null then
+                        raise exception 'path not found: %', op ->> 'from' using errcode = '22023';
+                    end if;
+                    if op ->> 'op' = 'move' then
+                        target := target #- from_path;
+                    end if;
+                    target := jsonb_patch_add(target, path, moved);
+                when 'test' then
+                    if target #> path is distinct from op -> 'value' then
+                        raise exception 'test failed at %', op ->> 'path' using errcode = '22023';
+                    end if;
+                else
+                    raise exception 'unknown JSON patch operation: %', op ->> 'op' using errcode = '22023';
+                end case;
+        end loop;
+    return target;
+end
+$$;
@@ -0,0 +1,45 @@
+-- Occupancy reports of the center devices, the source of the rollups
+create table if not exists room_occupancy_samples
+(
+    id                  bigserial
+        primary key,
+    room_id             integer   not null
+        constraint room_occupancy_samples_room_id_rooms_id_fk
+            references rooms,
+    occupied            boolean   not null,
+    occupant_count      integer   not null,
+    occupied_confidence integer   not null,
+    count_confidence    integer   not null,
+    sampled_at          timestamp not null
+);
+
+create index if not exists room_occupancy_samples_room_id_sampled_at_idx
+    on room_occupancy_samples (room_id, sampled_at);
+
+-- Per room and hour: time spent occupied, peak occupant count and the sums
+-- behind the average occupied confidence of the samples in that hour
+create table if not exists room_occupancy_hourly
+(
+    room_id            integer                      not null
+        constraint room_occupancy_hourly_room_id_rooms_id_fk
+            references rooms,
+    hour               timestamp                    not null,
+    occupied_seconds   double precision default 0   not null,
+    occupied_minutes   double precision generated always as (occupied_seconds / 60) stored,
+    max_occupant_count integer          default 0   not null,
+    confidence_sum     bigint           default 0   not null,
+    sample_count       integer          default 0   not null,
+    updated_at         timestamp        default now() not null,
+    primary key (room_id, hour)
+);
+
+create or replace view room_occupancy_daily as
+select room_id,
+       hour::date                                                as day,
+       sum(occupied_minutes)                                     as occupied_minutes,
+       sum(occupied_seconds) / 86400                             as occupancy_rate,
+       max(max_occupant_count)                                   as max_occupant_count,
+       sum(confidence_sum)::double precision / nullif(sum(sample_count), 0) as avg_confidence,
+       sum(sample_count)                                         as sample_count
+from room_occupancy_hourly
+group by room_id, hour::date;
@@ -0,0 +1,73 @@
+-- SQLite version of 0000_base_schema.sql: integer autoincrement keys, random
+-- uuids and json text columns instead of serial, uuid and jsonb.
+
+create table if not exists rooms
+(
+    id          integer primary key autoincrement,
+    number      text                                 not null,
+    name        text                                 not null,
+    description text      default 'no description'  not null,
+    occupancy   text      default 'unknown'         not null,
+    created_at  timestamp default current_timestamp not null,
+    updated_at  timestamp default current_timestamp not null
+);
+
+create index if not exists rooms_number_idx on rooms (number);
+create index if not exists rooms_name_idx on rooms (name);
+
+create table if not exists devices
+(
+    id           integer primary key autoincrement,
+    uuid         text      default (lower(hex(randomblob(4)) || '-' || hex(randomblob(2)) || '-4' ||
+                                          substr(hex(randomblob(2)), 2) || '-' ||
+                                          substr('89ab', 1 + (abs(random()) % 4), 1) ||
+                                          substr(hex(randomblob(2)), 2) || '-' ||
+                                          hex(randomblob(6))))  not null,
+    name         text                                 not null,
+    type         text                                 not null,
+    model        text,
+    manufacturer text,
+    description  text,
+    room_id      integer                              not null references rooms,
+    created_at   timestamp default current_timestamp not null,
+    updated_at   timestamp default current_timestamp not null
+);
+
+create index if not exists name_idx on devices (name);
+create index if not exists type_idx on devices (type);
+create index if not exists room_id_idx on devices (room_id);
+create unique index if not exists uuid_idx on devices (uuid);
+
+create table if not exists device_status
+(
+    id               integer primary key autoincrement,
+    device_id        integer                              not null references devices,
+    status           text                                 not null check (json_valid(status)),
+    updated_at       timestamp default current_timestamp not null,
+    last_reported_at timestamp default current_timestamp not null
+);
+
+create unique index if not exists device_status_device_id_unique_idx on device_status (device_id);
+
+create table if not exists room_status
+(
+    id                  integer primary key autoincrement,
+    room_id             integer                              not null references rooms,
+    temperature         integer,
+    humidity            integer,
+    air_quality         integer,
+    light_level         integer,
+    noise_level         integer,
+    occupied            boolean   default false              not null,
+    occupant_count      integer   default 0                  not null,
+    count_confidence    integer   default 0                  not null,
+    occupied_confidence integer   default 0                  not null,
+    count_source        text      default 'unknown'          not null,
+    last_source_change  timestamp,
+    metadata            text check (metadata is null or json_valid(metadata)),
+    updated_at          timestamp default current_timestamp not null
+);
+
+create unique index if not exists room_status_room_id_unique_idx on room_status (room_id);
+create index if not exists room_status_occupied_idx on room_status (occupied);
+create index if not exists room_status_updated_at_idx on room_status (updated_at);
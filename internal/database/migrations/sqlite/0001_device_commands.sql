@@ -0,0 +1,2 @@
+-- Downlink commands require PostgreSQL.
+-- Nothing to create on SQLite; the version is only recorded.
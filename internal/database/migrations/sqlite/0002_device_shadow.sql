@@ -0,0 +1,2 @@
+-- Device shadows belong to the downlink commands, which require PostgreSQL.
+-- Nothing to create on SQLite; the version is only recorded.
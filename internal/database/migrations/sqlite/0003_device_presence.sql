@@ -0,0 +1,2 @@
+-- Presence tracking requires PostgreSQL.
+-- Nothing to create on SQLite; the version is only recorded.
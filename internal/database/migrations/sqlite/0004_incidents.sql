@@ -0,0 +1,2 @@
+-- Alerts require PostgreSQL.
+-- Nothing to create on SQLite; the version is only recorded.
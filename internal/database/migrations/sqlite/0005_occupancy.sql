@@ -0,0 +1,2 @@
+-- The occupancy rule engine requires PostgreSQL.
+-- Nothing to create on SQLite; the version is only recorded.
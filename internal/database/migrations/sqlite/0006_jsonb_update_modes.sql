@@ -0,0 +1,3 @@
+-- SQLite applies the replace and merge_patch update modes with its built-in
+-- json_patch; the other update modes require PostgreSQL.
+-- Nothing to create on SQLite; the version is only recorded.
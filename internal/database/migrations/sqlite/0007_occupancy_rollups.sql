@@ -0,0 +1,2 @@
+-- Occupancy rollups require PostgreSQL.
+-- Nothing to create on SQLite; the version is only recorded.
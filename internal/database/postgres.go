@@ -3,29 +3,63 @@ package database
 import (
 	"context"
 	
+	"github.com/jackc/pgx/v5"
 	"github.com/jackc/pgx/v5/pgxpool"
 	"github.com/NieRVoid/emqx-pg-bridge/internal/config"
+	"github.com/NieRVoid/emqx-pg-bridge/internal/tracing"
 	"github.com/NieRVoid/emqx-pg-bridge/pkg/logger"
 )
 
 // Postgres represents a PostgreSQL database connection
 type Postgres struct {
 	Pool *pgxpool.Pool
-	log  *logger.Logger
+	// ReadPool serves the read APIs; it is Pool unless a read replica is
+	// configured
+	ReadPool *pgxpool.Pool
+	log      *logger.Logger
 }
 
-// NewPostgres creates a new PostgreSQL connection pool
-func NewPostgres(ctx context.Context, cfg *config.Config, log *logger.Logger) (*Postgres, error) {
-	dbConfig, err := pgxpool.ParseConfig(cfg.Database.URL)
+// StatementPreparer prepares named statements on every new connection of the
+// primary pool and traces their execution
+type StatementPreparer interface {
+	pgx.QueryTracer
+	Prepare(ctx context.Context, conn *pgx.Conn) error
+}
+
+// NewPostgres creates a new PostgreSQL connection pool, and a second one for
+// the read replica if configured. stmts may be nil.
+func NewPostgres(ctx context.Context, cfg *config.Config, stmts StatementPreparer, log *logger.Logger) (*Postgres, error) {
+	p := &Postgres{log: log.Component("database")}
+
+	dbConfig, err := poolConfig(cfg.Database.URL, cfg)
 	if err != nil {
 		return nil, err
 	}
-	
-	// Set pool configuration
-	dbConfig.MaxConns = int32(cfg.Database.MaxConnections)
-	dbConfig.MinConns = int32(cfg.Database.MinConnections)
-	dbConfig.MaxConnLifetime = cfg.GetMaxConnectionLifetime()
-	dbConfig.MaxConnIdleTime = cfg.GetMaxConnectionIdleTime()
+	if len(cfg.Database.Hosts) > 0 {
+		if err := setHosts(&dbConfig.ConnConfig.Config, cfg.Database.Hosts); err != nil {
+			return nil, err
+		}
+	}
+
+	// Only the primary may be chosen among several hosts
+	validate, err := sessionValidator(cfg.Database.TargetSessionAttrs)
+	if err != nil {
+		return nil, err
+	}
+	if validate != nil {
+		dbConfig.ConnConfig.ValidateConnect = validate
+	}
+
+	// Reconnect when a failover demoted the server we are connected to
+	tracers := multiTracer{&readOnlyTracer{p: p}}
+	if dbConfig.ConnConfig.Tracer != nil {
+		tracers = append(tracers, dbConfig.ConnConfig.Tracer)
+	}
+	if stmts != nil {
+		tracers = append(tracers, stmts)
+		dbConfig.AfterConnect = stmts.Prepare
+	}
+	dbConfig.ConnConfig.Tracer = tracers
 	
 	// Create the connection pool
 	pool, err := pgxpool.NewWithConfig(ctx, dbConfig)
@@ -38,17 +72,60 @@ func NewPostgres(ctx context.Context, cfg *config.Config, log *logger.Logger) (*
 		pool.Close()
 		return nil, err
 	}
+	p.Pool = pool
+	p.ReadPool = pool
 	
 	log.Info("Connected to PostgreSQL database")
+
+	if cfg.Database.ReadURL != "" {
+		readConfig, err := poolConfig(cfg.Database.ReadURL, cfg)
+		if err != nil {
+			pool.Close()
+			return nil, err
+		}
+		readPool, err := pgxpool.NewWithConfig(ctx, readConfig)
+		if err != nil {
+			pool.Close()
+			return nil, err
+		}
+		if err := readPool.Ping(ctx); err != nil {
+			readPool.Close()
+			pool.Close()
+			return nil, err
+		}
+		p.ReadPool = readPool
+		log.Info("Connected to PostgreSQL read replica")
+	}
 	
-	return &Postgres{
-		Pool: pool,
-		log:  log,
-	}, nil
+	return p, nil
 }
 
-// Close closes the database connection pool
+// poolConfig parses a database URL and applies the pool settings
+func poolConfig(databaseURL string, cfg *config.Config) (*pgxpool.Config, error) {
+	dbConfig, err := pgxpool.ParseConfig(databaseURL)
+	if err != nil {
+		return nil, err
+	}
+	
+	// Set pool configuration
+	dbConfig.MaxConns = int32(cfg.Database.MaxConnections)
+	dbConfig.MinConns = int32(cfg.Database.MinConnections)
+	dbConfig.MaxConnLifetime = cfg.GetMaxConnectionLifetime()
+	dbConfig.MaxConnIdleTime = cfg.GetMaxConnectionIdleTime()
+	
+	// Trace every query when tracing is enabled
+	if cfg.Tracing.Enabled {
+		dbConfig.ConnConfig.Tracer = tracing.NewPgxTracer()
+	}
+
+	return dbConfig, nil
+}
+
+// Close closes the database connection pools
 func (p *Postgres) Close() {
+	if p.ReadPool != p.Pool {
+		p.ReadPool.Close()
+	}
 	p.Pool.Close()
 	p.log.Info("Closed PostgreSQL connection pool")
 }
\ No newline at end of file
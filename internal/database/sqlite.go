@@ -0,0 +1,131 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+
+	// Pure Go SQLite driver registered as "sqlite"
+	_ "modernc.org/sqlite"
+
+	"github.com/NieRVoid/emqx-pg-bridge/internal/config"
+	"github.com/NieRVoid/emqx-pg-bridge/pkg/logger"
+)
+
+// sqlitePragmas are applied to every connection. Write transactions take the
+// database lock on BEGIN, which stands in for SELECT ... FOR UPDATE.
+var sqlitePragmas = []string{
+	"_pragma=foreign_keys(1)",
+	"_pragma=busy_timeout(5000)",
+	"_pragma=journal_mode(WAL)",
+	"_txlock=immediate",
+}
+
+// SQLite represents an embedded SQLite database
+type SQLite struct {
+	DB  *sql.DB
+	log *logger.Logger
+}
+
+// NewSQLite opens the SQLite database named by a sqlite:// database URL,
+// creating the file if needed
+func NewSQLite(ctx context.Context, cfg *config.Config, log *logger.Logger) (*SQLite, error) {
+	dsn := sqliteDSN(cfg.Database.URL)
+
+	db, err := sql.Open("sqlite", dsn)
+	if err != nil {
+		return nil, err
+	}
+
+	// SQLite has a single writer; one connection avoids busy errors
+	// between our own transactions
+	db.SetMaxOpenConns(1)
+
+	if err := db.PingContext(ctx); err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	log.Info("Opened SQLite database", "path", strings.SplitN(dsn, "?", 2)[0])
+
+	return &SQLite{
+		DB:  db,
+		log: log.Component("database"),
+	}, nil
+}
+
+// sqliteDSN converts sqlite:///abs/path.db, sqlite://rel/path.db or
+// sqlite:path.db into a driver DSN, keeping any query parameters
+func sqliteDSN(url string) string {
+	dsn := strings.TrimPrefix(url, "sqlite:")
+	dsn = strings.TrimPrefix(dsn, "//")
+
+	sep := "?"
+	if strings.Contains(dsn, "?") {
+		sep = "&"
+	}
+	return dsn + sep + strings.Join(sqlitePragmas, "&")
+}
+
+// Migrate applies the migrations that have not been applied yet, with the
+// SQLite versions of the scripts where they differ
+func (s *SQLite) Migrate(ctx context.Context) error {
+	migrations, err := loadMigrations(dialectSQLite)
+	if err != nil {
+		return err
+	}
+
+	if _, err := s.DB.ExecContext(ctx, `
+		CREATE TABLE IF NOT EXISTS schema_migrations (
+			version    text primary key,
+			applied_at timestamp default current_timestamp not null
+		)`); err != nil {
+		return fmt.Errorf("failed to create schema_migrations: %w", err)
+	}
+
+	for _, m := range migrations {
+		applied, err := s.applyMigration(ctx, m)
+		if err != nil {
+			return fmt.Errorf("migration %s failed: %w", m.version, err)
+		}
+		if applied {
+			s.log.Info("Applied migration", "version", m.version)
+		}
+	}
+
+	return nil
+}
+
+func (s *SQLite) applyMigration(ctx context.Context, m migration) (bool, error) {
+	tx, err := s.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	var exists bool
+	if err := tx.QueryRowContext(ctx,
+		`SELECT EXISTS (SELECT 1 FROM schema_migrations WHERE version = ?)`, m.version,
+	).Scan(&exists); err != nil {
+		return false, err
+	}
+	if exists {
+		return false, nil
+	}
+
+	if _, err := tx.ExecContext(ctx, m.script); err != nil {
+		return false, err
+	}
+	if _, err := tx.ExecContext(ctx, `INSERT INTO schema_migrations (version) VALUES (?)`, m.version); err != nil {
+		return false, err
+	}
+
+	return true, tx.Commit()
+}
+
+// Close closes the database
+func (s *SQLite) Close() {
+	s.DB.Close()
+	s.log.Info("Closed SQLite database")
+}
@@ -0,0 +1,151 @@
+package handler
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/go-chi/chi/v5"
+
+	"github.com/NieRVoid/emqx-pg-bridge/internal/command"
+	"github.com/NieRVoid/emqx-pg-bridge/pkg/logger"
+)
+
+// CommandHandler serves the downlink command API
+type CommandHandler struct {
+	service *command.Service
+	token   string
+	log     *logger.Logger
+}
+
+// NewCommandHandler creates a new command API handler. Requests must carry
+// "Authorization: Bearer <token>".
+func NewCommandHandler(service *command.Service, token string, log *logger.Logger) *CommandHandler {
+	return &CommandHandler{
+		service: service,
+		token:   token,
+		log:     log.Component("command-api"),
+	}
+}
+
+// Routes registers the command endpoints on r
+func (h *CommandHandler) Routes(r chi.Router) {
+	r.Group(func(r chi.Router) {
+		r.Use(requireBearer(h.token))
+		r.Post("/devices/{id}/commands", h.Create)
+		r.Get("/devices/{id}/commands", h.List)
+		r.Get("/devices/{id}/commands/{commandId}", h.Get)
+	})
+}
+
+// requireBearer rejects requests without "Authorization: Bearer <token>"
+func requireBearer(expected string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+			if !ok || subtle.ConstantTimeCompare([]byte(token), []byte(expected)) != 1 {
+				writeJSONError(w, http.StatusUnauthorized, "unauthorized")
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+type createCommandRequest struct {
+	Desired json.RawMessage `json:"desired"`
+}
+
+// Create handles POST /devices/{id}/commands with {"desired": {...}}
+func (h *CommandHandler) Create(w http.ResponseWriter, r *http.Request) {
+	log := h.log.WithContext(r.Context())
+
+	deviceID, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, "invalid device id")
+		return
+	}
+
+	var req createCommandRequest
+	body, err := io.ReadAll(io.LimitReader(r.Body, 65536))
+	if err != nil || json.Unmarshal(body, &req) != nil || len(req.Desired) == 0 {
+		writeJSONError(w, http.StatusBadRequest, "invalid request body")
+		return
+	}
+
+	cmd, err := h.service.Create(r.Context(), deviceID, req.Desired)
+	switch {
+	case errors.Is(err, command.ErrDeviceNotFound):
+		writeJSONError(w, http.StatusNotFound, err.Error())
+		return
+	case errors.Is(err, command.ErrInvalidDesired):
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	case err != nil:
+		log.Error("Failed to create command", "deviceId", deviceID, "error", err)
+		writeJSONError(w, http.StatusInternalServerError, "failed to create command")
+		return
+	}
+
+	w.Header().Set("Location", r.URL.Path+"/"+strconv.FormatInt(cmd.ID, 10))
+	if cmd.Status == command.StatusFailed {
+		writeJSON(w, http.StatusBadGateway, cmd)
+		return
+	}
+	writeJSON(w, http.StatusAccepted, cmd)
+}
+
+// List handles GET /devices/{id}/commands?limit=
+func (h *CommandHandler) List(w http.ResponseWriter, r *http.Request) {
+	deviceID, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, "invalid device id")
+		return
+	}
+
+	limit := 20
+	if v := r.URL.Query().Get("limit"); v != "" {
+		if limit, err = strconv.Atoi(v); err != nil || limit <= 0 || limit > 500 {
+			writeJSONError(w, http.StatusBadRequest, "invalid limit")
+			return
+		}
+	}
+
+	cmds, err := h.service.List(r.Context(), deviceID, limit)
+	if err != nil {
+		h.log.WithContext(r.Context()).Error("Failed to list commands", "deviceId", deviceID, "error", err)
+		writeJSONError(w, http.StatusInternalServerError, "failed to list commands")
+		return
+	}
+	writeJSON(w, http.StatusOK, cmds)
+}
+
+// Get handles GET /devices/{id}/commands/{commandId}
+func (h *CommandHandler) Get(w http.ResponseWriter, r *http.Request) {
+	deviceID, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, "invalid device id")
+		return
+	}
+	commandID, err := strconv.ParseInt(chi.URLParam(r, "commandId"), 10, 64)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, "invalid command id")
+		return
+	}
+
+	cmd, err := h.service.Get(r.Context(), deviceID, commandID)
+	if errors.Is(err, command.ErrCommandNotFound) {
+		writeJSONError(w, http.StatusNotFound, err.Error())
+		return
+	}
+	if err != nil {
+		h.log.WithContext(r.Context()).Error("Failed to get command", "commandId", commandID, "error", err)
+		writeJSONError(w, http.StatusInternalServerError, "failed to get command")
+		return
+	}
+	writeJSON(w, http.StatusOK, cmd)
+}
@@ -0,0 +1,139 @@
+package handler
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"strconv"
+
+	"github.com/go-chi/chi/v5"
+
+	"github.com/NieRVoid/emqx-pg-bridge/internal/command"
+	"github.com/NieRVoid/emqx-pg-bridge/internal/shadow"
+	"github.com/NieRVoid/emqx-pg-bridge/pkg/logger"
+)
+
+// ShadowHandler serves the device shadow API
+type ShadowHandler struct {
+	service *shadow.Service
+	token   string
+	log     *logger.Logger
+}
+
+// NewShadowHandler creates a new shadow API handler, authenticated with the
+// same bearer token as the command API
+func NewShadowHandler(service *shadow.Service, token string, log *logger.Logger) *ShadowHandler {
+	return &ShadowHandler{
+		service: service,
+		token:   token,
+		log:     log.Component("shadow-api"),
+	}
+}
+
+// Routes registers the shadow endpoints on r
+func (h *ShadowHandler) Routes(r chi.Router) {
+	r.Group(func(r chi.Router) {
+		r.Use(requireBearer(h.token))
+		r.Get("/devices/{id}/shadow", h.Get)
+		r.Get("/devices/{id}/shadow/delta", h.Delta)
+		r.Patch("/devices/{id}/shadow/desired", h.UpdateDesired)
+	})
+}
+
+// Get handles GET /devices/{id}/shadow
+func (h *ShadowHandler) Get(w http.ResponseWriter, r *http.Request) {
+	s, ok := h.load(w, r)
+	if !ok {
+		return
+	}
+	writeJSON(w, http.StatusOK, s)
+}
+
+type deltaResponse struct {
+	DeviceID int             `json:"deviceId"`
+	Version  int64           `json:"version"`
+	InSync   bool            `json:"inSync"`
+	Delta    json.RawMessage `json:"delta"`
+}
+
+// Delta handles GET /devices/{id}/shadow/delta
+func (h *ShadowHandler) Delta(w http.ResponseWriter, r *http.Request) {
+	s, ok := h.load(w, r)
+	if !ok {
+		return
+	}
+	writeJSON(w, http.StatusOK, deltaResponse{
+		DeviceID: s.DeviceID,
+		Version:  s.Version,
+		InSync:   s.InSync(),
+		Delta:    s.Delta,
+	})
+}
+
+func (h *ShadowHandler) load(w http.ResponseWriter, r *http.Request) (*shadow.Shadow, bool) {
+	deviceID, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, "invalid device id")
+		return nil, false
+	}
+
+	s, err := h.service.Get(r.Context(), deviceID)
+	if errors.Is(err, shadow.ErrDeviceNotFound) {
+		writeJSONError(w, http.StatusNotFound, err.Error())
+		return nil, false
+	}
+	if err != nil {
+		h.log.WithContext(r.Context()).Error("Failed to load shadow", "deviceId", deviceID, "error", err)
+		writeJSONError(w, http.StatusInternalServerError, "failed to load shadow")
+		return nil, false
+	}
+	return s, true
+}
+
+type updateDesiredRequest struct {
+	Desired json.RawMessage `json:"desired"`
+	// Version enables optimistic concurrency when set
+	Version *int64 `json:"version"`
+}
+
+type updateDesiredResponse struct {
+	Shadow  *shadow.Shadow   `json:"shadow"`
+	Command *command.Command `json:"command,omitempty"`
+}
+
+// UpdateDesired handles PATCH /devices/{id}/shadow/desired with
+// {"desired": {...}, "version": n}
+func (h *ShadowHandler) UpdateDesired(w http.ResponseWriter, r *http.Request) {
+	deviceID, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, "invalid device id")
+		return
+	}
+
+	var req updateDesiredRequest
+	body, err := io.ReadAll(io.LimitReader(r.Body, 65536))
+	if err != nil || json.Unmarshal(body, &req) != nil || len(req.Desired) == 0 {
+		writeJSONError(w, http.StatusBadRequest, "invalid request body")
+		return
+	}
+
+	s, cmd, err := h.service.UpdateDesired(r.Context(), deviceID, req.Desired, req.Version)
+	switch {
+	case errors.Is(err, shadow.ErrDeviceNotFound), errors.Is(err, command.ErrDeviceNotFound):
+		writeJSONError(w, http.StatusNotFound, err.Error())
+		return
+	case errors.Is(err, shadow.ErrInvalidDesired):
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	case errors.Is(err, shadow.ErrVersionConflict):
+		writeJSONError(w, http.StatusConflict, err.Error())
+		return
+	case err != nil:
+		h.log.WithContext(r.Context()).Error("Failed to update desired state", "deviceId", deviceID, "error", err)
+		writeJSONError(w, http.StatusInternalServerError, "failed to update desired state")
+		return
+	}
+
+	writeJSON(w, http.StatusOK, updateDesiredResponse{Shadow: s, Command: cmd})
+}
@@ -0,0 +1,269 @@
+package handler
+
+import (
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+
+	"github.com/NieRVoid/emqx-pg-bridge/internal/state"
+	"github.com/NieRVoid/emqx-pg-bridge/pkg/logger"
+)
+
+// Page is the envelope of paginated listings
+type Page[T any] struct {
+	Items  []T `json:"items"`
+	Total  int `json:"total"`
+	Limit  int `json:"limit"`
+	Offset int `json:"offset"`
+}
+
+// StateHandler serves read-only room and device state from the state cache
+type StateHandler struct {
+	cache           *state.Cache
+	defaultPageSize int
+	maxPageSize     int
+	staleAfter      time.Duration
+	// epoch makes ETags from different process lifetimes distinct, since
+	// cache versions restart at zero
+	epoch string
+	log   *logger.Logger
+}
+
+// NewStateHandler creates a new read API handler
+func NewStateHandler(cache *state.Cache, defaultPageSize, maxPageSize int, staleAfter time.Duration, log *logger.Logger) *StateHandler {
+	return &StateHandler{
+		cache:           cache,
+		defaultPageSize: defaultPageSize,
+		maxPageSize:     maxPageSize,
+		staleAfter:      staleAfter,
+		epoch:           strconv.FormatInt(time.Now().UnixNano(), 36),
+		log:             log.Component("read-api"),
+	}
+}
+
+// Routes registers the read endpoints on r
+func (h *StateHandler) Routes(r chi.Router) {
+	r.Get("/rooms", h.ListRooms)
+	r.Get("/rooms/{id}/status", h.RoomStatus)
+	r.Get("/devices", h.ListDevices)
+	r.Get("/devices/{id}/status", h.DeviceStatus)
+}
+
+// ListRooms handles GET /rooms?occupied=true|false&limit=&offset=
+func (h *StateHandler) ListRooms(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+
+	var filter state.RoomFilter
+	if v := q.Get("occupied"); v != "" {
+		occupied, err := strconv.ParseBool(v)
+		if err != nil {
+			writeJSONError(w, http.StatusBadRequest, "invalid occupied filter")
+			return
+		}
+		filter.Occupied = &occupied
+	}
+
+	limit, offset, err := h.pagination(q.Get("limit"), q.Get("offset"))
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	rooms, version := h.cache.Rooms(filter)
+	etag := h.listETag(version, r.URL.RawQuery)
+	if notModified(w, r, etag) {
+		return
+	}
+
+	writeJSONWithETag(w, etag, paginate(rooms, limit, offset))
+}
+
+// RoomStatus handles GET /rooms/{id}/status
+func (h *StateHandler) RoomStatus(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, "invalid room id")
+		return
+	}
+
+	entry, err := h.cache.Room(id)
+	if err != nil {
+		writeJSONError(w, http.StatusNotFound, "room not found")
+		return
+	}
+
+	etag := h.entityETag(entry.Version)
+	if notModified(w, r, etag) {
+		return
+	}
+	writeJSONWithETag(w, etag, entry.Status)
+}
+
+// ListDevices handles GET /devices?room_id=&type=&stale=true&stale_after_seconds=&limit=&offset=
+func (h *StateHandler) ListDevices(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+
+	var filter state.DeviceFilter
+	if v := q.Get("room_id"); v != "" {
+		roomID, err := strconv.Atoi(v)
+		if err != nil {
+			writeJSONError(w, http.StatusBadRequest, "invalid room_id filter")
+			return
+		}
+		filter.RoomID = &roomID
+	}
+	filter.Type = q.Get("type")
+
+	staleOnly := false
+	if v := q.Get("stale"); v != "" {
+		var err error
+		if staleOnly, err = strconv.ParseBool(v); err != nil {
+			writeJSONError(w, http.StatusBadRequest, "invalid stale filter")
+			return
+		}
+	}
+	staleAfter := h.staleAfter
+	if v := q.Get("stale_after_seconds"); v != "" {
+		secs, err := strconv.Atoi(v)
+		if err != nil || secs <= 0 {
+			writeJSONError(w, http.StatusBadRequest, "invalid stale_after_seconds")
+			return
+		}
+		staleAfter = time.Duration(secs) * time.Second
+		staleOnly = true
+	}
+	var staleBefore time.Time
+	if staleOnly {
+		staleBefore = time.Now().Add(-staleAfter)
+		filter.StaleBefore = &staleBefore
+	}
+
+	limit, offset, err := h.pagination(q.Get("limit"), q.Get("offset"))
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	devices, version := h.cache.Devices(filter)
+
+	// Staleness depends on the clock, so stale listings are not cacheable
+	if staleOnly {
+		w.Header().Set("Cache-Control", "no-cache")
+		writeJSON(w, http.StatusOK, paginate(devices, limit, offset))
+		return
+	}
+
+	etag := h.listETag(version, r.URL.RawQuery)
+	if notModified(w, r, etag) {
+		return
+	}
+	writeJSONWithETag(w, etag, paginate(devices, limit, offset))
+}
+
+// DeviceStatus handles GET /devices/{id}/status
+func (h *StateHandler) DeviceStatus(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, "invalid device id")
+		return
+	}
+
+	entry, err := h.cache.Device(id)
+	if err != nil {
+		writeJSONError(w, http.StatusNotFound, "device not found")
+		return
+	}
+
+	etag := h.entityETag(entry.Version)
+	if notModified(w, r, etag) {
+		return
+	}
+	writeJSONWithETag(w, etag, entry.Status)
+}
+
+func (h *StateHandler) pagination(limitStr, offsetStr string) (int, int, error) {
+	limit := h.defaultPageSize
+	if limitStr != "" {
+		v, err := strconv.Atoi(limitStr)
+		if err != nil || v <= 0 {
+			return 0, 0, fmt.Errorf("invalid limit")
+		}
+		limit = v
+	}
+	if limit > h.maxPageSize {
+		limit = h.maxPageSize
+	}
+
+	offset := 0
+	if offsetStr != "" {
+		v, err := strconv.Atoi(offsetStr)
+		if err != nil || v < 0 {
+			return 0, 0, fmt.Errorf("invalid offset")
+		}
+		offset = v
+	}
+	return limit, offset, nil
+}
+
+func (h *StateHandler) entityETag(version uint64) string {
+	return fmt.Sprintf(`W/"%s-%d"`, h.epoch, version)
+}
+
+// listETag covers the cache version and the query, since different filters
+// or pages of the same version are different representations
+func (h *StateHandler) listETag(version uint64, rawQuery string) string {
+	hash := fnv.New32a()
+	hash.Write([]byte(rawQuery))
+	return fmt.Sprintf(`W/"%s-%d-%x"`, h.epoch, version, hash.Sum32())
+}
+
+func paginate[T any](items []T, limit, offset int) Page[T] {
+	page := Page[T]{Items: []T{}, Total: len(items), Limit: limit, Offset: offset}
+	if offset < len(items) {
+		end := offset + limit
+		if end > len(items) {
+			end = len(items)
+		}
+		page.Items = items[offset:end]
+	}
+	return page
+}
+
+// notModified answers 304 when the client's If-None-Match covers etag
+func notModified(w http.ResponseWriter, r *http.Request, etag string) bool {
+	inm := r.Header.Get("If-None-Match")
+	if inm == "" {
+		return false
+	}
+	for _, candidate := range strings.Split(inm, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" || strings.TrimPrefix(candidate, "W/") == strings.TrimPrefix(etag, "W/") {
+			w.Header().Set("ETag", etag)
+			w.WriteHeader(http.StatusNotModified)
+			return true
+		}
+	}
+	return false
+}
+
+func writeJSONWithETag(w http.ResponseWriter, etag string, v interface{}) {
+	w.Header().Set("ETag", etag)
+	w.Header().Set("Cache-Control", "no-cache")
+	writeJSON(w, http.StatusOK, v)
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeJSONError(w http.ResponseWriter, status int, msg string) {
+	writeJSON(w, status, map[string]string{"error": msg})
+}
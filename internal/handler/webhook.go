@@ -2,28 +2,90 @@ package handler
 
 import (
 	"encoding/json"
+	"errors"
 	"io"
 	"net/http"
-	
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5/middleware"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+
 	"github.com/NieRVoid/emqx-pg-bridge/internal/models"
 	"github.com/NieRVoid/emqx-pg-bridge/internal/processor"
+	"github.com/NieRVoid/emqx-pg-bridge/internal/ratelimit"
+	"github.com/NieRVoid/emqx-pg-bridge/internal/spool"
+	"github.com/NieRVoid/emqx-pg-bridge/internal/tenant"
+	"github.com/NieRVoid/emqx-pg-bridge/internal/tracing"
 	"github.com/NieRVoid/emqx-pg-bridge/pkg/logger"
 )
 
 // WebhookHandler processes incoming webhooks from EMQX
 type WebhookHandler struct {
+	registry   *processor.ProcessorRegistry
+	deadLetter *spool.Spool
+	presence   *processor.PresenceProcessor
+	breaker    Breaker
+	tenants    *tenant.Resolver
+	limiter    *ratelimit.Limiter
+	log        *logger.Logger
+}
+
+// webhookTarget holds what a webhook is handed to: the processors, presence
+// tracking and breaker of its tenant
+type webhookTarget struct {
+	// tenant is the resolved tenant id, empty without tenants
+	tenant   string
 	registry *processor.ProcessorRegistry
-	log      *logger.Logger
+	presence *processor.PresenceProcessor
+	breaker  Breaker
 }
 
-// NewWebhookHandler creates a new webhook handler
-func NewWebhookHandler(registry *processor.ProcessorRegistry, log *logger.Logger) *WebhookHandler {
+// Breaker short-circuits processing while the database is unavailable
+type Breaker interface {
+	Allow() bool
+	Record(err error)
+}
+
+// ErrCircuitOpen is the dead-letter cause of webhooks not processed because
+// the circuit breaker was open
+var ErrCircuitOpen = errors.New("database circuit breaker open")
+
+// NewWebhookHandler creates a new webhook handler. deadLetter may be nil,
+// in which case processing failures are only reported to EMQX.
+func NewWebhookHandler(registry *processor.ProcessorRegistry, deadLetter *spool.Spool, log *logger.Logger) *WebhookHandler {
 	return &WebhookHandler{
-		registry: registry,
-		log:      log,
+		registry:   registry,
+		deadLetter: deadLetter,
+		log:        log.Component("webhook"),
 	}
 }
 
+// SetPresence records the activity of publishing clients with p. Client and
+// session events are routed to the presence processor through the registry.
+func (h *WebhookHandler) SetPresence(p *processor.PresenceProcessor) {
+	h.presence = p
+}
+
+// SetBreaker makes webhooks go straight to the dead-letter spool while b
+// reports the database as unavailable
+func (h *WebhookHandler) SetBreaker(b Breaker) {
+	h.breaker = b
+}
+
+// SetTenants hands every webhook to the processors of the tenant resolved by
+// r instead of the handler's own, requiring the tenant's auth key
+func (h *WebhookHandler) SetTenants(r *tenant.Resolver) {
+	h.tenants = r
+}
+
+// SetLimiter applies the rate limits of l to webhooks before processing them
+func (h *WebhookHandler) SetLimiter(l *ratelimit.Limiter) {
+	h.limiter = l
+}
+
 // Handle processes webhook requests
 func (h *WebhookHandler) Handle(w http.ResponseWriter, r *http.Request) {
 	// Check method
@@ -31,55 +93,216 @@ func (h *WebhookHandler) Handle(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 		return
 	}
-	
+
+	received := time.Now()
+	ctx := tracing.ExtractHTTP(r.Context(), r.Header)
+
+	// Propagate the request id to everything logged while handling this webhook
+	ctx = logger.ContextWith(ctx, "request_id", middleware.GetReqID(r.Context()))
+	log := h.log.WithContext(ctx)
+
 	// Limit request body size
 	body, err := io.ReadAll(io.LimitReader(r.Body, 1048576)) // 1 MB limit
 	if err != nil {
-		h.log.Error("Failed to read request body", "error", err)
+		log.Error("Failed to read request body", "error", err)
 		http.Error(w, "Failed to read request body", http.StatusInternalServerError)
 		return
 	}
-	
+
 	// Parse the request body
 	var data models.WebhookData
-	if err := json.Unmarshal(body, &data); err != nil {
-		h.log.Error("Failed to decode webhook data", "error", err)
+	decodeErr := json.Unmarshal(body, &data)
+	decoded := time.Now()
+
+	// The trace parent may only be known once the MQTT user properties are
+	// decoded, so the handler and decode spans are started retroactively
+	if decodeErr == nil {
+		ctx = tracing.ExtractWebhook(ctx, &data)
+	}
+	ctx, span := tracing.Tracer().Start(ctx, "WebhookHandler.Handle",
+		trace.WithSpanKind(trace.SpanKindServer),
+		trace.WithTimestamp(received),
+		trace.WithAttributes(
+			attribute.String("http.request_id", middleware.GetReqID(r.Context())),
+			attribute.Int("http.request_content_length", len(body)),
+		))
+	defer span.End()
+
+	_, decodeSpan := tracing.Tracer().Start(ctx, "webhook.decode", trace.WithTimestamp(received))
+	if decodeErr != nil {
+		decodeSpan.RecordError(decodeErr)
+		decodeSpan.SetStatus(codes.Error, "invalid webhook body")
+	}
+	decodeSpan.End(trace.WithTimestamp(decoded))
+
+	if traceID := tracing.TraceID(ctx); traceID != "" {
+		ctx = logger.ContextWith(ctx, "trace_id", traceID)
+		log = h.log.WithContext(ctx)
+	}
+
+	if decodeErr != nil {
+		log.Error("Failed to decode webhook data", "error", decodeErr)
+		span.SetStatus(codes.Error, "invalid request body")
 		http.Error(w, "Invalid request body", http.StatusBadRequest)
 		return
 	}
-	
-	// Extract device type
+
+	// Extract device type; connection and session events carry no user
+	// properties and all go to the presence processor
 	deviceType := data.GetUserProperty("deviceType")
+	if data.IsClientEvent() {
+		deviceType = processor.PresenceType
+	}
 	if deviceType == "" {
-		h.log.Error("Missing deviceType in webhook data")
+		log.Error("Missing deviceType in webhook data")
+		span.SetStatus(codes.Error, "missing deviceType")
 		http.Error(w, "Missing deviceType", http.StatusBadRequest)
 		return
 	}
-	
-	h.log.Debug("Received webhook", 
-		"deviceType", deviceType, 
-		"topic", data.Topic, 
-		"clientId", data.ClientID)
-	
+
+	target := webhookTarget{registry: h.registry, presence: h.presence, breaker: h.breaker}
+	if h.tenants != nil {
+		t, err := h.tenants.Resolve(&data)
+		if err != nil {
+			log.Sampled("tenant.unknown").Warn("No tenant for webhook",
+				"topic", data.Topic, "username", data.Username)
+			span.SetStatus(codes.Error, "unknown tenant")
+			http.Error(w, "Unknown tenant", http.StatusBadRequest)
+			return
+		}
+
+		// Label everything logged and traced from here on with the tenant
+		ctx = logger.ContextWith(ctx, "tenant", t.ID)
+		log = h.log.WithContext(ctx)
+		span.SetAttributes(attribute.String("tenant.id", t.ID))
+
+		key, _ := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !t.Authorize(key) {
+			log.Warn("Rejected webhook without a valid tenant key", "remoteAddr", r.RemoteAddr)
+			span.SetStatus(codes.Error, "unauthorized")
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		target = webhookTarget{tenant: t.ID, registry: t.Registry, presence: t.Presence}
+		if t.Breaker != nil {
+			target.breaker = t.Breaker
+		}
+	}
+
+	if h.limiter != nil {
+		if decision, limit := h.limiter.Check(deviceType, &data); decision != ratelimit.Allow {
+			log.Sampled("ratelimit.throttled").Warn("Webhook over rate limit",
+				"limit", limit, "deviceType", deviceType, "clientId", data.ClientID)
+			span.SetAttributes(attribute.String("ratelimit.limit", limit))
+
+			switch decision {
+			case ratelimit.SampledOut:
+				writeStatus(w, http.StatusAccepted, "sampled-out")
+			case ratelimit.Coalesced:
+				writeStatus(w, http.StatusAccepted, "coalesced")
+			default:
+				span.SetStatus(codes.Error, "rate limited")
+				w.Header().Set("Retry-After", "1")
+				http.Error(w, "Too many requests", http.StatusTooManyRequests)
+			}
+			return
+		}
+	}
+
+	span.SetAttributes(
+		attribute.String("emqx.device_type", deviceType),
+		attribute.String("messaging.destination.name", data.Topic),
+		attribute.String("messaging.client_id", data.ClientID),
+		attribute.String("emqx.event", data.Event),
+	)
+
+	log.Debug("Received webhook",
+		"deviceType", deviceType,
+		"topic", data.Topic,
+		"clientId", data.ClientID,
+		"event", data.Event,
+		"webhook", &data)
+
 	// Get the appropriate processor
-	processor, ok := h.registry.Get(deviceType)
+	proc, ok := target.registry.Get(deviceType)
+	if !ok && target.registry.IsDisabled(deviceType) {
+		log.Warn("Processor disabled, rejecting webhook", "deviceType", deviceType)
+		span.SetStatus(codes.Error, "processor disabled")
+		http.Error(w, "Processor disabled", http.StatusServiceUnavailable)
+		return
+	}
 	if !ok {
-		h.log.Error("Unsupported device type", "deviceType", deviceType)
+		log.Error("Unsupported device type", "deviceType", deviceType)
+		span.SetStatus(codes.Error, "unsupported device type")
 		http.Error(w, "Unsupported device type", http.StatusBadRequest)
 		return
 	}
-	
-	// Process the data
-	if err := processor.Process(r.Context(), &data); err != nil {
-		h.log.Error("Failed to process webhook data", 
-			"deviceType", deviceType, 
+
+	if target.breaker != nil && !target.breaker.Allow() {
+		err = ErrCircuitOpen
+	} else {
+		if target.presence != nil && !data.IsClientEvent() {
+			target.presence.Touch(ctx, &data)
+		}
+
+		// Process the data
+		dispatchCtx, dispatchSpan := tracing.Tracer().Start(ctx, "processor.dispatch",
+			trace.WithAttributes(attribute.String("processor.type", proc.Type())))
+		err = proc.Process(dispatchCtx, &data)
+		if err != nil {
+			dispatchSpan.RecordError(err)
+			dispatchSpan.SetStatus(codes.Error, err.Error())
+		}
+		dispatchSpan.End()
+
+		if target.breaker != nil {
+			target.breaker.Record(err)
+		}
+	}
+
+	if errors.Is(err, ErrCircuitOpen) {
+		log.Sampled("circuit.open").Warn("Database unavailable, not processing webhook",
+			"deviceType", deviceType)
+		span.SetStatus(codes.Error, "circuit open")
+	} else if err != nil {
+		log.Error("Failed to process webhook data",
+			"deviceType", deviceType,
 			"error", err)
+		span.SetStatus(codes.Error, "processing error")
+	}
+	if err != nil {
+		// Replaying a message the database rejected would fail again
+		if processor.IsPermanent(err) {
+			http.Error(w, "Unprocessable webhook", http.StatusUnprocessableEntity)
+			return
+		}
+
+		// Keep the message for a later replay instead of losing it
+		if h.deadLetter != nil {
+			spoolErr := h.deadLetter.Put(target.tenant, deviceType, &data, err)
+			if spoolErr == nil {
+				writeStatus(w, http.StatusAccepted, "dead-lettered")
+				return
+			}
+			log.Error("Failed to dead-letter webhook", "deviceType", deviceType, "error", spoolErr)
+		}
+
+		if errors.Is(err, ErrCircuitOpen) {
+			http.Error(w, "Database unavailable", http.StatusServiceUnavailable)
+			return
+		}
 		http.Error(w, "Processing error", http.StatusInternalServerError)
 		return
 	}
-	
+
 	// Return success
+	writeStatus(w, http.StatusOK, "ok")
+}
+
+// writeStatus writes a {"status": ...} JSON response
+func writeStatus(w http.ResponseWriter, code int, status string) {
 	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(http.StatusOK)
-	w.Write([]byte(`{"status":"ok"}`))
-}
\ No newline at end of file
+	w.WriteHeader(code)
+	w.Write([]byte(`{"status":"` + status + `"}`))
+}
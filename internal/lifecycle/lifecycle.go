@@ -0,0 +1,268 @@
+package lifecycle
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/NieRVoid/emqx-pg-bridge/pkg/logger"
+)
+
+// DrainFunc stops or drains one part of the bridge during shutdown. It
+// returns the number of items, e.g. queued records or pending webhooks, it
+// had to abandon when ctx expired.
+type DrainFunc func(ctx context.Context) (abandoned int, err error)
+
+// StepResult is the outcome of one shutdown step
+type StepResult struct {
+	Phase     string
+	Step      string
+	Abandoned int
+	Err       error
+	Duration  time.Duration
+	// TimedOut is set when the step did not return within its phase timeout
+	TimedOut bool
+}
+
+// Manager tracks readiness and shuts the bridge down in phases. Phases run
+// in the order they were added, each bounded by its own timeout; the steps
+// of a phase run one after the other, so that e.g. pending webhooks are
+// written before the sinks they feed are drained.
+type Manager struct {
+	log        *logger.Logger
+	ready      atomic.Bool
+	readyDelay time.Duration
+	phases     []*phase
+	// running are the steps that timed out and have not returned yet
+	running []*runningStep
+}
+
+type phase struct {
+	name    string
+	timeout time.Duration
+	steps   []step
+}
+
+type step struct {
+	name  string
+	drain DrainFunc
+	// closing steps wait for the steps that timed out before them
+	closing bool
+}
+
+// outcome is what a step returned
+type outcome struct {
+	abandoned int
+	err       error
+}
+
+// runningStep is a step left behind by its phase timeout
+type runningStep struct {
+	// result is the index of the step in the shutdown results
+	result int
+	done   <-chan outcome
+}
+
+// NewManager creates a manager that is not ready yet
+func NewManager(log *logger.Logger) *Manager {
+	return &Manager{log: log.Component("lifecycle")}
+}
+
+// AddPhase appends a shutdown phase bounded by timeout
+func (m *Manager) AddPhase(name string, timeout time.Duration) {
+	m.phases = append(m.phases, &phase{name: name, timeout: timeout})
+}
+
+// AddStep appends a step to a phase added before
+func (m *Manager) AddStep(phaseName, name string, fn DrainFunc) {
+	m.addStep(phaseName, step{name: name, drain: fn})
+}
+
+// AddClosingStep appends a step releasing what earlier steps may still use,
+// e.g. the database pools. It runs only once every step that timed out
+// before it has returned, and is skipped if they are still running when its
+// phase timeout expires.
+func (m *Manager) AddClosingStep(phaseName, name string, fn DrainFunc) {
+	m.addStep(phaseName, step{name: name, drain: fn, closing: true})
+}
+
+func (m *Manager) addStep(phaseName string, s step) {
+	for _, p := range m.phases {
+		if p.name == phaseName {
+			p.steps = append(p.steps, s)
+			return
+		}
+	}
+	panic(fmt.Sprintf("lifecycle: unknown phase %q", phaseName))
+}
+
+// SetReadyDelay keeps the bridge serving for d after it reported not ready,
+// before the first phase runs, so that load balancers polling readiness stop
+// sending webhooks before the listener closes
+func (m *Manager) SetReadyDelay(d time.Duration) {
+	m.readyDelay = d
+}
+
+// SetReady marks the bridge ready to receive webhooks
+func (m *Manager) SetReady() {
+	m.ready.Store(true)
+}
+
+// Ready reports whether the bridge is started and not shutting down
+func (m *Manager) Ready() bool {
+	return m.ready.Load()
+}
+
+// ReadyHandler answers readiness probes, with 503 before startup completed
+// and once shutdown began so that load balancers stop sending webhooks
+func (m *Manager) ReadyHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if !m.Ready() {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		w.Write([]byte(`{"status":"not ready"}`))
+		return
+	}
+	w.Write([]byte(`{"status":"ready"}`))
+}
+
+// Shutdown marks the bridge not ready, waits the ready delay and runs every
+// phase. It logs a summary of the work abandoned and returns the result of
+// every step.
+func (m *Manager) Shutdown() []StepResult {
+	m.ready.Store(false)
+	started := time.Now()
+	if m.readyDelay > 0 {
+		m.log.Info("Not ready, waiting before shutdown", "delay", m.readyDelay)
+		time.Sleep(m.readyDelay)
+	}
+
+	var results []StepResult
+	for _, p := range m.phases {
+		results = m.runPhase(p, results)
+	}
+	// Count what steps that timed out reported when they returned meanwhile
+	m.collect(results)
+
+	abandoned := 0
+	var incomplete []string
+	for _, r := range results {
+		abandoned += r.Abandoned
+		if r.Abandoned > 0 || r.Err != nil || r.TimedOut {
+			incomplete = append(incomplete, r.Phase+"/"+r.Step)
+		}
+	}
+	if len(incomplete) > 0 {
+		m.log.Warn("Shutdown left work unfinished",
+			"abandoned", abandoned, "steps", incomplete, "stillRunning", len(m.running),
+			"duration", time.Since(started))
+	} else {
+		m.log.Info("Shutdown completed", "duration", time.Since(started))
+	}
+	return results
+}
+
+// runPhase runs the steps of a phase until they are done or the phase
+// timeout expires and appends their results. A step still running then is
+// left behind and reported as timed out; the steps after it still run, with
+// the expired context, except closing steps.
+func (m *Manager) runPhase(p *phase, results []StepResult) []StepResult {
+	ctx, cancel := context.WithTimeout(context.Background(), p.timeout)
+	defer cancel()
+
+	log := m.log.With("phase", p.name)
+	log.Info("Shutdown phase started", "steps", len(p.steps), "timeout", p.timeout)
+
+	for _, s := range p.steps {
+		res := StepResult{Phase: p.name, Step: s.name}
+		start := time.Now()
+
+		if s.closing && !m.await(ctx, results) {
+			res.Err = fmt.Errorf("skipped, %d timed out steps still running", len(m.running))
+			res.Duration = time.Since(start)
+			log.Error("Shutdown step skipped", "step", s.name, "error", res.Err)
+			results = append(results, res)
+			continue
+		}
+
+		done := make(chan outcome, 1)
+		go func() {
+			abandoned, err := s.drain(ctx)
+			done <- outcome{abandoned: abandoned, err: err}
+		}()
+
+		var out outcome
+		select {
+		case out = <-done:
+		case <-ctx.Done():
+			// Give a step honouring ctx the chance to report what it left
+			select {
+			case out = <-done:
+			case <-time.After(100 * time.Millisecond):
+				res.TimedOut = true
+				out.err = ctx.Err()
+			}
+		}
+		res.Abandoned, res.Err = out.abandoned, out.err
+		res.Duration = time.Since(start)
+		if res.TimedOut {
+			m.running = append(m.running, &runningStep{result: len(results), done: done})
+		}
+
+		switch {
+		case res.TimedOut:
+			log.Error("Shutdown step timed out", "step", s.name, "duration", res.Duration)
+		case res.Err != nil:
+			log.Error("Shutdown step failed", "step", s.name, "abandoned", res.Abandoned, "error", res.Err)
+		case res.Abandoned > 0:
+			log.Warn("Shutdown step abandoned work", "step", s.name, "abandoned", res.Abandoned)
+		default:
+			log.Debug("Shutdown step completed", "step", s.name, "duration", res.Duration)
+		}
+		results = append(results, res)
+	}
+	return results
+}
+
+// await waits until the steps that timed out have returned, recording what
+// they abandoned, and reports whether they all did before ctx expired
+func (m *Manager) await(ctx context.Context, results []StepResult) bool {
+	for len(m.running) > 0 {
+		r := m.running[0]
+		select {
+		case out := <-r.done:
+			m.record(results, r, out)
+			m.running = m.running[1:]
+		case <-ctx.Done():
+			m.collect(results)
+			return len(m.running) == 0
+		}
+	}
+	return true
+}
+
+// collect records the steps that timed out and have returned since
+func (m *Manager) collect(results []StepResult) {
+	running := m.running[:0]
+	for _, r := range m.running {
+		select {
+		case out := <-r.done:
+			m.record(results, r, out)
+		default:
+			running = append(running, r)
+		}
+	}
+	m.running = running
+}
+
+// record updates the result of a step that returned after its timeout
+func (m *Manager) record(results []StepResult, r *runningStep, out outcome) {
+	res := &results[r.result]
+	res.Abandoned = out.abandoned
+	if out.err != nil {
+		res.Err = out.err
+	}
+	m.log.Warn("Timed out shutdown step returned", "phase", res.Phase, "step", res.Step,
+		"abandoned", res.Abandoned, "error", out.err)
+}
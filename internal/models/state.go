@@ -0,0 +1,71 @@
+package models
+
+import (
+	"encoding/json"
+	"time"
+)
+
+// RoomStatus is a room together with its current room_status row
+type RoomStatus struct {
+	RoomID             int             `json:"roomId"`
+	Number             string          `json:"number"`
+	Name               string          `json:"name"`
+	Occupancy          string          `json:"occupancy"`
+	Occupied           bool            `json:"occupied"`
+	OccupantCount      int             `json:"occupantCount"`
+	CountConfidence    int             `json:"countConfidence"`
+	OccupiedConfidence int             `json:"occupiedConfidence"`
+	CountSource        string          `json:"countSource"`
+	LastSourceChange   *time.Time      `json:"lastSourceChange,omitempty"`
+	Temperature        *int            `json:"temperature,omitempty"`
+	Humidity           *int            `json:"humidity,omitempty"`
+	AirQuality         *int            `json:"airQuality,omitempty"`
+	LightLevel         *int            `json:"lightLevel,omitempty"`
+	NoiseLevel         *int            `json:"noiseLevel,omitempty"`
+	Metadata           json.RawMessage `json:"metadata,omitempty"`
+	UpdatedAt          *time.Time      `json:"updatedAt,omitempty"`
+}
+
+// DeviceStatus is a device together with its current device_status row
+type DeviceStatus struct {
+	DeviceID       int             `json:"deviceId"`
+	UUID           string          `json:"uuid"`
+	Name           string          `json:"name"`
+	Type           string          `json:"type"`
+	RoomID         int             `json:"roomId"`
+	Status         json.RawMessage `json:"status,omitempty"`
+	UpdatedAt      *time.Time      `json:"updatedAt,omitempty"`
+	LastReportedAt *time.Time      `json:"lastReportedAt,omitempty"`
+}
+
+// RoomStatusChange describes a room_status write that has been committed.
+// Old is nil when the write created the row.
+type RoomStatusChange struct {
+	Old *RoomStatus
+	New *RoomStatus
+}
+
+// OccupancyChanged reports whether the write changed occupied or occupant_count
+func (c *RoomStatusChange) OccupancyChanged() bool {
+	if c.Old == nil {
+		return true
+	}
+	return c.Old.Occupied != c.New.Occupied || c.Old.OccupantCount != c.New.OccupantCount
+}
+
+// DeviceStatusChange describes a device_status write that has been committed.
+// Old is nil when the write created the row.
+type DeviceStatusChange struct {
+	Old *DeviceStatus
+	New *DeviceStatus
+}
+
+// OccupancyTransition is a committed change of rooms.occupancy
+type OccupancyTransition struct {
+	RoomID      int       `json:"roomId"`
+	From        string    `json:"from"`
+	To          string    `json:"to"`
+	Probability int       `json:"probability"`
+	Reason      string    `json:"reason"`
+	At          time.Time `json:"at"`
+}
@@ -2,6 +2,7 @@ package models
 
 import (
 	"encoding/json"
+	"strings"
 )
 
 // WebhookData represents the structure of the EMQX webhook data
@@ -22,6 +23,14 @@ type WebhookData struct {
 	PeerName          string                   `json:"peername"`
 	ID                string                   `json:"id"`
 	ClientAttrs       map[string]interface{}   `json:"client_attrs"`
+
+	// Client and session event fields
+	Reason            string                   `json:"reason"`
+	ConnectedAt       int64                    `json:"connected_at"`
+	DisconnectedAt    int64                    `json:"disconnected_at"`
+	Keepalive         int                      `json:"keepalive"`
+	ProtoName         string                   `json:"proto_name"`
+	ProtoVer          int                      `json:"proto_ver"`
 }
 
 // WebhookPubProps contains the MQTT publish properties
@@ -53,6 +62,12 @@ func (d *WebhookData) GetUserProperty(key string) string {
 	return ""
 }
 
+// IsClientEvent reports whether the webhook carries a client connection or
+// session event rather than a published message
+func (d *WebhookData) IsClientEvent() bool {
+	return strings.HasPrefix(d.Event, "client.") || strings.HasPrefix(d.Event, "session.")
+}
+
 // GetPayloadJSON parses the payload as JSON into the provided struct
 func (d *WebhookData) GetPayloadJSON(v interface{}) error {
 	return json.Unmarshal([]byte(d.Payload), v)
@@ -0,0 +1,197 @@
+package occupancy
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+
+	"github.com/NieRVoid/emqx-pg-bridge/internal/models"
+	"github.com/NieRVoid/emqx-pg-bridge/pkg/logger"
+)
+
+// Listener is notified after a transition has been committed
+type Listener interface {
+	RoomOccupancyChanged(ctx context.Context, t *models.OccupancyTransition)
+}
+
+// Engine applies the rules to room_status and maintains rooms.occupancy
+type Engine struct {
+	db        *pgxpool.Pool
+	rules     Rules
+	listeners []Listener
+	log       *logger.Logger
+}
+
+// NewEngine creates a new occupancy rule engine
+func NewEngine(db *pgxpool.Pool, rules Rules, log *logger.Logger) *Engine {
+	return &Engine{
+		db:    db,
+		rules: rules,
+		log:   log.Component("occupancy"),
+	}
+}
+
+// AddListener registers a listener for committed transitions. It must be
+// called before the engine starts.
+func (e *Engine) AddListener(l Listener) {
+	e.listeners = append(e.listeners, l)
+}
+
+// RoomStatusChanged implements processor.RoomStatusListener
+func (e *Engine) RoomStatusChanged(ctx context.Context, change *models.RoomStatusChange) {
+	if _, err := e.Evaluate(ctx, change.New.RoomID, time.Now()); err != nil {
+		e.log.WithContext(ctx).Error("Failed to evaluate occupancy", "roomId", change.New.RoomID, "error", err)
+	}
+}
+
+// Run re-evaluates rooms with a pending candidate state every interval, so
+// that dwell timers expire without waiting for the next report
+func (e *Engine) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			rows, err := e.db.Query(ctx, `SELECT room_id FROM room_occupancy_state WHERE candidate IS NOT NULL`)
+			if err != nil {
+				if ctx.Err() == nil {
+					e.log.Error("Failed to list pending occupancy candidates", "error", err)
+				}
+				continue
+			}
+			roomIDs, err := pgx.CollectRows(rows, pgx.RowTo[int])
+			if err != nil {
+				e.log.Error("Failed to list pending occupancy candidates", "error", err)
+				continue
+			}
+			for _, roomID := range roomIDs {
+				if _, err := e.Evaluate(ctx, roomID, time.Now()); err != nil && ctx.Err() == nil {
+					e.log.Error("Failed to evaluate occupancy", "roomId", roomID, "error", err)
+				}
+			}
+		}
+	}
+}
+
+// Evaluate applies the rules to the current room_status of a room. The
+// latest row is read rather than the triggering write, so evaluations of
+// concurrent reports cannot apply an outdated state. It returns the committed
+// transition, or nil when the state did not change.
+func (e *Engine) Evaluate(ctx context.Context, roomID int, now time.Time) (*models.OccupancyTransition, error) {
+	tx, err := e.db.Begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback(ctx)
+
+	// Seed the engine state from whatever rooms.occupancy holds today
+	if _, err := tx.Exec(ctx, `
+		INSERT INTO room_occupancy_state (room_id, state)
+		SELECT id, occupancy FROM rooms WHERE id = $1
+		ON CONFLICT (room_id) DO NOTHING`, roomID); err != nil {
+		return nil, err
+	}
+
+	var state string
+	var candidate *string
+	var candidateSince *time.Time
+	err = tx.QueryRow(ctx, `
+		SELECT state, candidate, candidate_since
+		FROM room_occupancy_state WHERE room_id = $1
+		FOR UPDATE`, roomID).Scan(&state, &candidate, &candidateSince)
+	if errors.Is(err, pgx.ErrNoRows) {
+		// The room does not exist
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var in Input
+	err = tx.QueryRow(ctx, `
+		SELECT occupied, occupied_confidence, occupant_count, count_confidence, count_source
+		FROM room_status WHERE room_id = $1`, roomID,
+	).Scan(&in.Occupied, &in.OccupiedConfidence, &in.OccupantCount, &in.CountConfidence, &in.ChangeSource)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	d := e.rules.Classify(in)
+
+	if d.State == state {
+		if candidate != nil {
+			if _, err := tx.Exec(ctx, `
+				UPDATE room_occupancy_state SET candidate = NULL, candidate_since = NULL
+				WHERE room_id = $1`, roomID); err != nil {
+				return nil, err
+			}
+			e.log.Debug("Occupancy candidate dropped", "roomId", roomID, "state", state, "candidate", *candidate)
+		}
+		return nil, tx.Commit(ctx)
+	}
+
+	since := now
+	if candidate != nil && *candidate == d.State && candidateSince != nil {
+		since = *candidateSince
+	}
+
+	if !d.Immediate && now.Sub(since) < e.rules.DwellFor(d.State) {
+		if _, err := tx.Exec(ctx, `
+			UPDATE room_occupancy_state SET candidate = $2, candidate_since = $3
+			WHERE room_id = $1`, roomID, d.State, since); err != nil {
+			return nil, err
+		}
+		return nil, tx.Commit(ctx)
+	}
+
+	t := &models.OccupancyTransition{
+		RoomID:      roomID,
+		From:        state,
+		To:          d.State,
+		Probability: d.Probability,
+		Reason:      d.Reason,
+		At:          now,
+	}
+
+	if _, err := tx.Exec(ctx, `
+		UPDATE room_occupancy_state
+		SET state = $2, candidate = NULL, candidate_since = NULL, changed_at = $3
+		WHERE room_id = $1`, roomID, t.To, now); err != nil {
+		return nil, err
+	}
+	if _, err := tx.Exec(ctx, `
+		UPDATE rooms SET occupancy = $2, updated_at = NOW() WHERE id = $1`, roomID, t.To); err != nil {
+		return nil, err
+	}
+	if _, err := tx.Exec(ctx, `
+		INSERT INTO occupancy_transitions (
+			room_id, from_state, to_state, probability, occupied, occupied_confidence,
+			occupant_count, count_confidence, change_source, reason, created_at
+		)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11)`,
+		roomID, t.From, t.To, t.Probability, in.Occupied, in.OccupiedConfidence,
+		in.OccupantCount, in.CountConfidence, in.ChangeSource, t.Reason, now); err != nil {
+		return nil, err
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return nil, err
+	}
+
+	e.log.WithContext(ctx).Info("Room occupancy changed",
+		"roomId", roomID, "from", t.From, "to", t.To,
+		"probability", t.Probability, "reason", t.Reason)
+	for _, l := range e.listeners {
+		l.RoomOccupancyChanged(ctx, t)
+	}
+	return t, nil
+}
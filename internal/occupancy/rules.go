@@ -0,0 +1,104 @@
+package occupancy
+
+import (
+	"fmt"
+	"time"
+)
+
+// Derived room states written to rooms.occupancy
+const (
+	StateUnknown   = "unknown"
+	StateVacant    = "vacant"
+	StateOccupied  = "occupied"
+	StateUncertain = "uncertain"
+)
+
+// SourceRule adjusts how much a change source is trusted
+type SourceRule struct {
+	// Weight scales the confidences reported by the source between 0 (the
+	// source is ignored) and 1 (taken at face value)
+	Weight float64
+	// Immediate applies transitions from this source without dwell time
+	Immediate bool
+}
+
+// Rules derives the room-level occupancy state from room_status
+type Rules struct {
+	// OccupiedAbove and VacantBelow bound the hysteresis band of the
+	// occupancy probability (0-100). Inside the band the current state is
+	// kept until the uncertain dwell time has passed.
+	OccupiedAbove int
+	VacantBelow   int
+	// CountConfidenceMin is the count_confidence at which occupant_count is
+	// used as evidence on its own
+	CountConfidenceMin int
+	// Dwell is how long a new state must be indicated before it is applied
+	Dwell   map[string]time.Duration
+	Sources map[string]SourceRule
+}
+
+// Input is the room_status data the rules look at
+type Input struct {
+	Occupied           bool
+	OccupiedConfidence int
+	OccupantCount      int
+	CountConfidence    int
+	ChangeSource       string
+}
+
+// Decision is the state indicated by one evaluation
+type Decision struct {
+	State       string
+	Probability int
+	Immediate   bool
+	Reason      string
+}
+
+func (r *Rules) source(name string) SourceRule {
+	if rule, ok := r.Sources[name]; ok {
+		return rule
+	}
+	return SourceRule{Weight: 1}
+}
+
+// Classify maps an input to the indicated state
+func (r *Rules) Classify(in Input) Decision {
+	src := r.source(in.ChangeSource)
+
+	// Probability that the room is occupied, pulled towards 50 for less
+	// trusted sources
+	p := in.OccupiedConfidence
+	if !in.Occupied {
+		p = 100 - p
+	}
+	p = 50 + int(float64(p-50)*src.Weight)
+	reason := fmt.Sprintf("occupied=%t confidence=%d", in.Occupied, in.OccupiedConfidence)
+
+	countConf := int(float64(in.CountConfidence) * src.Weight)
+	if r.CountConfidenceMin > 0 && countConf >= r.CountConfidenceMin {
+		if in.OccupantCount > 0 && countConf > p {
+			p = countConf
+			reason = fmt.Sprintf("count=%d confidence=%d", in.OccupantCount, in.CountConfidence)
+		} else if in.OccupantCount == 0 && 100-countConf < p {
+			p = 100 - countConf
+			reason = fmt.Sprintf("count=0 confidence=%d", in.CountConfidence)
+		}
+	}
+	reason += " source=" + in.ChangeSource
+
+	d := Decision{Probability: p, Immediate: src.Immediate, Reason: reason}
+	switch {
+	case p >= r.OccupiedAbove:
+		d.State = StateOccupied
+	case p <= r.VacantBelow:
+		d.State = StateVacant
+	default:
+		d.State = StateUncertain
+	}
+	return d
+}
+
+// DwellFor returns the dwell time of a state
+func (r *Rules) DwellFor(state string) time.Duration {
+	return r.Dwell[state]
+}
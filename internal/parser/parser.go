@@ -17,6 +17,9 @@ var (
 
 // TopicInfo contains information extracted from a topic
 type TopicInfo struct {
+	// Prefix is the first topic level, which names the tenant when several
+	// properties share the broker
+	Prefix     string
 	RoomName   string
 	DeviceName string
 }
@@ -24,15 +27,25 @@ type TopicInfo struct {
 // ParseTopic parses a topic in the format "homestay/{roomName}/{deviceName}/"
 // and extracts the room name and device name
 func ParseTopic(topic string) (*TopicInfo, error) {
+	info, err := SplitTopic(topic)
+	if err != nil || info.Prefix != "homestay" {
+		return nil, ErrInvalidTopic
+	}
+	return info, nil
+}
+
+// SplitTopic parses a topic in the format "{prefix}/{roomName}/{deviceName}/"
+// with any prefix
+func SplitTopic(topic string) (*TopicInfo, error) {
 	parts := strings.Split(topic, "/")
 	
-	// The expected format is "homestay/{roomName}/{deviceName}/"
-	// which splits into at least 3 parts
-	if len(parts) < 3 || parts[0] != "homestay" {
+	// The expected format splits into at least 3 parts
+	if len(parts) < 3 || parts[0] == "" {
 		return nil, ErrInvalidTopic
 	}
 	
 	return &TopicInfo{
+		Prefix:     parts[0],
 		RoomName:   parts[1],
 		DeviceName: parts[2],
 	}, nil
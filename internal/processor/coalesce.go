@@ -0,0 +1,280 @@
+package processor
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/NieRVoid/emqx-pg-bridge/internal/models"
+	"github.com/NieRVoid/emqx-pg-bridge/pkg/logger"
+)
+
+// User properties messages are coalesced by; the key must identify the row
+// the processor writes, so that only messages replacing each other coalesce
+const (
+	CoalesceKeyRoomID   = "roomId"
+	CoalesceKeyDeviceID = "deviceId"
+)
+
+// FailureFunc receives a coalesced message that failed permanently. Its
+// webhook was acknowledged when the message was kept, so nothing else
+// records the failure.
+type FailureFunc func(deviceType string, data *models.WebhookData, err error)
+
+// Coalescer writes at most one message per key and interval through the
+// processor it wraps. The first message of a quiet key is processed right
+// away; newer ones arriving within the interval replace each other and only
+// the last is processed once the interval is over, so the final state of a
+// key is always written.
+type Coalescer struct {
+	Processor
+	key      string
+	interval time.Duration
+	log      *logger.Logger
+	// onFailure is called for messages failing permanently; nil logs only
+	onFailure FailureFunc
+
+	mu      sync.Mutex
+	entries map[string]*coalesceEntry
+	// idle is signalled whenever a write of an entry finished
+	idle *sync.Cond
+	// flushed is set by Flush; later messages are processed directly
+	flushed bool
+}
+
+// coalesceEntry is the write state of one key
+type coalesceEntry struct {
+	last     time.Time
+	inflight bool
+	pending  *coalescedMessage
+}
+
+// coalescedMessage is the newest message of a key waiting to be processed
+type coalescedMessage struct {
+	ctx  context.Context
+	data *models.WebhookData
+}
+
+// NewCoalescer wraps p so that messages with the same value of the user
+// property named key are processed at most once per interval
+func NewCoalescer(p Processor, key string, interval time.Duration, log *logger.Logger) *Coalescer {
+	c := &Coalescer{
+		Processor: p,
+		key:       key,
+		interval:  interval,
+		log:       log.Component("processor.coalesce").With("type", p.Type()),
+		entries:   make(map[string]*coalesceEntry),
+	}
+	c.idle = sync.NewCond(&c.mu)
+	return c
+}
+
+// SetOnFailure hands messages failing permanently to fn, e.g. to dead-letter
+// them. It must be called before the coalescer is used.
+func (c *Coalescer) SetOnFailure(fn FailureFunc) {
+	c.onFailure = fn
+}
+
+// Unwrap returns the wrapped processor
+func (c *Coalescer) Unwrap() Processor {
+	return c.Processor
+}
+
+// Process processes data if its key was not written within the interval and
+// keeps it as the key's pending message otherwise
+func (c *Coalescer) Process(ctx context.Context, data *models.WebhookData) error {
+	key := c.keyOf(data)
+	if key == "" {
+		return c.Processor.Process(ctx, data)
+	}
+
+	now := time.Now()
+	c.mu.Lock()
+	e, ok := c.entries[key]
+	if !ok {
+		e = &coalesceEntry{}
+		c.entries[key] = e
+	}
+	if !c.flushed && (e.inflight || e.pending != nil || now.Sub(e.last) < c.interval) {
+		// The request is over before the message is processed
+		e.pending = &coalescedMessage{ctx: context.WithoutCancel(ctx), data: data}
+		c.mu.Unlock()
+		return nil
+	}
+	e.last = now
+	e.inflight = true
+	c.mu.Unlock()
+
+	err := c.Processor.Process(ctx, data)
+
+	c.mu.Lock()
+	e.inflight = false
+	c.idle.Broadcast()
+	c.mu.Unlock()
+	return err
+}
+
+// Run processes the pending messages whose interval is over, every interval
+// until ctx is cancelled
+func (c *Coalescer) Run(ctx context.Context) {
+	ticker := time.NewTicker(c.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			c.flush(ctx, now, false)
+		}
+	}
+}
+
+// Flush processes every pending message regardless of the interval, so the
+// final state of each key is written before shutdown. Writes still in flight,
+// e.g. of a Run tick cut short by shutdown, are waited for first, so that
+// what they put back is flushed too. It returns the number of messages still
+// pending, i.e. abandoned if ctx expired. Messages arriving afterwards, e.g.
+// from a spool replay, are no longer coalesced.
+func (c *Coalescer) Flush(ctx context.Context) int {
+	c.mu.Lock()
+	c.flushed = true
+	c.mu.Unlock()
+
+	c.waitIdle(ctx)
+	c.flush(ctx, time.Now(), true)
+	return c.Depth()
+}
+
+// waitIdle waits until no entry is being written or ctx is done
+func (c *Coalescer) waitIdle(ctx context.Context) {
+	stop := context.AfterFunc(ctx, func() {
+		c.mu.Lock()
+		c.idle.Broadcast()
+		c.mu.Unlock()
+	})
+	defer stop()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for ctx.Err() == nil && c.writing() {
+		c.idle.Wait()
+	}
+}
+
+// writing reports whether a write of some entry is in flight. c.mu must be
+// held.
+func (c *Coalescer) writing() bool {
+	for _, e := range c.entries {
+		if e.inflight {
+			return true
+		}
+	}
+	return false
+}
+
+// flush processes the pending messages due at now, or all of them if force
+// is set. A message failing with a transient error stays pending unless a
+// newer one replaced it meanwhile.
+func (c *Coalescer) flush(ctx context.Context, now time.Time, force bool) {
+	type due struct {
+		key   string
+		entry *coalesceEntry
+		msg   *coalescedMessage
+	}
+	var batch []due
+
+	c.mu.Lock()
+	if !force && c.flushed {
+		// Flush took over the pending messages
+		c.mu.Unlock()
+		return
+	}
+	for key, e := range c.entries {
+		if e.pending == nil || e.inflight || (!force && now.Sub(e.last) < c.interval) {
+			// Forget keys that went quiet
+			if e.pending == nil && !e.inflight && now.Sub(e.last) >= c.interval {
+				delete(c.entries, key)
+			}
+			continue
+		}
+		batch = append(batch, due{key: key, entry: e, msg: e.pending})
+		e.pending = nil
+		e.last = now
+		e.inflight = true
+	}
+	c.mu.Unlock()
+
+	for _, d := range batch {
+		var err error
+		if ctx.Err() != nil {
+			err = ctx.Err()
+		} else {
+			err = c.Processor.Process(mergeValues(ctx, d.msg.ctx), d.msg.data)
+		}
+
+		c.mu.Lock()
+		d.entry.inflight = false
+		if err != nil && d.entry.pending == nil && !IsPermanent(err) {
+			d.entry.pending = d.msg
+		}
+		c.idle.Broadcast()
+		c.mu.Unlock()
+
+		if err != nil && ctx.Err() == nil {
+			c.log.WithContext(d.msg.ctx).Error("Failed to process coalesced message",
+				"key", d.key, "clientId", d.msg.data.ClientID, "error", err)
+		}
+		if err != nil && IsPermanent(err) && c.onFailure != nil {
+			c.onFailure(c.Type(), d.msg.data, err)
+		}
+	}
+}
+
+// Name returns the queue name under which pending messages are reported
+func (c *Coalescer) Name() string {
+	return "coalesce-" + c.Type()
+}
+
+// Depth returns the number of keys with a pending message
+func (c *Coalescer) Depth() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	n := 0
+	for _, e := range c.entries {
+		if e.pending != nil {
+			n++
+		}
+	}
+	return n
+}
+
+// keyOf returns the coalescing key of a message; empty processes it directly
+func (c *Coalescer) keyOf(data *models.WebhookData) string {
+	return data.GetUserProperty(c.key)
+}
+
+// Unwrap returns the processor p wraps, or p itself
+func Unwrap(p Processor) Processor {
+	if w, ok := p.(interface{ Unwrap() Processor }); ok {
+		return w.Unwrap()
+	}
+	return p
+}
+
+// valuesContext takes its deadline and cancellation from one context and its
+// values from another
+type valuesContext struct {
+	context.Context
+	values context.Context
+}
+
+func (c valuesContext) Value(key any) any {
+	return c.values.Value(key)
+}
+
+// mergeValues returns ctx carrying the values, e.g. log labels, of values
+func mergeValues(ctx, values context.Context) context.Context {
+	return valuesContext{Context: ctx, values: values}
+}
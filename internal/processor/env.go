@@ -0,0 +1,320 @@
+package processor
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+
+	"github.com/NieRVoid/emqx-pg-bridge/internal/models"
+	"github.com/NieRVoid/emqx-pg-bridge/pkg/logger"
+)
+
+// Environment readings mapped to room_status columns
+const (
+	ReadingTemperature = "temperature"
+	ReadingHumidity    = "humidity"
+	ReadingAirQuality  = "airQuality"
+	ReadingLightLevel  = "lightLevel"
+	ReadingNoiseLevel  = "noiseLevel"
+)
+
+// envColumns maps payload readings to their room_status column
+var envColumns = map[string]string{
+	ReadingTemperature: "temperature",
+	ReadingHumidity:    "humidity",
+	ReadingAirQuality:  "air_quality",
+	ReadingLightLevel:  "light_level",
+	ReadingNoiseLevel:  "noise_level",
+}
+
+// stmtUpsertRoomEnv writes the readings of a room. Readings missing from the
+// payload keep their stored value, extra keys are merged into metadata.
+var stmtUpsertRoomEnv = Statement{Name: "room_status.upsert_env", SQL: `
+	INSERT INTO room_status (
+		room_id, temperature, humidity, air_quality, light_level, noise_level,
+		metadata, updated_at
+	)
+	VALUES ($1, $2, $3, $4, $5, $6, $7::jsonb, NOW())
+	ON CONFLICT (room_id)
+	DO UPDATE SET
+		temperature = COALESCE($2, room_status.temperature),
+		humidity = COALESCE($3, room_status.humidity),
+		air_quality = COALESCE($4, room_status.air_quality),
+		light_level = COALESCE($5, room_status.light_level),
+		noise_level = COALESCE($6, room_status.noise_level),
+		metadata = CASE
+			WHEN $7::jsonb IS NULL THEN room_status.metadata
+			ELSE COALESCE(room_status.metadata, '{}'::jsonb) || $7::jsonb
+		END,
+		updated_at = NOW()
+	RETURNING ` + roomStatusReturning}
+
+// Range bounds a reading after unit conversion
+type Range struct {
+	Min float64
+	Max float64
+}
+
+// DefaultEnvRanges are the accepted ranges in the stored units: °C, %RH,
+// AQI, lux and dB
+var DefaultEnvRanges = map[string]Range{
+	ReadingTemperature: {Min: -40, Max: 85},
+	ReadingHumidity:    {Min: 0, Max: 100},
+	ReadingAirQuality:  {Min: 0, Max: 500},
+	ReadingLightLevel:  {Min: 0, Max: 100000},
+	ReadingNoiseLevel:  {Min: 0, Max: 140},
+}
+
+// EnvProcessor handles environment sensors reporting into the room_status
+// temperature, humidity, air_quality, light_level and noise_level columns.
+// Readings are either plain numbers in the stored unit or {"value", "unit"}
+// objects. Any other payload keys are merged into room_status.metadata.
+type EnvProcessor struct {
+	db         *pgxpool.Pool
+	deviceType string
+	ranges     map[string]Range
+	smoother   *Smoother
+	log        *logger.Logger
+	listeners  []RoomStatusListener
+	notifier   *Notifier
+	retry      RetryPolicy
+	stmts      *StatementRegistry
+}
+
+// NewEnvProcessor creates a new environment sensor processor for deviceType.
+// ranges overrides DefaultEnvRanges per reading.
+func NewEnvProcessor(db *pgxpool.Pool, deviceType string, ranges map[string]Range, smoother *Smoother, log *logger.Logger) *EnvProcessor {
+	merged := make(map[string]Range, len(DefaultEnvRanges))
+	for k, v := range DefaultEnvRanges {
+		merged[k] = v
+	}
+	for k, v := range ranges {
+		merged[k] = v
+	}
+	return &EnvProcessor{
+		db:         db,
+		deviceType: deviceType,
+		ranges:     merged,
+		smoother:   smoother,
+		log:        log.Component("processor.env"),
+	}
+}
+
+// AddListener registers a listener for committed room_status writes. It must
+// be called before the processor starts handling webhooks.
+func (p *EnvProcessor) AddListener(l RoomStatusListener) {
+	p.listeners = append(p.listeners, l)
+}
+
+// SetNotifier enables NOTIFY publication of room_status changes
+func (p *EnvProcessor) SetNotifier(n *Notifier) {
+	p.notifier = n
+}
+
+// SetRetryPolicy enables retries of writes failing with transient errors
+func (p *EnvProcessor) SetRetryPolicy(rp RetryPolicy) {
+	p.retry = rp
+}
+
+// SetStatements registers the processor statements, which are executed
+// prepared once the registry is validated
+func (p *EnvProcessor) SetStatements(r *StatementRegistry) {
+	r.Register(stmtLockRoomStatus, stmtUpsertRoomEnv)
+	p.stmts = r
+}
+
+// Type returns the device type this processor handles
+func (p *EnvProcessor) Type() string {
+	return p.deviceType
+}
+
+// reading is a sensor value with an optional unit
+type reading struct {
+	Value float64 `json:"value"`
+	Unit  string  `json:"unit"`
+}
+
+func (r *reading) UnmarshalJSON(data []byte) error {
+	if err := json.Unmarshal(data, &r.Value); err == nil {
+		return nil
+	}
+	type plain reading
+	return json.Unmarshal(data, (*plain)(r))
+}
+
+// Process handles the environment sensor data
+func (p *EnvProcessor) Process(ctx context.Context, data *models.WebhookData) error {
+	log := p.log.WithContext(ctx)
+
+	roomIDStr := data.GetUserProperty("roomId")
+	if roomIDStr == "" {
+		return ErrMissingRoomID
+	}
+	roomID, err := strconv.Atoi(roomIDStr)
+	if err != nil {
+		log.Error("Invalid roomId format", "roomId", roomIDStr, "error", err)
+		return err
+	}
+
+	var payload map[string]json.RawMessage
+	if err := json.Unmarshal([]byte(data.Payload), &payload); err != nil {
+		log.Sampled("payload.error").Error("Failed to parse payload", "payload", data.Payload, "error", err)
+		return ErrInvalidPayload
+	}
+
+	values := make(map[string]*int, len(envColumns))
+	extra := make(map[string]json.RawMessage)
+	for key, raw := range payload {
+		if _, ok := envColumns[key]; !ok {
+			extra[key] = raw
+			continue
+		}
+
+		var r reading
+		if err := json.Unmarshal(raw, &r); err != nil {
+			log.Sampled("payload.error").Warn("Ignoring malformed reading", "roomId", roomID, "reading", key, "error", err)
+			continue
+		}
+		value, err := convertUnit(key, r.Value, r.Unit)
+		if err != nil {
+			log.Sampled("payload.error").Warn("Ignoring reading", "roomId", roomID, "reading", key, "error", err)
+			continue
+		}
+		if rng := p.ranges[key]; value < rng.Min || value > rng.Max {
+			log.Sampled("env.range").Warn("Reading out of range",
+				"roomId", roomID, "reading", key, "value", value, "min", rng.Min, "max", rng.Max)
+			continue
+		}
+
+		if p.smoother != nil {
+			value = p.smoother.Add(roomIDStr+"/"+key, value)
+		}
+		v := int(math.Round(value))
+		values[key] = &v
+	}
+
+	if len(values) == 0 && len(extra) == 0 {
+		log.Debug("No usable readings in environment payload", "roomId", roomID)
+		return nil
+	}
+
+	var metadata []byte
+	if len(extra) > 0 {
+		if metadata, err = json.Marshal(extra); err != nil {
+			return err
+		}
+	}
+
+	var change *models.RoomStatusChange
+	err = p.retry.Do(ctx, p.log, "room_status", func() (err error) {
+		change, err = p.write(ctx, roomID, values, metadata)
+		return err
+	})
+	if err != nil {
+		log.Error("Failed to update room environment", "roomId", roomID, "error", err)
+		return err
+	}
+	status := change.New
+
+	for _, l := range p.listeners {
+		l.RoomStatusChanged(ctx, change)
+	}
+
+	log.Sampled("room.env").Info("Updated room environment",
+		"roomId", roomID,
+		"temperature", status.Temperature,
+		"humidity", status.Humidity,
+		"airQuality", status.AirQuality,
+		"lightLevel", status.LightLevel,
+		"noiseLevel", status.NoiseLevel,
+		"extraReadings", len(extra))
+
+	return nil
+}
+
+// write upserts the readings and metadata of a room in one transaction
+func (p *EnvProcessor) write(ctx context.Context, roomID int, values map[string]*int, metadata []byte) (*models.RoomStatusChange, error) {
+	tx, err := p.db.Begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback(ctx)
+
+	old, err := scanRoomStatus(tx.QueryRow(ctx, p.stmts.Text(stmtLockRoomStatus), roomID))
+	if errors.Is(err, pgx.ErrNoRows) {
+		old = nil
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to read room_status: %w", err)
+	}
+
+	status, err := scanRoomStatus(tx.QueryRow(ctx, p.stmts.Text(stmtUpsertRoomEnv),
+		roomID, values[ReadingTemperature], values[ReadingHumidity], values[ReadingAirQuality],
+		values[ReadingLightLevel], values[ReadingNoiseLevel], metadata))
+	if err != nil {
+		return nil, err
+	}
+
+	change := &models.RoomStatusChange{Old: old, New: status}
+
+	if p.notifier != nil {
+		if err := p.notifier.NotifyRoom(ctx, tx, change); err != nil {
+			return nil, fmt.Errorf("failed to publish notification: %w", err)
+		}
+	}
+
+	if err := commit(ctx, tx); err != nil {
+		return nil, err
+	}
+	return change, nil
+}
+
+// convertUnit converts a reading to the unit stored in room_status. An
+// empty unit means the value is already in the stored unit.
+func convertUnit(key string, value float64, unit string) (float64, error) {
+	if math.IsNaN(value) || math.IsInf(value, 0) {
+		return 0, fmt.Errorf("invalid value")
+	}
+
+	unit = strings.ToLower(strings.TrimSpace(unit))
+	switch key {
+	case ReadingTemperature:
+		switch unit {
+		case "", "c", "°c", "celsius":
+			return value, nil
+		case "f", "°f", "fahrenheit":
+			return (value - 32) * 5 / 9, nil
+		case "k", "kelvin":
+			return value - 273.15, nil
+		}
+	case ReadingHumidity:
+		switch unit {
+		case "", "%", "%rh", "percent":
+			return value, nil
+		case "ratio", "fraction":
+			return value * 100, nil
+		}
+	case ReadingLightLevel:
+		switch unit {
+		case "", "lx", "lux":
+			return value, nil
+		case "fc", "footcandle", "footcandles":
+			return value * 10.764, nil
+		}
+	case ReadingAirQuality:
+		if unit == "" || unit == "aqi" {
+			return value, nil
+		}
+	case ReadingNoiseLevel:
+		if unit == "" || unit == "db" || unit == "dba" {
+			return value, nil
+		}
+	}
+	return 0, fmt.Errorf("unsupported unit %q", unit)
+}
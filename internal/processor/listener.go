@@ -0,0 +1,70 @@
+package processor
+
+import (
+	"context"
+
+	"github.com/jackc/pgx/v5"
+
+	"github.com/NieRVoid/emqx-pg-bridge/internal/models"
+)
+
+// RoomStatusListener is notified after a room_status write has been committed
+type RoomStatusListener interface {
+	RoomStatusChanged(ctx context.Context, change *models.RoomStatusChange)
+}
+
+// DeviceStatusListener is notified after a device_status write has been committed
+type DeviceStatusListener interface {
+	DeviceStatusChanged(ctx context.Context, change *models.DeviceStatusChange)
+}
+
+// RoomStatusSource is implemented by processors writing room_status
+type RoomStatusSource interface {
+	AddListener(l RoomStatusListener)
+}
+
+// DeviceStatusSource is implemented by processors writing device_status
+type DeviceStatusSource interface {
+	AddListener(l DeviceStatusListener)
+}
+
+// RoomHistoryRecorder records room_status writes in the writing transaction,
+// so history and current state commit or roll back together
+type RoomHistoryRecorder interface {
+	RecordRoomStatus(ctx context.Context, tx pgx.Tx, status *models.RoomStatus) error
+}
+
+// roomStatusReturning lists the room_status columns scanned by scanRoomStatus.
+// A count_source left NULL by an older schema reads as unknown.
+const roomStatusReturning = `
+	room_id, occupied, occupant_count, count_confidence, occupied_confidence,
+	COALESCE(count_source, 'unknown') AS count_source, last_source_change, temperature, humidity, air_quality,
+	light_level, noise_level, metadata, updated_at`
+
+// scanRoomStatus scans a row selected with roomStatusReturning
+func scanRoomStatus(row pgx.Row) (*models.RoomStatus, error) {
+	var rs models.RoomStatus
+	err := row.Scan(&rs.RoomID, &rs.Occupied, &rs.OccupantCount, &rs.CountConfidence,
+		&rs.OccupiedConfidence, &rs.CountSource, &rs.LastSourceChange, &rs.Temperature,
+		&rs.Humidity, &rs.AirQuality, &rs.LightLevel, &rs.NoiseLevel, &rs.Metadata,
+		&rs.UpdatedAt)
+	if err != nil {
+		return nil, err
+	}
+	return &rs, nil
+}
+
+// deviceStatusReturning lists the device_status columns scanned by
+// scanDeviceStatus. last_reported_at is read with the session time zone it
+// was written in, so that it compares with the local clock.
+const deviceStatusReturning = `device_id, status, updated_at,
+	last_reported_at::timestamptz AS last_reported_at`
+
+// scanDeviceStatus scans a row selected with deviceStatusReturning
+func scanDeviceStatus(row pgx.Row) (*models.DeviceStatus, error) {
+	var ds models.DeviceStatus
+	if err := row.Scan(&ds.DeviceID, &ds.Status, &ds.UpdatedAt, &ds.LastReportedAt); err != nil {
+		return nil, err
+	}
+	return &ds, nil
+}
@@ -3,34 +3,54 @@ package processor
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"strconv"
 	
-	"github.com/jackc/pgx/v5/pgxpool"
 	"github.com/NieRVoid/emqx-pg-bridge/internal/models"
 	"github.com/NieRVoid/emqx-pg-bridge/pkg/logger"
 )
 
+// NormalType is the device type of normal devices
+const NormalType = "normal"
+
 // NormalProcessor handles processing for normal device types
 type NormalProcessor struct {
-	db  *pgxpool.Pool
-	log *logger.Logger
+	store     StatusStore
+	log       *logger.Logger
+	listeners []DeviceStatusListener
+	mode      UpdateMode
 }
 
 // NewNormalProcessor creates a new normal device processor
-func NewNormalProcessor(db *pgxpool.Pool, log *logger.Logger) *NormalProcessor {
+func NewNormalProcessor(store StatusStore, log *logger.Logger) *NormalProcessor {
 	return &NormalProcessor{
-		db:  db,
-		log: log,
+		store: store,
+		log:   log.Component("processor.normal"),
+		mode:  UpdateMode{Mode: UpdateReplace, ArrayStrategy: ArrayReplace},
 	}
 }
 
+// SetUpdateMode selects how reported payloads are applied to the stored
+// status. The default replaces it wholesale.
+func (p *NormalProcessor) SetUpdateMode(mode UpdateMode) {
+	p.mode = mode
+}
+
+// AddListener registers a listener for committed device_status writes. It
+// must be called before the processor starts handling webhooks.
+func (p *NormalProcessor) AddListener(l DeviceStatusListener) {
+	p.listeners = append(p.listeners, l)
+}
+
 // Type returns the device type this processor handles
 func (p *NormalProcessor) Type() string {
-	return "normal"
+	return NormalType
 }
 
 // Process handles the normal device data
 func (p *NormalProcessor) Process(ctx context.Context, data *models.WebhookData) error {
+	log := p.log.WithContext(ctx)
+
 	// Extract deviceId from user properties
 	deviceIDStr := data.GetUserProperty("deviceId")
 	if deviceIDStr == "" {
@@ -40,39 +60,44 @@ func (p *NormalProcessor) Process(ctx context.Context, data *models.WebhookData)
 	// Convert deviceId to integer
 	deviceID, err := strconv.Atoi(deviceIDStr)
 	if err != nil {
-		p.log.Error("Invalid deviceId format", "deviceId", deviceIDStr, "error", err)
+		log.Error("Invalid deviceId format", "deviceId", deviceIDStr, "error", err)
 		return err
 	}
 	
-	p.log.Debug("Processing normal device data", "deviceId", deviceID)
+	log.Debug("Processing normal device data", "deviceId", deviceID)
 	
 	// For normal devices, we store the entire payload as JSON
 	// Create a valid JSON object from the payload string
 	var payloadJSON json.RawMessage
 	if err := json.Unmarshal([]byte(data.Payload), &payloadJSON); err != nil {
-		p.log.Error("Invalid JSON payload", "payload", data.Payload, "error", err)
+		log.Sampled("payload.error").Error("Invalid JSON payload", "payload", data.Payload, "error", err)
 		return ErrInvalidPayload
 	}
 	
-	// Update device_status table using UPSERT
-	_, err = p.db.Exec(ctx, `
-		INSERT INTO device_status (
-			device_id, status, updated_at, last_reported_at
-		)
-		VALUES ($1, $2, NOW(), NOW())
-		ON CONFLICT (device_id) 
-		DO UPDATE SET
-			status = $2,
-			updated_at = NOW(),
-			last_reported_at = NOW()
-	`, deviceID, payloadJSON)
-	
+	change, err := p.store.UpsertDeviceStatus(ctx, &DeviceStatusUpdate{
+		DeviceID: deviceID,
+		Status:   payloadJSON,
+		Mode:     p.mode,
+	})
+	if errors.Is(err, ErrInvalidPayload) {
+		log.Sampled("payload.error").Error("Payload cannot be applied to device status",
+			"mode", p.mode.Mode, "payload", data.Payload, "error", err)
+		return ErrInvalidPayload
+	}
+	if errors.Is(err, ErrStale) {
+		log.Info("Skipped device status older than the stored one", "deviceId", deviceID)
+		return nil
+	}
 	if err != nil {
-		p.log.Error("Failed to update device_status", "error", err)
+		log.Error("Failed to update device_status", "error", err)
 		return err
 	}
 	
-	p.log.Info("Updated device status", "deviceId", deviceID)
+	for _, l := range p.listeners {
+		l.DeviceStatusChanged(ctx, change)
+	}
+	
+	log.Sampled("device.update").Info("Updated device status", "deviceId", deviceID)
 	
 	return nil
 }
\ No newline at end of file
@@ -0,0 +1,212 @@
+package processor
+
+import (
+	"context"
+	"encoding/json"
+	"reflect"
+	"sort"
+
+	"github.com/jackc/pgx/v5"
+
+	"github.com/NieRVoid/emqx-pg-bridge/internal/models"
+)
+
+// maxNotifyPayload stays below PostgreSQL's 8000 byte NOTIFY payload limit
+const maxNotifyPayload = 7900
+
+// stmtNotify publishes a notification on a channel
+var stmtNotify = Statement{Name: "notify", SQL: `SELECT pg_notify($1, $2)`}
+
+// Notifier publishes compact diffs of state changes with pg_notify inside the
+// writing transaction, so listeners only ever see committed changes and see
+// each of them exactly once
+type Notifier struct {
+	roomChannel   string
+	deviceChannel string
+	stmts         *StatementRegistry
+}
+
+// NewNotifier creates a notifier. An empty channel disables notifications for
+// that table.
+func NewNotifier(roomChannel, deviceChannel string) *Notifier {
+	return &Notifier{
+		roomChannel:   roomChannel,
+		deviceChannel: deviceChannel,
+	}
+}
+
+// SetStatements registers the notify statement, which is executed prepared
+// once the registry is validated
+func (n *Notifier) SetStatements(r *StatementRegistry) {
+	r.Register(stmtNotify)
+	n.stmts = r
+}
+
+// ValueChange holds the previous and new value of a column or status key
+type ValueChange struct {
+	Old interface{} `json:"old"`
+	New interface{} `json:"new"`
+}
+
+// Notification is the JSON payload sent on the notify channels
+type Notification struct {
+	Table    string                 `json:"table"`
+	Op       string                 `json:"op"`
+	RoomID   int                    `json:"roomId,omitempty"`
+	DeviceID int                    `json:"deviceId,omitempty"`
+	Changes  map[string]ValueChange `json:"changes,omitempty"`
+	Removed  []string               `json:"removed,omitempty"`
+	// ChangedKeys replaces Changes when the values do not fit into a
+	// NOTIFY payload; listeners then have to read the row themselves
+	ChangedKeys []string `json:"changedKeys,omitempty"`
+	Truncated   bool     `json:"truncated,omitempty"`
+}
+
+// NotifyRoom sends the room_status column diff, if any column changed
+func (n *Notifier) NotifyRoom(ctx context.Context, tx pgx.Tx, change *models.RoomStatusChange) error {
+	if n.roomChannel == "" {
+		return nil
+	}
+
+	note := Notification{
+		Table:   "room_status",
+		Op:      op(change.Old == nil),
+		RoomID:  change.New.RoomID,
+		Changes: roomDiff(change.Old, change.New),
+	}
+	if len(note.Changes) == 0 {
+		return nil
+	}
+	return n.send(ctx, tx, n.roomChannel, &note)
+}
+
+// NotifyDevice sends the changed keys of device_status.status, if any
+func (n *Notifier) NotifyDevice(ctx context.Context, tx pgx.Tx, change *models.DeviceStatusChange) error {
+	if n.deviceChannel == "" {
+		return nil
+	}
+
+	var oldStatus json.RawMessage
+	if change.Old != nil {
+		oldStatus = change.Old.Status
+	}
+
+	note := Notification{
+		Table:    "device_status",
+		Op:       op(change.Old == nil),
+		DeviceID: change.New.DeviceID,
+	}
+	note.Changes, note.Removed = jsonKeyDiff(oldStatus, change.New.Status)
+	if len(note.Changes) == 0 && len(note.Removed) == 0 {
+		return nil
+	}
+	return n.send(ctx, tx, n.deviceChannel, &note)
+}
+
+func (n *Notifier) send(ctx context.Context, tx pgx.Tx, channel string, note *Notification) error {
+	payload, err := json.Marshal(note)
+	if err != nil {
+		return err
+	}
+
+	if len(payload) > maxNotifyPayload {
+		for key := range note.Changes {
+			note.ChangedKeys = append(note.ChangedKeys, key)
+		}
+		sort.Strings(note.ChangedKeys)
+		note.Changes = nil
+		note.Truncated = true
+		if payload, err = json.Marshal(note); err != nil {
+			return err
+		}
+		if len(payload) > maxNotifyPayload {
+			note.ChangedKeys, note.Removed = nil, nil
+			if payload, err = json.Marshal(note); err != nil {
+				return err
+			}
+		}
+	}
+
+	_, err = tx.Exec(ctx, n.stmts.Text(stmtNotify), channel, string(payload))
+	return err
+}
+
+func op(inserted bool) string {
+	if inserted {
+		return "insert"
+	}
+	return "update"
+}
+
+// roomDiff compares the room_status columns written by the processors;
+// updated_at is left out since it changes on every write
+func roomDiff(old, cur *models.RoomStatus) map[string]ValueChange {
+	if old == nil {
+		old = &models.RoomStatus{}
+	}
+
+	changes := make(map[string]ValueChange)
+	add := func(column string, o, c interface{}) {
+		if !reflect.DeepEqual(o, c) {
+			changes[column] = ValueChange{Old: o, New: c}
+		}
+	}
+
+	add("occupied", old.Occupied, cur.Occupied)
+	add("occupant_count", old.OccupantCount, cur.OccupantCount)
+	add("count_confidence", old.CountConfidence, cur.CountConfidence)
+	add("occupied_confidence", old.OccupiedConfidence, cur.OccupiedConfidence)
+	add("count_source", old.CountSource, cur.CountSource)
+	add("last_source_change", old.LastSourceChange, cur.LastSourceChange)
+	add("temperature", old.Temperature, cur.Temperature)
+	add("humidity", old.Humidity, cur.Humidity)
+	add("air_quality", old.AirQuality, cur.AirQuality)
+	add("light_level", old.LightLevel, cur.LightLevel)
+	add("noise_level", old.NoiseLevel, cur.NoiseLevel)
+	add("metadata", decodeJSON(old.Metadata), decodeJSON(cur.Metadata))
+
+	return changes
+}
+
+// jsonKeyDiff compares two JSON objects key by key. Documents that are not
+// objects are reported as a single change of the "" key.
+func jsonKeyDiff(old, cur json.RawMessage) (map[string]ValueChange, []string) {
+	oldDoc, curDoc := decodeJSON(old), decodeJSON(cur)
+	oldObj, oldIsObj := oldDoc.(map[string]interface{})
+	curObj, curIsObj := curDoc.(map[string]interface{})
+
+	changes := make(map[string]ValueChange)
+	if (!oldIsObj && oldDoc != nil) || !curIsObj {
+		if !reflect.DeepEqual(oldDoc, curDoc) {
+			changes[""] = ValueChange{Old: oldDoc, New: curDoc}
+		}
+		return changes, nil
+	}
+
+	for key, value := range curObj {
+		if prev, ok := oldObj[key]; !ok || !reflect.DeepEqual(prev, value) {
+			changes[key] = ValueChange{Old: prev, New: value}
+		}
+	}
+
+	var removed []string
+	for key := range oldObj {
+		if _, ok := curObj[key]; !ok {
+			removed = append(removed, key)
+		}
+	}
+	sort.Strings(removed)
+
+	return changes, removed
+}
+
+func decodeJSON(raw json.RawMessage) interface{} {
+	if len(raw) == 0 {
+		return nil
+	}
+	var v interface{}
+	if err := json.Unmarshal(raw, &v); err != nil {
+		return nil
+	}
+	return v
+}
@@ -0,0 +1,313 @@
+package processor
+
+import (
+	"context"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+
+	"github.com/NieRVoid/emqx-pg-bridge/internal/models"
+	"github.com/NieRVoid/emqx-pg-bridge/pkg/logger"
+)
+
+// PresenceType is the registry key of the presence processor. The webhook
+// handler routes client and session events to it regardless of deviceType.
+const PresenceType = "presence"
+
+// Client id matching modes for mapping MQTT clients to devices
+const (
+	ClientIDMatchNone = ""
+	ClientIDMatchUUID = "uuid"
+	ClientIDMatchName = "name"
+)
+
+// PresenceProcessor maintains device_presence from EMQX client.connected,
+// client.disconnected and session.* events
+type PresenceProcessor struct {
+	db            *pgxpool.Pool
+	clientIDMatch string
+	log           *logger.Logger
+	retry         RetryPolicy
+	statements    presenceStatements
+	stmts         *StatementRegistry
+}
+
+// presenceStatements are the statements of the presence processor, which
+// depend on the client id matching mode
+type presenceStatements struct {
+	connect    Statement
+	disconnect Statement
+	session    Statement
+	touch      Statement
+	stale      Statement
+}
+
+// NewPresenceProcessor creates a new presence processor. Clients are mapped
+// to devices by the deviceId user property of their messages and, depending
+// on clientIDMatch, by a client id equal to the device uuid or name.
+func NewPresenceProcessor(db *pgxpool.Pool, clientIDMatch string, log *logger.Logger) *PresenceProcessor {
+	p := &PresenceProcessor{
+		db:            db,
+		clientIDMatch: clientIDMatch,
+		log:           log.Component("processor.presence"),
+	}
+	p.statements = p.newStatements()
+	return p
+}
+
+func (p *PresenceProcessor) newStatements() presenceStatements {
+	return presenceStatements{
+		connect: Statement{Name: "device_presence.connect", SQL: `
+			INSERT INTO device_presence
+				(client_id, device_id, online, stale, last_connected_at, peer_host, username, node, updated_at)
+			VALUES ($1, ` + p.deviceLookup("$1") + `, true, false, $2, $3, $4, $5, NOW())
+			ON CONFLICT (client_id) DO UPDATE
+			SET device_id = COALESCE(device_presence.device_id, EXCLUDED.device_id),
+				-- A disconnect delivered after this connect must keep the client offline
+				online = device_presence.last_disconnected_at IS NULL
+					OR device_presence.last_disconnected_at <= EXCLUDED.last_connected_at,
+				stale = false,
+				last_connected_at = GREATEST(device_presence.last_connected_at, EXCLUDED.last_connected_at),
+				peer_host = COALESCE(EXCLUDED.peer_host, device_presence.peer_host),
+				username = EXCLUDED.username,
+				node = EXCLUDED.node,
+				updated_at = NOW()`},
+
+		disconnect: Statement{Name: "device_presence.disconnect", SQL: `
+			INSERT INTO device_presence
+				(client_id, device_id, online, last_disconnected_at, disconnect_reason, peer_host, username, node, updated_at)
+			VALUES ($1, ` + p.deviceLookup("$1") + `, false, $2, $3, $4, $5, $6, NOW())
+			ON CONFLICT (client_id) DO UPDATE
+			SET device_id = COALESCE(device_presence.device_id, EXCLUDED.device_id),
+				-- Ignore a disconnect that is older than the latest connect
+				online = COALESCE(device_presence.online
+					AND device_presence.last_connected_at > EXCLUDED.last_disconnected_at, false),
+				last_disconnected_at = GREATEST(device_presence.last_disconnected_at, EXCLUDED.last_disconnected_at),
+				disconnect_reason = EXCLUDED.disconnect_reason,
+				peer_host = COALESCE(EXCLUDED.peer_host, device_presence.peer_host),
+				username = EXCLUDED.username,
+				node = EXCLUDED.node,
+				updated_at = NOW()`},
+
+		// Session activity proves the client is alive without changing its
+		// connection state
+		session: Statement{Name: "device_presence.session", SQL: `
+			UPDATE device_presence SET stale = false, updated_at = NOW()
+			WHERE client_id = $1`},
+
+		touch: Statement{Name: "device_presence.touch", SQL: `
+			INSERT INTO device_presence (client_id, device_id, online, last_message_at, peer_host, updated_at)
+			VALUES ($1, COALESCE($2, ` + p.deviceLookup("$1") + `), true, $3, $4, NOW())
+			ON CONFLICT (client_id) DO UPDATE
+			SET device_id = COALESCE($2, device_presence.device_id),
+				-- A client that publishes is connected, even if its connect event was lost
+				online = device_presence.online
+					OR device_presence.last_disconnected_at IS NULL
+					OR device_presence.last_disconnected_at < EXCLUDED.last_message_at,
+				stale = false,
+				last_message_at = GREATEST(device_presence.last_message_at, EXCLUDED.last_message_at),
+				updated_at = NOW()`},
+
+		stale: Statement{Name: "device_presence.mark_stale", SQL: `
+			UPDATE device_presence SET stale = true, updated_at = NOW()
+			WHERE online AND NOT stale
+				AND updated_at < NOW() - $1::float8 * interval '1 second'
+			RETURNING client_id, device_id`},
+	}
+}
+
+// SetRetryPolicy enables retries of event writes failing with transient errors
+func (p *PresenceProcessor) SetRetryPolicy(rp RetryPolicy) {
+	p.retry = rp
+}
+
+// SetStatements registers the processor statements, which are executed
+// prepared once the registry is validated
+func (p *PresenceProcessor) SetStatements(r *StatementRegistry) {
+	r.Register(p.statements.connect, p.statements.disconnect, p.statements.session,
+		p.statements.touch, p.statements.stale)
+	p.stmts = r
+}
+
+// Type returns the registry key of this processor
+func (p *PresenceProcessor) Type() string {
+	return PresenceType
+}
+
+// Process handles a client or session event
+func (p *PresenceProcessor) Process(ctx context.Context, data *models.WebhookData) error {
+	log := p.log.WithContext(ctx)
+
+	if data.ClientID == "" {
+		return ErrInvalidPayload
+	}
+
+	switch data.Event {
+	case "client.connected":
+		at := eventTime(data.ConnectedAt, data.Timestamp)
+		err := p.exec(ctx, p.statements.connect,
+			data.ClientID, at, peerHost(data), data.Username, data.Node)
+		if err != nil {
+			return err
+		}
+		log.Sampled("presence.update").Info("Client connected",
+			"clientId", data.ClientID, "peerHost", peerHost(data))
+
+	case "client.disconnected":
+		at := eventTime(data.DisconnectedAt, data.Timestamp)
+		err := p.exec(ctx, p.statements.disconnect,
+			data.ClientID, at, data.Reason, peerHost(data), data.Username, data.Node)
+		if err != nil {
+			return err
+		}
+		log.Sampled("presence.update").Info("Client disconnected",
+			"clientId", data.ClientID, "reason", data.Reason)
+
+	default:
+		if !strings.HasPrefix(data.Event, "session.") {
+			log.Debug("Ignoring client event", "event", data.Event, "clientId", data.ClientID)
+			return nil
+		}
+		if err := p.exec(ctx, p.statements.session, data.ClientID); err != nil {
+			return err
+		}
+		log.Debug("Session event", "event", data.Event, "clientId", data.ClientID, "topic", data.Topic)
+	}
+
+	return nil
+}
+
+// exec runs a single statement of an event according to the retry policy
+func (p *PresenceProcessor) exec(ctx context.Context, stmt Statement, args ...interface{}) error {
+	return p.retry.Do(ctx, p.log, stmt.Name, func() error {
+		_, err := p.db.Exec(ctx, p.stmts.Text(stmt), args...)
+		return err
+	})
+}
+
+// Touch records that a client published a message and learns its device from
+// the deviceId user property. Errors are logged only, presence must never
+// fail the message itself.
+func (p *PresenceProcessor) Touch(ctx context.Context, data *models.WebhookData) {
+	if data.ClientID == "" {
+		return
+	}
+
+	var deviceID *int
+	if id, err := strconv.Atoi(data.GetUserProperty("deviceId")); err == nil {
+		deviceID = &id
+	}
+
+	_, err := p.db.Exec(ctx, p.stmts.Text(p.statements.touch),
+		data.ClientID, deviceID, eventTime(data.PublishReceivedAt, data.Timestamp), peerHost(data))
+	if err != nil {
+		p.log.WithContext(ctx).Warn("Failed to record client activity", "clientId", data.ClientID, "error", err)
+	}
+}
+
+// Run marks online clients stale when no message, connect or session event
+// arrived within window, checking every interval until ctx is cancelled
+func (p *PresenceProcessor) Run(ctx context.Context, window, interval time.Duration) {
+	if p.clientIDMatch == ClientIDMatchName {
+		p.warnAmbiguousNames(ctx)
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			rows, err := p.db.Query(ctx, p.stmts.Text(p.statements.stale), window.Seconds())
+			if err != nil {
+				if ctx.Err() == nil {
+					p.log.Error("Failed to mark stale clients", "error", err)
+				}
+				continue
+			}
+			for rows.Next() {
+				var clientID string
+				var deviceID *int
+				if err := rows.Scan(&clientID, &deviceID); err != nil {
+					p.log.Error("Failed to read stale client", "error", err)
+					break
+				}
+				p.log.Warn("Client silent beyond heartbeat window", "clientId", clientID, "deviceId", deviceID, "window", window)
+			}
+			rows.Close()
+		}
+	}
+}
+
+// deviceLookup returns a subquery resolving the device of the client id in
+// param according to the configured matching mode. Device names are not
+// unique; a name shared by several devices resolves to the oldest one, see
+// warnAmbiguousNames.
+func (p *PresenceProcessor) deviceLookup(param string) string {
+	switch p.clientIDMatch {
+	case ClientIDMatchUUID:
+		return `(SELECT id FROM devices WHERE uuid::text = ` + param + `)`
+	case ClientIDMatchName:
+		return `(SELECT id FROM devices WHERE name = ` + param + ` ORDER BY id LIMIT 1)`
+	default:
+		return `NULL::integer`
+	}
+}
+
+// warnAmbiguousNames logs the device names shared by several devices, whose
+// clients are attributed to the device with the lowest id only
+func (p *PresenceProcessor) warnAmbiguousNames(ctx context.Context) {
+	rows, err := p.db.Query(ctx, `
+		SELECT name, array_agg(id ORDER BY id)
+		FROM devices
+		GROUP BY name
+		HAVING count(*) > 1`)
+	if err != nil {
+		p.log.Error("Failed to check device names", "error", err)
+		return
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var name string
+		var ids []int32
+		if err := rows.Scan(&name, &ids); err != nil {
+			p.log.Error("Failed to read device names", "error", err)
+			return
+		}
+		p.log.Warn("Device name shared by several devices, clients match the first",
+			"name", name, "deviceIds", ids)
+	}
+}
+
+// eventTime converts an EMQX millisecond timestamp, falling back to the
+// webhook timestamp and then to the current time
+func eventTime(ms, fallback int64) time.Time {
+	if ms == 0 {
+		ms = fallback
+	}
+	if ms == 0 {
+		return time.Now()
+	}
+	return time.UnixMilli(ms)
+}
+
+// peerHost returns the client address without port
+func peerHost(data *models.WebhookData) *string {
+	host := data.PeerHost
+	if host == "" && data.PeerName != "" {
+		host = data.PeerName
+		if h, _, err := net.SplitHostPort(data.PeerName); err == nil {
+			host = h
+		}
+	}
+	if host == "" {
+		return nil
+	}
+	return &host
+}
@@ -3,16 +3,20 @@ package processor
 import (
 	"context"
 	"errors"
-	
+	"sort"
+	"sync"
+
 	"github.com/NieRVoid/emqx-pg-bridge/internal/models"
 	"github.com/NieRVoid/emqx-pg-bridge/pkg/logger"
 )
 
 // Common errors
 var (
-	ErrMissingDeviceID = errors.New("missing deviceId in user properties")
-	ErrMissingRoomID   = errors.New("missing roomId in user properties")
-	ErrInvalidPayload  = errors.New("invalid payload format")
+	ErrMissingDeviceID   = errors.New("missing deviceId in user properties")
+	ErrMissingRoomID     = errors.New("missing roomId in user properties")
+	ErrInvalidPayload    = errors.New("invalid payload format")
+	ErrUnknownProcessor  = errors.New("unknown processor type")
+	ErrProcessorDisabled = errors.New("processor is disabled")
 )
 
 // Processor defines the interface for all device type processors
@@ -21,9 +25,19 @@ type Processor interface {
 	Type() string
 }
 
+// Status describes a registered processor
+type Status struct {
+	// Tenant is set when several tenants have processors of their own
+	Tenant  string `json:"tenant,omitempty"`
+	Type    string `json:"type"`
+	Enabled bool   `json:"enabled"`
+}
+
 // ProcessorRegistry maintains a mapping of device types to their processors
 type ProcessorRegistry struct {
+	mu         sync.RWMutex
 	processors map[string]Processor
+	disabled   map[string]bool
 	log        *logger.Logger
 }
 
@@ -31,23 +45,86 @@ type ProcessorRegistry struct {
 func NewProcessorRegistry(log *logger.Logger) *ProcessorRegistry {
 	return &ProcessorRegistry{
 		processors: make(map[string]Processor),
-		log:        log,
+		disabled:   make(map[string]bool),
+		log:        log.Component("registry"),
 	}
 }
 
 // Register adds a processor to the registry
 func (r *ProcessorRegistry) Register(p Processor) {
+	r.mu.Lock()
 	r.processors[p.Type()] = p
+	r.mu.Unlock()
 	r.log.Info("Registered processor", "type", p.Type())
 }
 
-// Get returns the processor for the given device type
+// Get returns the processor for the given device type. Disabled processors
+// are not returned.
 func (r *ProcessorRegistry) Get(deviceType string) (Processor, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
 	p, ok := r.processors[deviceType]
-	return p, ok
+	if !ok || r.disabled[deviceType] {
+		return nil, false
+	}
+	return p, true
 }
 
 // GetProcessors returns all registered processors
 func (r *ProcessorRegistry) GetProcessors() map[string]Processor {
-	return r.processors
-}
\ No newline at end of file
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	processors := make(map[string]Processor, len(r.processors))
+	for t, p := range r.processors {
+		processors[t] = p
+	}
+	return processors
+}
+
+// Statuses returns every registered processor with its enabled flag, sorted by type
+func (r *ProcessorRegistry) Statuses() []Status {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	statuses := make([]Status, 0, len(r.processors))
+	for t := range r.processors {
+		statuses = append(statuses, Status{Type: t, Enabled: !r.disabled[t]})
+	}
+	sort.Slice(statuses, func(i, j int) bool { return statuses[i].Type < statuses[j].Type })
+	return statuses
+}
+
+// IsDisabled reports whether a registered processor has been disabled
+func (r *ProcessorRegistry) IsDisabled(deviceType string) bool {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	_, ok := r.processors[deviceType]
+	return ok && r.disabled[deviceType]
+}
+
+// SetEnabled enables or disables a registered processor at runtime
+func (r *ProcessorRegistry) SetEnabled(deviceType string, enabled bool) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, ok := r.processors[deviceType]; !ok {
+		return ErrUnknownProcessor
+	}
+	if enabled {
+		delete(r.disabled, deviceType)
+	} else {
+		r.disabled[deviceType] = true
+	}
+	r.log.Info("Changed processor state", "type", deviceType, "enabled", enabled)
+	return nil
+}
+
+// Dispatch processes data with the processor registered for deviceType
+func (r *ProcessorRegistry) Dispatch(ctx context.Context, deviceType string, data *models.WebhookData) error {
+	p, ok := r.Get(deviceType)
+	if !ok {
+		if r.IsDisabled(deviceType) {
+			return ErrProcessorDisabled
+		}
+		return ErrUnknownProcessor
+	}
+	return p.Process(ctx, data)
+}
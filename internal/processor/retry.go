@@ -0,0 +1,144 @@
+package processor
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+
+	"github.com/NieRVoid/emqx-pg-bridge/internal/backoff"
+	"github.com/NieRVoid/emqx-pg-bridge/pkg/logger"
+)
+
+// RetryPolicy controls how often a database transaction failing with a
+// transient error is run again. The zero value runs it once.
+type RetryPolicy struct {
+	// MaxAttempts includes the first attempt
+	MaxAttempts    int
+	InitialBackoff time.Duration
+	MaxBackoff     time.Duration
+}
+
+// backoff returns the jittered delay before the given retry (1-based)
+func (p RetryPolicy) backoff(retry int) time.Duration {
+	return backoff.Delay(retry, p.InitialBackoff, p.MaxBackoff)
+}
+
+// commitUnknownError is a COMMIT whose outcome is unknown: the connection
+// failed after it was sent, so the transaction may have been applied
+type commitUnknownError struct {
+	err error
+}
+
+func (e *commitUnknownError) Error() string { return "commit outcome unknown: " + e.err.Error() }
+func (e *commitUnknownError) Unwrap() error { return e.err }
+
+// commit commits a transaction run by RetryPolicy.Do. Unless the server
+// answered or the COMMIT was never sent, the error is marked so that it is
+// not retried: running json_patch adds or deep_merge appends again would
+// apply them twice.
+func commit(ctx context.Context, tx pgx.Tx) error {
+	err := tx.Commit(ctx)
+	var pgErr *pgconn.PgError
+	if err == nil || errors.As(err, &pgErr) || pgconn.SafeToRetry(err) {
+		return err
+	}
+	return &commitUnknownError{err: err}
+}
+
+// Do runs fn until it succeeds, fails with an error that is not retryable or
+// runs out of attempts. fn must run a whole transaction so that every attempt
+// starts from scratch. No retry is made whose backoff would end after the
+// deadline of ctx.
+func (p RetryPolicy) Do(ctx context.Context, log *logger.Logger, op string, fn func() error) error {
+	for attempt := 1; ; attempt++ {
+		err := fn()
+		if err == nil || attempt >= p.MaxAttempts || !IsRetryable(err) {
+			return err
+		}
+
+		delay := p.backoff(attempt)
+		if deadline, ok := ctx.Deadline(); ok && time.Now().Add(delay).After(deadline) {
+			return err
+		}
+		log.WithContext(ctx).Sampled("db.retry").Warn("Transient database error, retrying",
+			"operation", op, "attempt", attempt, "retryIn", delay, "error", err)
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return err
+		}
+	}
+}
+
+// IsRetryable reports whether err is a transient database error that the
+// same transaction is expected to get past when run again: serialization
+// failures, deadlocks, the server shutting down and connections lost before
+// the transaction was committed
+func IsRetryable(err error) bool {
+	if err == nil || errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+
+	var commitErr *commitUnknownError
+	if errors.As(err, &commitErr) {
+		return false
+	}
+
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) {
+		switch pgErr.Code {
+		case "40001", // serialization_failure
+			"40P01", // deadlock_detected
+			"57P01", // admin_shutdown
+			"25006": // read_only_sql_transaction, the pool reconnects to the new primary
+			return true
+		}
+		return strings.HasPrefix(pgErr.Code, "08")
+	}
+
+	// The query never reached the server
+	if pgconn.SafeToRetry(err) {
+		return true
+	}
+
+	var netErr net.Error
+	return errors.As(err, &netErr)
+}
+
+// IsPermanent reports whether err can never succeed for the same webhook,
+// neither retried nor replayed later: integrity constraint violations such as
+// a device_status row for an unknown device, data the database rejects,
+// malformed payloads and update modes the store does not support
+func IsPermanent(err error) bool {
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) {
+		// integrity_constraint_violation, data_exception
+		return strings.HasPrefix(pgErr.Code, "23") || strings.HasPrefix(pgErr.Code, "22")
+	}
+
+	// SQLite result codes keep the primary code in the low byte
+	var liteErr interface{ Code() int }
+	if errors.As(err, &liteErr) {
+		return liteErr.Code()&0xff == sqliteConstraint
+	}
+
+	var numErr *strconv.NumError
+	return errors.Is(err, ErrInvalidPayload) ||
+		errors.Is(err, ErrMissingDeviceID) ||
+		errors.Is(err, ErrMissingRoomID) ||
+		errors.Is(err, ErrUnknownProcessor) ||
+		errors.Is(err, ErrUnsupportedUpdateMode) ||
+		errors.As(err, &numErr)
+}
+
+// sqliteConstraint is SQLITE_CONSTRAINT
+const sqliteConstraint = 19
@@ -0,0 +1,71 @@
+package processor
+
+import (
+	"sort"
+	"sync"
+)
+
+// Smoothing methods for sensor readings
+const (
+	SmoothingNone   = "none"
+	SmoothingEWMA   = "ewma"
+	SmoothingMedian = "median"
+)
+
+// Smoother smooths a stream of readings per key. State is kept in memory
+// only, so smoothing restarts from the first reading after a restart.
+type Smoother struct {
+	method string
+	alpha  float64
+	window int
+
+	mu      sync.Mutex
+	ewma    map[string]float64
+	samples map[string][]float64
+}
+
+// NewSmoother creates a smoother. alpha weighs the newest reading for EWMA,
+// window is the number of samples the median is taken over.
+func NewSmoother(method string, alpha float64, window int) *Smoother {
+	return &Smoother{
+		method:  method,
+		alpha:   alpha,
+		window:  window,
+		ewma:    make(map[string]float64),
+		samples: make(map[string][]float64),
+	}
+}
+
+// Add records a reading for key and returns the smoothed value
+func (s *Smoother) Add(key string, value float64) float64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	switch s.method {
+	case SmoothingEWMA:
+		prev, ok := s.ewma[key]
+		if ok {
+			value = s.alpha*value + (1-s.alpha)*prev
+		}
+		s.ewma[key] = value
+		return value
+
+	case SmoothingMedian:
+		samples := append(s.samples[key], value)
+		if len(samples) > s.window {
+			samples = samples[len(samples)-s.window:]
+		}
+		s.samples[key] = samples
+
+		sorted := append([]float64(nil), samples...)
+		sort.Float64s(sorted)
+		mid := len(sorted) / 2
+		if len(sorted)%2 == 0 {
+			return (sorted[mid-1] + sorted[mid]) / 2
+		}
+		return sorted[mid]
+
+	default:
+		return value
+	}
+}
@@ -0,0 +1,224 @@
+package processor
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// Statement is a named SQL statement of a processor
+type Statement struct {
+	Name string
+	SQL  string
+}
+
+// StatementStats is the latency summary of a registered statement
+type StatementStats struct {
+	// Tenant is set when several tenants have statements of their own
+	Tenant  string  `json:"tenant,omitempty"`
+	Name    string  `json:"name"`
+	Calls   uint64  `json:"calls"`
+	Errors  uint64  `json:"errors"`
+	TotalMs float64 `json:"totalMs"`
+	AvgMs   float64 `json:"avgMs"`
+	MaxMs   float64 `json:"maxMs"`
+}
+
+// StatementRegistry holds the processor statements prepared on every pool
+// connection. Processors register their statements while being wired up;
+// Validate then prepares them against the live schema and switches the
+// processors from sending SQL text to executing the prepared statements.
+// The registry also traces the statements to measure their latency.
+type StatementRegistry struct {
+	ready atomic.Bool
+
+	mu         sync.Mutex
+	statements map[string]string
+	stats      map[string]*statementStats
+}
+
+type statementStats struct {
+	calls  uint64
+	errors uint64
+	total  time.Duration
+	max    time.Duration
+}
+
+type statementStartKey struct{}
+
+// statementStart is kept in the query context between trace start and end
+type statementStart struct {
+	name string
+	at   time.Time
+}
+
+// NewStatementRegistry creates an empty statement registry
+func NewStatementRegistry() *StatementRegistry {
+	return &StatementRegistry{
+		statements: make(map[string]string),
+		stats:      make(map[string]*statementStats),
+	}
+}
+
+// Register adds statements to be prepared. Registering a name again with the
+// same SQL is a no-op, with different SQL it makes Validate fail. It must be
+// called before Validate.
+func (r *StatementRegistry) Register(stmts ...Statement) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for _, s := range stmts {
+		if sql, ok := r.statements[s.Name]; ok && sql != s.SQL {
+			r.statements[s.Name] = ""
+			continue
+		}
+		r.statements[s.Name] = s.SQL
+		r.stats[s.Name] = &statementStats{}
+	}
+}
+
+// Text returns what to send for s: its name once the registry is validated,
+// the SQL itself on a nil or not yet validated registry
+func (r *StatementRegistry) Text(s Statement) string {
+	if r == nil || !r.ready.Load() {
+		return s.SQL
+	}
+	return s.Name
+}
+
+// Prepare prepares all registered statements on a new connection; it is
+// the AfterConnect hook of the pool
+func (r *StatementRegistry) Prepare(ctx context.Context, conn *pgx.Conn) error {
+	r.mu.Lock()
+	statements := make(map[string]string, len(r.statements))
+	for name, sql := range r.statements {
+		statements[name] = sql
+	}
+	r.mu.Unlock()
+
+	for name, sql := range statements {
+		if _, err := conn.Prepare(ctx, name, sql); err != nil {
+			return fmt.Errorf("failed to prepare statement %s: %w", name, err)
+		}
+	}
+	return nil
+}
+
+// Validate prepares every registered statement on one connection, reporting
+// all statements that do not match the schema. On success the pool is reset
+// so that every connection has the statements prepared, and the processors
+// start using them.
+func (r *StatementRegistry) Validate(ctx context.Context, pool *pgxpool.Pool) error {
+	conn, err := pool.Acquire(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Release()
+
+	r.mu.Lock()
+	names := make([]string, 0, len(r.statements))
+	for name := range r.statements {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var errs []error
+	for _, name := range names {
+		sql := r.statements[name]
+		if sql == "" {
+			errs = append(errs, fmt.Errorf("statement %s: registered with different SQL", name))
+			continue
+		}
+		if _, err := conn.Conn().Prepare(ctx, name, sql); err != nil {
+			errs = append(errs, fmt.Errorf("statement %s: %w", name, err))
+		}
+	}
+	r.mu.Unlock()
+
+	if len(errs) > 0 {
+		return errors.Join(errs...)
+	}
+
+	// Connections opened before the statements were registered lack them
+	pool.Reset()
+	r.ready.Store(true)
+	return nil
+}
+
+// Len returns the number of registered statements
+func (r *StatementRegistry) Len() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return len(r.statements)
+}
+
+// TraceQueryStart implements pgx.QueryTracer
+func (r *StatementRegistry) TraceQueryStart(ctx context.Context, conn *pgx.Conn, data pgx.TraceQueryStartData) context.Context {
+	if !r.ready.Load() {
+		return ctx
+	}
+	r.mu.Lock()
+	_, ok := r.stats[data.SQL]
+	r.mu.Unlock()
+	if !ok {
+		return ctx
+	}
+	return context.WithValue(ctx, statementStartKey{}, statementStart{name: data.SQL, at: time.Now()})
+}
+
+// TraceQueryEnd implements pgx.QueryTracer
+func (r *StatementRegistry) TraceQueryEnd(ctx context.Context, conn *pgx.Conn, data pgx.TraceQueryEndData) {
+	start, ok := ctx.Value(statementStartKey{}).(statementStart)
+	if !ok {
+		return
+	}
+	elapsed := time.Since(start.at)
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	st := r.stats[start.name]
+	st.calls++
+	if data.Err != nil {
+		st.errors++
+	}
+	st.total += elapsed
+	if elapsed > st.max {
+		st.max = elapsed
+	}
+}
+
+// Stats returns the latency summary of every registered statement, sorted
+// by name
+func (r *StatementRegistry) Stats() []StatementStats {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	out := make([]StatementStats, 0, len(r.stats))
+	for name, st := range r.stats {
+		s := StatementStats{
+			Name:    name,
+			Calls:   st.calls,
+			Errors:  st.errors,
+			TotalMs: durationMs(st.total),
+			MaxMs:   durationMs(st.max),
+		}
+		if st.calls > 0 {
+			s.AvgMs = durationMs(st.total / time.Duration(st.calls))
+		}
+		out = append(out, s)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Name < out[j].Name })
+	return out
+}
+
+func durationMs(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
@@ -0,0 +1,281 @@
+package processor
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+
+	"github.com/NieRVoid/emqx-pg-bridge/internal/models"
+	"github.com/NieRVoid/emqx-pg-bridge/pkg/logger"
+)
+
+// ErrUnsupportedUpdateMode is returned by stores that cannot apply an update mode
+var ErrUnsupportedUpdateMode = errors.New("update mode not supported by the store")
+
+// ErrStale is returned by stores skipping a write older than the stored row
+var ErrStale = errors.New("status older than the stored one")
+
+// reportedAtKey carries when the state written with a context was reported
+type reportedAtKey struct{}
+
+// WithReportedAt marks the writes made with ctx as reported at t, e.g. by a
+// webhook replayed from the dead-letter spool. Stores skip them with ErrStale
+// where the row was updated since.
+func WithReportedAt(ctx context.Context, t time.Time) context.Context {
+	return context.WithValue(ctx, reportedAtKey{}, t)
+}
+
+// checkFresh returns ErrStale if the write of ctx was reported before a row
+// was last updated
+func checkFresh(ctx context.Context, updatedAt *time.Time) error {
+	if t, ok := ctx.Value(reportedAtKey{}).(time.Time); ok && updatedAt != nil && updatedAt.After(t) {
+		return ErrStale
+	}
+	return nil
+}
+
+// RoomStatusUpdate holds the room_status columns reported by a center device
+type RoomStatusUpdate struct {
+	RoomID             int
+	Occupied           bool
+	OccupantCount      int
+	CountConfidence    int
+	OccupiedConfidence int
+	CountSource        string
+}
+
+// DeviceStatusUpdate holds a status reported by a normal device and how it is
+// applied to the stored one
+type DeviceStatusUpdate struct {
+	DeviceID int
+	Status   json.RawMessage
+	Mode     UpdateMode
+}
+
+// StatusStore persists the room and device status written by the center and
+// normal processors. Each write runs in one transaction holding the previous
+// row, which is returned as the Old side of the change.
+type StatusStore interface {
+	UpsertRoomStatus(ctx context.Context, u *RoomStatusUpdate) (*models.RoomStatusChange, error)
+	UpsertDeviceStatus(ctx context.Context, u *DeviceStatusUpdate) (*models.DeviceStatusChange, error)
+}
+
+// Statements of the PostgreSQL store
+var (
+	// stmtLockRoomStatus locks the current row so the previous values
+	// reported to listeners are exactly the ones a write replaces
+	stmtLockRoomStatus = Statement{Name: "room_status.lock", SQL: `
+		SELECT ` + roomStatusReturning + `
+		FROM room_status WHERE room_id = $1
+		FOR UPDATE`}
+
+	// stmtUpsertRoomOccupancy writes the columns reported by center devices.
+	// last_source_change only moves when the count source changes; a new
+	// row starts with its first source.
+	stmtUpsertRoomOccupancy = Statement{Name: "room_status.upsert_occupancy", SQL: `
+		INSERT INTO room_status (
+			room_id, occupied, occupant_count, count_confidence,
+			occupied_confidence, count_source, updated_at,
+			last_source_change
+		)
+		VALUES ($1, $2, $3, $4, $5, $6, NOW(), NOW())
+		ON CONFLICT (room_id)
+		DO UPDATE SET
+			occupied = EXCLUDED.occupied,
+			occupant_count = EXCLUDED.occupant_count,
+			count_confidence = EXCLUDED.count_confidence,
+			occupied_confidence = EXCLUDED.occupied_confidence,
+			count_source = EXCLUDED.count_source,
+			updated_at = EXCLUDED.updated_at,
+			last_source_change = CASE
+				WHEN room_status.count_source IS DISTINCT FROM EXCLUDED.count_source THEN NOW()
+				ELSE room_status.last_source_change
+			END
+		RETURNING ` + roomStatusReturning}
+
+	// stmtLockDeviceStatus locks the current row so the previous status is
+	// exactly the one a write replaces
+	stmtLockDeviceStatus = Statement{Name: "device_status.lock", SQL: `
+		SELECT ` + deviceStatusReturning + `
+		FROM device_status WHERE device_id = $1
+		FOR UPDATE`}
+)
+
+// deviceStatusUpsert returns the device_status upsert of an update mode
+func deviceStatusUpsert(mode UpdateMode) Statement {
+	return Statement{Name: "device_status.upsert." + mode.Mode, SQL: `
+		INSERT INTO device_status (
+			device_id, status, updated_at, last_reported_at
+		)
+		VALUES ($1, ` + mode.statusExpr("NULL::jsonb") + `, NOW(), NOW())
+		ON CONFLICT (device_id)
+		DO UPDATE SET
+			status = ` + mode.statusExpr("device_status.status") + `,
+			updated_at = NOW(),
+			last_reported_at = NOW()
+		RETURNING ` + deviceStatusReturning}
+}
+
+// PostgresStore is the PostgreSQL StatusStore. NOTIFY publication and
+// occupancy history are written in the same transaction as the status.
+type PostgresStore struct {
+	db       *pgxpool.Pool
+	log      *logger.Logger
+	notifier *Notifier
+	history  RoomHistoryRecorder
+	retry    RetryPolicy
+	stmts    *StatementRegistry
+}
+
+// NewPostgresStore creates a store on a PostgreSQL pool
+func NewPostgresStore(db *pgxpool.Pool, log *logger.Logger) *PostgresStore {
+	return &PostgresStore{
+		db:  db,
+		log: log.Component("processor.store"),
+	}
+}
+
+// SetRetryPolicy enables retries of writes failing with transient errors
+func (s *PostgresStore) SetRetryPolicy(p RetryPolicy) {
+	s.retry = p
+}
+
+// SetStatements registers the store statements, which are executed prepared
+// once the registry is validated
+func (s *PostgresStore) SetStatements(r *StatementRegistry) {
+	r.Register(stmtLockRoomStatus, stmtUpsertRoomOccupancy, stmtLockDeviceStatus)
+	for _, mode := range []string{UpdateReplace, UpdateMergePatch, UpdateJSONPatch, UpdateDeepMerge} {
+		r.Register(deviceStatusUpsert(UpdateMode{Mode: mode}))
+	}
+	s.stmts = r
+}
+
+// SetNotifier enables NOTIFY publication of room_status and device_status changes
+func (s *PostgresStore) SetNotifier(n *Notifier) {
+	s.notifier = n
+}
+
+// SetHistoryRecorder enables recording of occupancy history
+func (s *PostgresStore) SetHistoryRecorder(r RoomHistoryRecorder) {
+	s.history = r
+}
+
+// UpsertRoomStatus implements StatusStore
+func (s *PostgresStore) UpsertRoomStatus(ctx context.Context, u *RoomStatusUpdate) (*models.RoomStatusChange, error) {
+	var change *models.RoomStatusChange
+	err := s.retry.Do(ctx, s.log, "room_status", func() (err error) {
+		change, err = s.upsertRoomStatus(ctx, u)
+		return err
+	})
+	return change, err
+}
+
+func (s *PostgresStore) upsertRoomStatus(ctx context.Context, u *RoomStatusUpdate) (*models.RoomStatusChange, error) {
+	tx, err := s.db.Begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback(ctx)
+
+	// Lock the current row so the previous values reported to listeners are
+	// exactly the ones this write replaces
+	old, err := scanRoomStatus(tx.QueryRow(ctx, s.stmts.Text(stmtLockRoomStatus), u.RoomID))
+	if errors.Is(err, pgx.ErrNoRows) {
+		old = nil
+	} else if err != nil {
+		return nil, err
+	} else if err := checkFresh(ctx, old.UpdatedAt); err != nil {
+		return nil, err
+	}
+
+	row := tx.QueryRow(ctx, s.stmts.Text(stmtUpsertRoomOccupancy), u.RoomID, u.Occupied,
+		u.OccupantCount, u.CountConfidence, u.OccupiedConfidence, u.CountSource)
+
+	status, err := scanRoomStatus(row)
+	if err != nil {
+		return nil, err
+	}
+
+	if s.history != nil {
+		if err := s.history.RecordRoomStatus(ctx, tx, status); err != nil {
+			return nil, fmt.Errorf("failed to record occupancy history: %w", err)
+		}
+	}
+
+	change := &models.RoomStatusChange{Old: old, New: status}
+
+	// Notifications are delivered by PostgreSQL only if the upsert commits
+	if s.notifier != nil {
+		if err := s.notifier.NotifyRoom(ctx, tx, change); err != nil {
+			return nil, fmt.Errorf("failed to publish notification: %w", err)
+		}
+	}
+
+	if err := commit(ctx, tx); err != nil {
+		return nil, err
+	}
+	return change, nil
+}
+
+// UpsertDeviceStatus implements StatusStore
+func (s *PostgresStore) UpsertDeviceStatus(ctx context.Context, u *DeviceStatusUpdate) (*models.DeviceStatusChange, error) {
+	var change *models.DeviceStatusChange
+	err := s.retry.Do(ctx, s.log, "device_status", func() (err error) {
+		change, err = s.upsertDeviceStatus(ctx, u)
+		return err
+	})
+	return change, err
+}
+
+func (s *PostgresStore) upsertDeviceStatus(ctx context.Context, u *DeviceStatusUpdate) (*models.DeviceStatusChange, error) {
+	tx, err := s.db.Begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback(ctx)
+
+	// Lock the current row so the previous status is exactly the one replaced
+	old, err := scanDeviceStatus(tx.QueryRow(ctx, s.stmts.Text(stmtLockDeviceStatus), u.DeviceID))
+	if errors.Is(err, pgx.ErrNoRows) {
+		old = nil
+	} else if err != nil {
+		return nil, err
+	} else if err := checkFresh(ctx, old.UpdatedAt); err != nil {
+		return nil, err
+	}
+
+	// The new status is computed from the locked row in SQL, so concurrent
+	// partial updates all apply
+	args := []interface{}{u.DeviceID, u.Status}
+	if u.Mode.Mode == UpdateDeepMerge {
+		args = append(args, u.Mode.ArrayStrategy)
+	}
+	row := tx.QueryRow(ctx, s.stmts.Text(deviceStatusUpsert(u.Mode)), args...)
+
+	status, err := scanDeviceStatus(row)
+	if isInvalidPatch(err) {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidPayload, err)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	change := &models.DeviceStatusChange{Old: old, New: status}
+
+	// Notifications are delivered by PostgreSQL only if the upsert commits
+	if s.notifier != nil {
+		if err := s.notifier.NotifyDevice(ctx, tx, change); err != nil {
+			return nil, fmt.Errorf("failed to publish notification: %w", err)
+		}
+	}
+
+	if err := commit(ctx, tx); err != nil {
+		return nil, err
+	}
+	return change, nil
+}
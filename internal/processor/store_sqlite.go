@@ -0,0 +1,171 @@
+package processor
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/NieRVoid/emqx-pg-bridge/internal/models"
+)
+
+// SQLiteStore is the embedded SQLite StatusStore for small sites. It supports
+// the replace and merge_patch update modes.
+type SQLiteStore struct {
+	db *sql.DB
+}
+
+// NewSQLiteStore creates a store on an SQLite database. Transactions must be
+// opened with BEGIN IMMEDIATE so the previous row cannot change before the
+// write.
+func NewSQLiteStore(db *sql.DB) *SQLiteStore {
+	return &SQLiteStore{db: db}
+}
+
+// sqliteRoomStatusColumns reads a count_source left NULL by an older schema
+// as unknown, like roomStatusReturning
+const sqliteRoomStatusColumns = `
+	room_id, occupied, occupant_count, count_confidence, occupied_confidence,
+	COALESCE(count_source, 'unknown') AS count_source, last_source_change, temperature, humidity, air_quality,
+	light_level, noise_level, metadata, updated_at`
+
+func scanSQLiteRoomStatus(row *sql.Row) (*models.RoomStatus, error) {
+	var rs models.RoomStatus
+	var lastSourceChange, updatedAt sql.NullTime
+	var metadata []byte
+	err := row.Scan(&rs.RoomID, &rs.Occupied, &rs.OccupantCount, &rs.CountConfidence,
+		&rs.OccupiedConfidence, &rs.CountSource, &lastSourceChange, &rs.Temperature,
+		&rs.Humidity, &rs.AirQuality, &rs.LightLevel, &rs.NoiseLevel, &metadata,
+		&updatedAt)
+	if err != nil {
+		return nil, err
+	}
+	rs.LastSourceChange = nullTime(lastSourceChange)
+	rs.UpdatedAt = nullTime(updatedAt)
+	rs.Metadata = metadata
+	return &rs, nil
+}
+
+const sqliteDeviceStatusColumns = `device_id, status, updated_at, last_reported_at`
+
+func scanSQLiteDeviceStatus(row *sql.Row) (*models.DeviceStatus, error) {
+	var ds models.DeviceStatus
+	var status []byte
+	var updatedAt, lastReportedAt sql.NullTime
+	if err := row.Scan(&ds.DeviceID, &status, &updatedAt, &lastReportedAt); err != nil {
+		return nil, err
+	}
+	ds.Status = status
+	ds.UpdatedAt = nullTime(updatedAt)
+	ds.LastReportedAt = nullTime(lastReportedAt)
+	return &ds, nil
+}
+
+func nullTime(t sql.NullTime) *time.Time {
+	if !t.Valid {
+		return nil
+	}
+	return &t.Time
+}
+
+// UpsertRoomStatus implements StatusStore
+func (s *SQLiteStore) UpsertRoomStatus(ctx context.Context, u *RoomStatusUpdate) (*models.RoomStatusChange, error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	old, err := scanSQLiteRoomStatus(tx.QueryRowContext(ctx, `
+		SELECT `+sqliteRoomStatusColumns+`
+		FROM room_status WHERE room_id = ?`, u.RoomID))
+	if errors.Is(err, sql.ErrNoRows) {
+		old = nil
+	} else if err != nil {
+		return nil, err
+	} else if err := checkFresh(ctx, old.UpdatedAt); err != nil {
+		return nil, err
+	}
+
+	now := time.Now().UTC()
+	status, err := scanSQLiteRoomStatus(tx.QueryRowContext(ctx, `
+		INSERT INTO room_status (
+			room_id, occupied, occupant_count, count_confidence,
+			occupied_confidence, count_source, updated_at, last_source_change
+		)
+		VALUES (?1, ?2, ?3, ?4, ?5, ?6, ?7, ?7)
+		ON CONFLICT (room_id)
+		DO UPDATE SET
+			occupied = excluded.occupied,
+			occupant_count = excluded.occupant_count,
+			count_confidence = excluded.count_confidence,
+			occupied_confidence = excluded.occupied_confidence,
+			count_source = excluded.count_source,
+			updated_at = excluded.updated_at,
+			last_source_change = CASE
+				WHEN room_status.count_source IS NOT excluded.count_source THEN excluded.updated_at
+				ELSE room_status.last_source_change
+			END
+		RETURNING `+sqliteRoomStatusColumns, u.RoomID, u.Occupied, u.OccupantCount,
+		u.CountConfidence, u.OccupiedConfidence, u.CountSource, now))
+	if err != nil {
+		return nil, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	return &models.RoomStatusChange{Old: old, New: status}, nil
+}
+
+// UpsertDeviceStatus implements StatusStore
+func (s *SQLiteStore) UpsertDeviceStatus(ctx context.Context, u *DeviceStatusUpdate) (*models.DeviceStatusChange, error) {
+	// json_patch implements RFC 7396, the successor of RFC 7386
+	var insertExpr, updateExpr string
+	switch u.Mode.Mode {
+	case UpdateReplace, "":
+		insertExpr, updateExpr = `json(?2)`, `json(?2)`
+	case UpdateMergePatch:
+		insertExpr, updateExpr = `json_patch('{}', ?2)`, `json_patch(device_status.status, ?2)`
+	default:
+		return nil, ErrUnsupportedUpdateMode
+	}
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	old, err := scanSQLiteDeviceStatus(tx.QueryRowContext(ctx, `
+		SELECT `+sqliteDeviceStatusColumns+`
+		FROM device_status WHERE device_id = ?`, u.DeviceID))
+	if errors.Is(err, sql.ErrNoRows) {
+		old = nil
+	} else if err != nil {
+		return nil, err
+	} else if err := checkFresh(ctx, old.UpdatedAt); err != nil {
+		return nil, err
+	}
+
+	now := time.Now().UTC()
+	status, err := scanSQLiteDeviceStatus(tx.QueryRowContext(ctx, `
+		INSERT INTO device_status (
+			device_id, status, updated_at, last_reported_at
+		)
+		VALUES (?1, `+insertExpr+`, ?3, ?3)
+		ON CONFLICT (device_id)
+		DO UPDATE SET
+			status = `+updateExpr+`,
+			updated_at = excluded.updated_at,
+			last_reported_at = excluded.last_reported_at
+		RETURNING `+sqliteDeviceStatusColumns, u.DeviceID, string(u.Status), now))
+	if err != nil {
+		return nil, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	return &models.DeviceStatusChange{Old: old, New: status}, nil
+}
@@ -0,0 +1,423 @@
+package processor_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/NieRVoid/emqx-pg-bridge/internal/config"
+	"github.com/NieRVoid/emqx-pg-bridge/internal/database"
+	"github.com/NieRVoid/emqx-pg-bridge/internal/processor"
+	"github.com/NieRVoid/emqx-pg-bridge/pkg/logger"
+)
+
+// testDatabaseURLEnv names a PostgreSQL database the store tests may create
+// and drop schemas in; the PostgreSQL store is skipped without it. CI and
+// "make test-postgres" set it.
+const testDatabaseURLEnv = "TEST_DATABASE_URL"
+
+// storeBackend is a StatusStore on a freshly migrated database with one
+// room (id 1) and one device (id 1) in it
+type storeBackend struct {
+	name  string
+	store processor.StatusStore
+	// exec runs seeding SQL on the store's database
+	exec func(ctx context.Context, sql string) error
+	// modes lists the device_status update modes the store supports
+	modes []string
+}
+
+// storeBackends opens every store the conformance tests run against
+func storeBackends(t *testing.T) []storeBackend {
+	return []storeBackend{sqliteBackend(t), postgresBackend(t)}
+}
+
+// seedSQL creates the room and device the tests write status for. It is
+// plain SQL both dialects accept.
+const seedSQL = `
+	INSERT INTO rooms (id, number, name) VALUES (1, '101', 'Room 101');
+	INSERT INTO devices (id, name, type, room_id) VALUES (1, 'sensor-1', 'normal', 1);`
+
+func testConfig(t *testing.T, databaseURL string) *config.Config {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	data := fmt.Sprintf("database:\n  url: %q\n", databaseURL)
+	if err := os.WriteFile(path, []byte(data), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := config.LoadFromFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cfg
+}
+
+func testLogger() *logger.Logger {
+	return logger.New(os.Stderr, os.Stderr, "error", "text")
+}
+
+func sqliteBackend(t *testing.T) storeBackend {
+	ctx := context.Background()
+	cfg := testConfig(t, "sqlite://"+filepath.Join(t.TempDir(), "bridge.db"))
+
+	lite, err := database.NewSQLite(ctx, cfg, testLogger())
+	if err != nil {
+		t.Fatalf("failed to open SQLite: %v", err)
+	}
+	t.Cleanup(lite.Close)
+
+	if err := lite.Migrate(ctx); err != nil {
+		t.Fatalf("failed to migrate SQLite: %v", err)
+	}
+	if _, err := lite.DB.ExecContext(ctx, seedSQL); err != nil {
+		t.Fatalf("failed to seed SQLite: %v", err)
+	}
+
+	return storeBackend{
+		name:  "sqlite",
+		store: processor.NewSQLiteStore(lite.DB),
+		exec: func(ctx context.Context, sql string) error {
+			_, err := lite.DB.ExecContext(ctx, sql)
+			return err
+		},
+		modes: []string{processor.UpdateReplace, processor.UpdateMergePatch},
+	}
+}
+
+// postgresBackend migrates a schema of its own in the test database, which
+// is dropped again when the test ends
+func postgresBackend(t *testing.T) storeBackend {
+	backend := storeBackend{
+		name: "postgres",
+		modes: []string{processor.UpdateReplace, processor.UpdateMergePatch,
+			processor.UpdateJSONPatch, processor.UpdateDeepMerge},
+	}
+
+	databaseURL := os.Getenv(testDatabaseURLEnv)
+	if databaseURL == "" {
+		return backend
+	}
+
+	ctx := context.Background()
+	log := testLogger()
+	schema := fmt.Sprintf("store_test_%d", time.Now().UnixNano())
+
+	admin, err := database.NewPostgres(ctx, testConfig(t, databaseURL), nil, log)
+	if err != nil {
+		t.Fatalf("failed to connect to PostgreSQL: %v", err)
+	}
+	t.Cleanup(admin.Close)
+	if err := admin.CreateSchema(ctx, schema); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		if _, err := admin.Pool.Exec(context.Background(), `DROP SCHEMA `+schema+` CASCADE`); err != nil {
+			t.Errorf("failed to drop schema %s: %v", schema, err)
+		}
+	})
+
+	u, err := url.Parse(databaseURL)
+	if err != nil {
+		t.Fatalf("%s must be a URL: %v", testDatabaseURLEnv, err)
+	}
+	q := u.Query()
+	q.Set("search_path", schema)
+	u.RawQuery = q.Encode()
+
+	db, err := database.NewPostgres(ctx, testConfig(t, u.String()), nil, log)
+	if err != nil {
+		t.Fatalf("failed to connect to PostgreSQL: %v", err)
+	}
+	t.Cleanup(db.Close)
+
+	if err := db.Migrate(ctx); err != nil {
+		t.Fatalf("failed to migrate PostgreSQL: %v", err)
+	}
+	if _, err := db.Pool.Exec(ctx, seedSQL); err != nil {
+		t.Fatalf("failed to seed PostgreSQL: %v", err)
+	}
+
+	backend.store = processor.NewPostgresStore(db.Pool, log)
+	backend.exec = func(ctx context.Context, sql string) error {
+		_, err := db.Pool.Exec(ctx, sql)
+		return err
+	}
+	return backend
+}
+
+// runStores runs a conformance test against every store
+func runStores(t *testing.T, test func(t *testing.T, b storeBackend)) {
+	for _, b := range storeBackends(t) {
+		t.Run(b.name, func(t *testing.T) {
+			if b.store == nil {
+				t.Skipf("%s not set", testDatabaseURLEnv)
+			}
+			test(t, b)
+		})
+	}
+}
+
+func (b storeBackend) supports(mode string) bool {
+	for _, m := range b.modes {
+		if m == mode {
+			return true
+		}
+	}
+	return false
+}
+
+func TestStoreUpsertRoomStatus(t *testing.T) {
+	runStores(t, func(t *testing.T, b storeBackend) {
+		ctx := context.Background()
+
+		first, err := b.store.UpsertRoomStatus(ctx, &processor.RoomStatusUpdate{
+			RoomID: 1, Occupied: true, OccupantCount: 2,
+			CountConfidence: 80, OccupiedConfidence: 90, CountSource: "radar",
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if first.Old != nil {
+			t.Errorf("first write: Old = %+v, want nil", first.Old)
+		}
+		if first.New.RoomID != 1 || !first.New.Occupied || first.New.OccupantCount != 2 ||
+			first.New.CountConfidence != 80 || first.New.OccupiedConfidence != 90 ||
+			first.New.CountSource != "radar" {
+			t.Errorf("first write: New = %+v", first.New)
+		}
+		if first.New.UpdatedAt == nil || first.New.LastSourceChange == nil {
+			t.Fatalf("first write: timestamps not set: %+v", first.New)
+		}
+
+		// Same source: last_source_change stays
+		second, err := b.store.UpsertRoomStatus(ctx, &processor.RoomStatusUpdate{
+			RoomID: 1, Occupied: true, OccupantCount: 3, CountSource: "radar",
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if second.Old == nil || second.Old.OccupantCount != 2 {
+			t.Errorf("second write: Old = %+v, want the first write", second.Old)
+		}
+		if second.New.OccupantCount != 3 {
+			t.Errorf("second write: occupant count = %d, want 3", second.New.OccupantCount)
+		}
+		if !second.New.LastSourceChange.Equal(*first.New.LastSourceChange) {
+			t.Errorf("second write: last source change moved from %v to %v",
+				first.New.LastSourceChange, second.New.LastSourceChange)
+		}
+
+		// New source: last_source_change moves with the write
+		third, err := b.store.UpsertRoomStatus(ctx, &processor.RoomStatusUpdate{
+			RoomID: 1, Occupied: false, CountSource: "camera",
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if third.New.CountSource != "camera" || third.New.Occupied {
+			t.Errorf("third write: New = %+v", third.New)
+		}
+		if !third.New.LastSourceChange.Equal(*third.New.UpdatedAt) {
+			t.Errorf("third write: last source change %v, want the write time %v",
+				third.New.LastSourceChange, third.New.UpdatedAt)
+		}
+	})
+}
+
+// A count_source left NULL, e.g. by a schema older than the bridge, differs
+// from every source written, in SQLite as in PostgreSQL
+func TestStoreCountSourceFromNull(t *testing.T) {
+	runStores(t, func(t *testing.T, b storeBackend) {
+		ctx := context.Background()
+
+		err := b.exec(ctx, `
+			ALTER TABLE room_status DROP COLUMN count_source;
+			ALTER TABLE room_status ADD COLUMN count_source text;
+			INSERT INTO room_status (room_id, updated_at) VALUES (1, '2020-01-01 00:00:00');`)
+		if err != nil {
+			t.Fatalf("failed to seed a NULL count source: %v", err)
+		}
+
+		change, err := b.store.UpsertRoomStatus(ctx, &processor.RoomStatusUpdate{
+			RoomID: 1, Occupied: true, OccupantCount: 1, CountSource: "radar",
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if change.Old == nil || change.Old.CountSource != "unknown" {
+			t.Errorf("Old = %+v, want count source unknown", change.Old)
+		}
+		if change.New.LastSourceChange == nil || !change.New.LastSourceChange.Equal(*change.New.UpdatedAt) {
+			t.Errorf("last source change %v, want the write time %v",
+				change.New.LastSourceChange, change.New.UpdatedAt)
+		}
+	})
+}
+
+func TestStoreUpsertDeviceStatus(t *testing.T) {
+	tests := []struct {
+		mode  string
+		first string
+		patch string
+		want  string
+	}{
+		{
+			mode:  processor.UpdateReplace,
+			first: `{"a":1,"b":{"c":2}}`,
+			patch: `{"b":{"d":3}}`,
+			want:  `{"b":{"d":3}}`,
+		},
+		{
+			mode:  processor.UpdateMergePatch,
+			first: `{"a":1,"b":{"c":2}}`,
+			patch: `{"a":null,"b":{"d":3}}`,
+			want:  `{"b":{"c":2,"d":3}}`,
+		},
+	}
+
+	runStores(t, func(t *testing.T, b storeBackend) {
+		ctx := context.Background()
+
+		for i, tt := range tests {
+			if !b.supports(tt.mode) {
+				continue
+			}
+			t.Run(tt.mode, func(t *testing.T) {
+				// Every mode writes its own device so the first write inserts
+				deviceID := 100 + i
+				seedDevice(t, b, deviceID)
+
+				mode := processor.UpdateMode{Mode: tt.mode}
+				first, err := b.store.UpsertDeviceStatus(ctx, &processor.DeviceStatusUpdate{
+					DeviceID: deviceID, Status: json.RawMessage(tt.first), Mode: mode,
+				})
+				if err != nil {
+					t.Fatal(err)
+				}
+				if first.Old != nil {
+					t.Errorf("first write: Old = %s, want nil", first.Old.Status)
+				}
+				assertJSON(t, first.New.Status, tt.first)
+
+				second, err := b.store.UpsertDeviceStatus(ctx, &processor.DeviceStatusUpdate{
+					DeviceID: deviceID, Status: json.RawMessage(tt.patch), Mode: mode,
+				})
+				if err != nil {
+					t.Fatal(err)
+				}
+				if second.Old == nil {
+					t.Fatal("second write: Old = nil, want the first write")
+				}
+				assertJSON(t, second.Old.Status, tt.first)
+				assertJSON(t, second.New.Status, tt.want)
+				if second.New.DeviceID != deviceID || second.New.UpdatedAt == nil || second.New.LastReportedAt == nil {
+					t.Errorf("second write: New = %+v", second.New)
+				}
+			})
+		}
+	})
+}
+
+func TestStoreUnsupportedUpdateMode(t *testing.T) {
+	runStores(t, func(t *testing.T, b storeBackend) {
+		for _, mode := range []string{processor.UpdateJSONPatch, processor.UpdateDeepMerge} {
+			if b.supports(mode) {
+				continue
+			}
+			_, err := b.store.UpsertDeviceStatus(context.Background(), &processor.DeviceStatusUpdate{
+				DeviceID: 1, Status: json.RawMessage(`{}`), Mode: processor.UpdateMode{Mode: mode},
+			})
+			if !processor.IsPermanent(err) {
+				t.Errorf("%s: error %v is not permanent", mode, err)
+			}
+		}
+	})
+}
+
+// TestStoreSkipsStale checks that a write reported before the row was last
+// updated, e.g. a replayed webhook, leaves the row alone
+func TestStoreSkipsStale(t *testing.T) {
+	runStores(t, func(t *testing.T, b storeBackend) {
+		ctx := context.Background()
+		before := time.Now().Add(-time.Hour)
+
+		room := &processor.RoomStatusUpdate{RoomID: 1, Occupied: true, OccupantCount: 2, CountSource: "radar"}
+		device := &processor.DeviceStatusUpdate{
+			DeviceID: 1, Status: json.RawMessage(`{"a":1}`),
+			Mode: processor.UpdateMode{Mode: processor.UpdateReplace},
+		}
+		if _, err := b.store.UpsertRoomStatus(ctx, room); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := b.store.UpsertDeviceStatus(ctx, device); err != nil {
+			t.Fatal(err)
+		}
+
+		stale := processor.WithReportedAt(ctx, before)
+		if _, err := b.store.UpsertRoomStatus(stale, room); !errors.Is(err, processor.ErrStale) {
+			t.Errorf("room status error = %v, want ErrStale", err)
+		}
+		if _, err := b.store.UpsertDeviceStatus(stale, device); !errors.Is(err, processor.ErrStale) {
+			t.Errorf("device status error = %v, want ErrStale", err)
+		}
+
+		fresh := processor.WithReportedAt(ctx, time.Now().Add(time.Hour))
+		if _, err := b.store.UpsertRoomStatus(fresh, room); err != nil {
+			t.Errorf("room status: %v", err)
+		}
+		if _, err := b.store.UpsertDeviceStatus(fresh, device); err != nil {
+			t.Errorf("device status: %v", err)
+		}
+	})
+}
+
+func TestStoreUnknownRowsArePermanent(t *testing.T) {
+	runStores(t, func(t *testing.T, b storeBackend) {
+		ctx := context.Background()
+
+		_, err := b.store.UpsertRoomStatus(ctx, &processor.RoomStatusUpdate{RoomID: 999, CountSource: "radar"})
+		if err == nil || !processor.IsPermanent(err) {
+			t.Errorf("unknown room: error %v, want a permanent one", err)
+		}
+
+		_, err = b.store.UpsertDeviceStatus(ctx, &processor.DeviceStatusUpdate{
+			DeviceID: 999, Status: json.RawMessage(`{}`),
+			Mode: processor.UpdateMode{Mode: processor.UpdateReplace},
+		})
+		if err == nil || !processor.IsPermanent(err) {
+			t.Errorf("unknown device: error %v, want a permanent one", err)
+		}
+	})
+}
+
+// seedDevice adds a device to room 1
+func seedDevice(t *testing.T, b storeBackend, id int) {
+	t.Helper()
+	err := b.exec(context.Background(), fmt.Sprintf(
+		`INSERT INTO devices (id, name, type, room_id) VALUES (%d, 'sensor-%d', 'normal', 1)`, id, id))
+	if err != nil {
+		t.Fatalf("failed to seed device %d: %v", id, err)
+	}
+}
+
+// assertJSON compares JSON documents regardless of key order and spacing
+func assertJSON(t *testing.T, got json.RawMessage, want string) {
+	t.Helper()
+	var g, w interface{}
+	if err := json.Unmarshal(got, &g); err != nil {
+		t.Fatalf("invalid JSON %s: %v", got, err)
+	}
+	if err := json.Unmarshal([]byte(want), &w); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(g, w) {
+		t.Errorf("status = %s, want %s", got, want)
+	}
+}
@@ -0,0 +1,82 @@
+package processor
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+// Update modes for device_status.status
+const (
+	UpdateReplace    = "replace"
+	UpdateMergePatch = "merge_patch"
+	UpdateJSONPatch  = "json_patch"
+	UpdateDeepMerge  = "deep_merge"
+)
+
+// Array strategies of the deep merge update mode
+const (
+	ArrayReplace = "replace"
+	ArrayAppend  = "append"
+	ArrayUnion   = "union"
+)
+
+// UpdateMode selects how a reported payload is applied to the stored status
+type UpdateMode struct {
+	Mode string
+	// ArrayStrategy is only used by UpdateDeepMerge
+	ArrayStrategy string
+}
+
+// UpdateModeSetter is implemented by processors supporting update modes
+type UpdateModeSetter interface {
+	SetUpdateMode(mode UpdateMode)
+}
+
+// ParseUpdateMode validates mode and array strategy; empty values select
+// replace
+func ParseUpdateMode(mode, arrayStrategy string) (UpdateMode, error) {
+	if mode == "" {
+		mode = UpdateReplace
+	}
+	if arrayStrategy == "" {
+		arrayStrategy = ArrayReplace
+	}
+
+	switch mode {
+	case UpdateReplace, UpdateMergePatch, UpdateJSONPatch, UpdateDeepMerge:
+	default:
+		return UpdateMode{}, fmt.Errorf("invalid update mode: %s", mode)
+	}
+	switch arrayStrategy {
+	case ArrayReplace, ArrayAppend, ArrayUnion:
+	default:
+		return UpdateMode{}, fmt.Errorf("invalid array strategy: %s", arrayStrategy)
+	}
+
+	return UpdateMode{Mode: mode, ArrayStrategy: arrayStrategy}, nil
+}
+
+// statusExpr returns the SQL expression computing the new status from
+// current, the payload parameter $2 and the array strategy parameter $3.
+// The functions are installed by the embedded migrations.
+func (m UpdateMode) statusExpr(current string) string {
+	switch m.Mode {
+	case UpdateMergePatch:
+		return `jsonb_merge_patch(` + current + `, $2::jsonb)`
+	case UpdateJSONPatch:
+		return `jsonb_apply_patch(` + current + `, $2::jsonb)`
+	case UpdateDeepMerge:
+		return `jsonb_deep_merge(` + current + `, $2::jsonb, $3::text)`
+	default:
+		return `$2::jsonb`
+	}
+}
+
+// isInvalidPatch reports whether err was raised by the update functions for
+// a patch that cannot be applied
+func isInvalidPatch(err error) bool {
+	var pgErr *pgconn.PgError
+	return errors.As(err, &pgErr) && pgErr.Code == "22023"
+}
@@ -0,0 +1,380 @@
+package ratelimit
+
+import (
+	"context"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/NieRVoid/emqx-pg-bridge/internal/models"
+	"github.com/NieRVoid/emqx-pg-bridge/internal/spool"
+	"github.com/NieRVoid/emqx-pg-bridge/pkg/logger"
+)
+
+// Keys a limit is applied per
+const (
+	KeyClientID   = "clientid"
+	KeyDeviceID   = "device_id"
+	KeyDeviceType = "device_type"
+	KeyPeerIP     = "peer_ip"
+)
+
+// Actions taken on webhooks over a limit
+const (
+	// ActionDrop rejects the webhook with 429
+	ActionDrop = "drop"
+	// ActionSample processes one in SampleEvery throttled webhooks and
+	// acknowledges the others without processing them
+	ActionSample = "sample"
+	// ActionCoalesce keeps the latest throttled webhook per key and room or
+	// device and processes it as soon as the key has tokens again
+	ActionCoalesce = "coalesce"
+)
+
+// idleEviction is how long a full bucket is kept after its key went quiet
+const idleEviction = 10 * time.Minute
+
+// Decision is the outcome of a limit check
+type Decision int
+
+// Limit check outcomes
+const (
+	Allow Decision = iota
+	Drop
+	SampledOut
+	Coalesced
+)
+
+// Rule configures one limit
+type Rule struct {
+	Name string
+	Key  string
+	// Rate is the sustained number of webhooks per second and key
+	Rate  float64
+	Burst int
+	// Action is drop, sample or coalesce
+	Action      string
+	SampleEvery int
+	// DeviceTypes restricts the limit to some device types; empty means all
+	DeviceTypes []string
+}
+
+// Stats counts the traffic seen by a limit
+type Stats struct {
+	Name      string `json:"name"`
+	Key       string `json:"key"`
+	Action    string `json:"action"`
+	Keys      int    `json:"keys"`
+	Allowed   uint64 `json:"allowed"`
+	Dropped   uint64 `json:"dropped"`
+	Sampled   uint64 `json:"sampledOut"`
+	Coalesced uint64 `json:"coalesced"`
+	Flushed   uint64 `json:"flushed"`
+	Pending   int    `json:"pending"`
+}
+
+// bucket is the token bucket of one key
+type bucket struct {
+	tokens    float64
+	last      time.Time
+	throttled uint64
+}
+
+// pendingWebhook is the latest coalesced webhook of a key and row
+type pendingWebhook struct {
+	// key is the bucket the webhook waits for tokens of
+	key        string
+	deviceType string
+	data       *models.WebhookData
+}
+
+type limit struct {
+	Rule
+	deviceTypes map[string]bool
+	buckets     map[string]*bucket
+	// pending is keyed by pendingKey, so webhooks of different rows sharing
+	// a bucket do not replace each other
+	pending map[string]*pendingWebhook
+	stats   Stats
+}
+
+// take refills the bucket of key and takes a token if one is available
+func (l *limit) take(key string, now time.Time) (*bucket, bool) {
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &bucket{tokens: float64(l.Burst), last: now}
+		l.buckets[key] = b
+	}
+	b.tokens += now.Sub(b.last).Seconds() * l.Rate
+	if b.tokens > float64(l.Burst) {
+		b.tokens = float64(l.Burst)
+	}
+	b.last = now
+
+	if b.tokens < 1 {
+		return b, false
+	}
+	b.tokens--
+	return b, true
+}
+
+// Limiter applies token bucket limits to incoming webhooks
+type Limiter struct {
+	log      *logger.Logger
+	dispatch spool.DispatchFunc
+	timeout  time.Duration
+
+	mu     sync.Mutex
+	limits []*limit
+}
+
+// NewLimiter creates a limiter checking the rules in order
+func NewLimiter(rules []Rule, log *logger.Logger) *Limiter {
+	l := &Limiter{log: log.Component("ratelimit")}
+	for _, r := range rules {
+		lim := &limit{
+			Rule:    r,
+			buckets: make(map[string]*bucket),
+			pending: make(map[string]*pendingWebhook),
+			stats:   Stats{Name: r.Name, Key: r.Key, Action: r.Action},
+		}
+		if len(r.DeviceTypes) > 0 {
+			lim.deviceTypes = make(map[string]bool, len(r.DeviceTypes))
+			for _, t := range r.DeviceTypes {
+				lim.deviceTypes[t] = true
+			}
+		}
+		l.limits = append(l.limits, lim)
+	}
+	return l
+}
+
+// SetDispatch sets how coalesced webhooks are processed once released. It
+// is required by coalesce limits and must be called before the limiter is
+// used.
+func (l *Limiter) SetDispatch(fn spool.DispatchFunc) {
+	l.dispatch = fn
+}
+
+// SetTimeout bounds the processing of each released webhook, as the request
+// timeout bounds that of a webhook processed right away. Zero means no bound.
+func (l *Limiter) SetTimeout(d time.Duration) {
+	l.timeout = d
+}
+
+// Check applies the limits to a webhook. The first limit the webhook is over
+// decides; Coalesced webhooks are kept by the limiter and processed later.
+func (l *Limiter) Check(deviceType string, data *models.WebhookData) (Decision, string) {
+	now := time.Now()
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	for _, lim := range l.limits {
+		if lim.deviceTypes != nil && !lim.deviceTypes[deviceType] {
+			continue
+		}
+		key := keyOf(lim.Key, deviceType, data)
+		if key == "" {
+			continue
+		}
+
+		// A webhook newer than the coalesced one of its row must not be
+		// overwritten by it later
+		pk := pendingKey(key, deviceType, data)
+		if _, ok := lim.pending[pk]; ok && lim.Action == ActionCoalesce {
+			lim.pending[pk] = &pendingWebhook{key: key, deviceType: deviceType, data: data}
+			lim.stats.Coalesced++
+			return Coalesced, lim.Name
+		}
+
+		b, ok := lim.take(key, now)
+		if ok {
+			lim.stats.Allowed++
+			continue
+		}
+
+		b.throttled++
+		switch lim.Action {
+		case ActionSample:
+			if lim.SampleEvery > 0 && b.throttled%uint64(lim.SampleEvery) == 0 {
+				lim.stats.Allowed++
+				continue
+			}
+			lim.stats.Sampled++
+			return SampledOut, lim.Name
+		case ActionCoalesce:
+			lim.pending[pk] = &pendingWebhook{key: key, deviceType: deviceType, data: data}
+			lim.stats.Coalesced++
+			return Coalesced, lim.Name
+		default:
+			lim.stats.Dropped++
+			return Drop, lim.Name
+		}
+	}
+	return Allow, ""
+}
+
+// Run releases coalesced webhooks as their keys get tokens again and evicts
+// the buckets of quiet keys, every interval until ctx is cancelled
+func (l *Limiter) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	lastEviction := time.Now()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			l.release(ctx, now, false)
+			if now.Sub(lastEviction) >= idleEviction {
+				l.evict(now)
+				lastEviction = now
+			}
+		}
+	}
+}
+
+// Flush processes every coalesced webhook regardless of the limits, so the
+// latest state of each key is written before shutdown. It returns the number
+// of webhooks still pending, i.e. abandoned if ctx expired.
+func (l *Limiter) Flush(ctx context.Context) int {
+	l.release(ctx, time.Now(), true)
+	return l.Depth()
+}
+
+// release dispatches the pending webhooks whose key has a token, or all of
+// them if force is set
+func (l *Limiter) release(ctx context.Context, now time.Time, force bool) {
+	type released struct {
+		limit      *limit
+		pendingKey string
+		*pendingWebhook
+	}
+	var batch []released
+
+	l.mu.Lock()
+	for _, lim := range l.limits {
+		for pk, p := range lim.pending {
+			if !force {
+				if _, ok := lim.take(p.key, now); !ok {
+					continue
+				}
+			}
+			delete(lim.pending, pk)
+			batch = append(batch, released{limit: lim, pendingKey: pk, pendingWebhook: p})
+		}
+	}
+	l.mu.Unlock()
+
+	for i, r := range batch {
+		if ctx.Err() != nil {
+			// Put back what could not be dispatched
+			l.mu.Lock()
+			for _, r := range batch[i:] {
+				if _, ok := r.limit.pending[r.pendingKey]; !ok {
+					r.limit.pending[r.pendingKey] = r.pendingWebhook
+				}
+			}
+			l.mu.Unlock()
+			return
+		}
+
+		dctx := logger.ContextWith(ctx, "rate_limit", r.limit.Name)
+		cancel := context.CancelFunc(func() {})
+		if l.timeout > 0 {
+			dctx, cancel = context.WithTimeout(dctx, l.timeout)
+		}
+		err := l.dispatch(dctx, r.deviceType, r.data)
+		cancel()
+		if err != nil {
+			l.log.WithContext(dctx).Error("Failed to process coalesced webhook",
+				"deviceType", r.deviceType, "clientId", r.data.ClientID, "error", err)
+		}
+		l.mu.Lock()
+		r.limit.stats.Flushed++
+		l.mu.Unlock()
+	}
+}
+
+// evict drops the buckets of keys that are back to a full bucket and have
+// been quiet for a while
+func (l *Limiter) evict(now time.Time) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	for _, lim := range l.limits {
+		waiting := make(map[string]bool, len(lim.pending))
+		for _, p := range lim.pending {
+			waiting[p.key] = true
+		}
+		for key, b := range lim.buckets {
+			if !waiting[key] && now.Sub(b.last) > idleEviction {
+				delete(lim.buckets, key)
+			}
+		}
+	}
+}
+
+// Stats returns the traffic counters of every limit in rule order
+func (l *Limiter) Stats() []Stats {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	out := make([]Stats, 0, len(l.limits))
+	for _, lim := range l.limits {
+		s := lim.stats
+		s.Keys = len(lim.buckets)
+		s.Pending = len(lim.pending)
+		out = append(out, s)
+	}
+	return out
+}
+
+// Name returns the queue name under which coalesced webhooks are reported
+func (l *Limiter) Name() string {
+	return "rate-limit-coalesced"
+}
+
+// Depth returns the number of coalesced webhooks waiting for tokens
+func (l *Limiter) Depth() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	n := 0
+	for _, lim := range l.limits {
+		n += len(lim.pending)
+	}
+	return n
+}
+
+// pendingKey identifies the row a coalesced webhook writes within the bucket
+// of key. Only the latest webhook of a row may replace an earlier one; a
+// bucket shared by several rooms or devices keeps one webhook per row.
+func pendingKey(key, deviceType string, data *models.WebhookData) string {
+	return key + "\x00" + deviceType + "\x00" + data.GetUserProperty("roomId") +
+		"\x00" + data.GetUserProperty("deviceId")
+}
+
+// keyOf returns the value a limit is keyed by; empty skips the limit
+func keyOf(kind, deviceType string, data *models.WebhookData) string {
+	switch kind {
+	case KeyClientID:
+		return data.ClientID
+	case KeyDeviceID:
+		return data.GetUserProperty("deviceId")
+	case KeyDeviceType:
+		return deviceType
+	case KeyPeerIP:
+		if data.PeerHost != "" {
+			return data.PeerHost
+		}
+		if host, _, err := net.SplitHostPort(data.PeerName); err == nil {
+			return host
+		}
+		return data.PeerName
+	default:
+		return ""
+	}
+}
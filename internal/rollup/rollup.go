@@ -0,0 +1,289 @@
+package rollup
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+
+	"github.com/NieRVoid/emqx-pg-bridge/internal/models"
+	"github.com/NieRVoid/emqx-pg-bridge/internal/processor"
+	"github.com/NieRVoid/emqx-pg-bridge/pkg/logger"
+)
+
+// Recorder keeps occupancy samples and maintains the hourly rollups
+// incrementally as room status reports arrive
+type Recorder struct {
+	db        *pgxpool.Pool
+	maxGap    time.Duration
+	retention time.Duration
+	log       *logger.Logger
+	stmts     *processor.StatementRegistry
+}
+
+// Statements of the incremental rollup, run for every center report
+var (
+	stmtLastSample = processor.Statement{Name: "room_occupancy_samples.last", SQL: `
+		SELECT occupied, occupant_count, sampled_at
+		FROM room_occupancy_samples
+		WHERE room_id = $1
+		ORDER BY sampled_at DESC
+		LIMIT 1`}
+
+	stmtInsertSample = processor.Statement{Name: "room_occupancy_samples.insert", SQL: `
+		INSERT INTO room_occupancy_samples (
+			room_id, occupied, occupant_count, occupied_confidence, count_confidence, sampled_at
+		)
+		VALUES ($1, $2, $3, $4, $5, $6)`}
+
+	// stmtAddSegments adds the occupied time of the previous state to the
+	// hours it spans
+	stmtAddSegments = processor.Statement{Name: "room_occupancy_hourly.add_segments", SQL: `
+		INSERT INTO room_occupancy_hourly (room_id, hour, occupied_seconds, max_occupant_count)
+		SELECT $1, b.hour, b.seconds, b.count
+		FROM unnest($2::timestamp[], $3::double precision[], $4::integer[]) AS b(hour, seconds, count)
+		ON CONFLICT (room_id, hour) DO UPDATE SET
+			occupied_seconds = room_occupancy_hourly.occupied_seconds + EXCLUDED.occupied_seconds,
+			max_occupant_count = GREATEST(room_occupancy_hourly.max_occupant_count, EXCLUDED.max_occupant_count),
+			updated_at = NOW()`}
+
+	// stmtAddSample counts a new sample towards its hour
+	stmtAddSample = processor.Statement{Name: "room_occupancy_hourly.add_sample", SQL: `
+		INSERT INTO room_occupancy_hourly (room_id, hour, max_occupant_count, confidence_sum, sample_count)
+		VALUES ($1, date_trunc('hour', $2::timestamp), $3, $4, 1)
+		ON CONFLICT (room_id, hour) DO UPDATE SET
+			max_occupant_count = GREATEST(room_occupancy_hourly.max_occupant_count, EXCLUDED.max_occupant_count),
+			confidence_sum = room_occupancy_hourly.confidence_sum + EXCLUDED.confidence_sum,
+			sample_count = room_occupancy_hourly.sample_count + 1,
+			updated_at = NOW()`}
+)
+
+// NewRecorder creates a new rollup recorder. A state is assumed to hold for
+// at most maxGap after the sample reporting it, so silent periods do not
+// count as occupied.
+func NewRecorder(db *pgxpool.Pool, maxGap time.Duration, log *logger.Logger) *Recorder {
+	return &Recorder{
+		db:     db,
+		maxGap: maxGap,
+		log:    log.Component("rollup"),
+	}
+}
+
+// SetStatements registers the statements run for every report, which are
+// executed prepared once the registry is validated
+func (r *Recorder) SetStatements(reg *processor.StatementRegistry) {
+	reg.Register(stmtLastSample, stmtInsertSample, stmtAddSegments, stmtAddSample)
+	r.stmts = reg
+}
+
+// SetRetention tells the recorder how long samples are kept, so Backfill
+// does not rebuild hours whose samples may have been dropped
+func (r *Recorder) SetRetention(retention time.Duration) {
+	r.retention = retention
+}
+
+// BackfillStart returns the earliest hour Backfill can rebuild at now, or
+// the zero time when samples are kept forever. Samples older than the
+// retention may have been dropped, and the first hour also needs the sample
+// before it, up to the max gap earlier.
+func (r *Recorder) BackfillStart(now time.Time) time.Time {
+	if r.retention <= 0 {
+		return time.Time{}
+	}
+	start := now.Add(-r.retention + r.maxGap)
+	if t := start.Truncate(time.Hour); t.Before(start) {
+		start = t.Add(time.Hour)
+	}
+	return start
+}
+
+// sample is the occupancy state reported at a point in time
+type sample struct {
+	occupied bool
+	count    int
+	at       time.Time
+}
+
+// bucket accumulates the contribution of a segment to one hour
+type bucket struct {
+	hour            time.Time
+	occupiedSeconds float64
+	maxCount        int
+}
+
+// RecordRoomStatus implements processor.RoomHistoryRecorder. It runs in the
+// transaction writing room_status, which holds the row lock serializing
+// reports of the same room.
+func (r *Recorder) RecordRoomStatus(ctx context.Context, tx pgx.Tx, status *models.RoomStatus) error {
+	at := time.Now()
+	if status.UpdatedAt != nil {
+		at = *status.UpdatedAt
+	}
+
+	var prev sample
+	err := tx.QueryRow(ctx, r.stmts.Text(stmtLastSample), status.RoomID).
+		Scan(&prev.occupied, &prev.count, &prev.at)
+	hasPrev := err == nil
+	if err != nil && !errors.Is(err, pgx.ErrNoRows) {
+		return err
+	}
+
+	if _, err := tx.Exec(ctx, r.stmts.Text(stmtInsertSample),
+		status.RoomID, status.Occupied, status.OccupantCount,
+		status.OccupiedConfidence, status.CountConfidence, at); err != nil {
+		return err
+	}
+
+	// The previous state held from its sample until now
+	var buckets []bucket
+	if hasPrev && at.After(prev.at) {
+		buckets = segmentBuckets(prev, at, r.maxGap)
+	}
+
+	hours := make([]time.Time, 0, len(buckets)+1)
+	seconds := make([]float64, 0, len(buckets)+1)
+	counts := make([]int32, 0, len(buckets)+1)
+	for _, b := range buckets {
+		hours = append(hours, b.hour)
+		seconds = append(seconds, b.occupiedSeconds)
+		counts = append(counts, int32(b.maxCount))
+	}
+
+	_, err = tx.Exec(ctx, r.stmts.Text(stmtAddSegments), status.RoomID, hours, seconds, counts)
+	if err != nil {
+		return err
+	}
+
+	// The new sample itself counts towards its hour
+	_, err = tx.Exec(ctx, r.stmts.Text(stmtAddSample),
+		status.RoomID, at, status.OccupantCount, status.OccupiedConfidence)
+	return err
+}
+
+// segmentBuckets splits the time from prev until end, capped at maxGap, into
+// hourly buckets
+func segmentBuckets(prev sample, end time.Time, maxGap time.Duration) []bucket {
+	if maxGap > 0 && end.Sub(prev.at) > maxGap {
+		end = prev.at.Add(maxGap)
+	}
+
+	var buckets []bucket
+	for hour := prev.at.Truncate(time.Hour); hour.Before(end); hour = hour.Add(time.Hour) {
+		start := prev.at
+		if hour.After(start) {
+			start = hour
+		}
+		stop := hour.Add(time.Hour)
+		if end.Before(stop) {
+			stop = end
+		}
+
+		b := bucket{hour: hour, maxCount: prev.count}
+		if prev.occupied {
+			b.occupiedSeconds = stop.Sub(start).Seconds()
+		}
+		buckets = append(buckets, b)
+	}
+	return buckets
+}
+
+// Backfill rebuilds the hourly rollups of [from, to) from the stored samples.
+// roomIDs limits the rebuild to some rooms; empty rebuilds all of them.
+// from and to are truncated to whole hours. A range starting before
+// BackfillStart is refused, since it would replace kept rollups with ones
+// built from partly dropped samples.
+func (r *Recorder) Backfill(ctx context.Context, from, to time.Time, roomIDs []int) (int64, error) {
+	from, to = from.Truncate(time.Hour), to.Truncate(time.Hour)
+	if !to.After(from) {
+		return 0, errors.New("backfill range is empty")
+	}
+	if start := r.BackfillStart(time.Now()); from.Before(start) {
+		return 0, fmt.Errorf("backfill range starts before %s, the oldest hour whose samples are retained",
+			start.Format(time.RFC3339))
+	}
+	if roomIDs == nil {
+		// A nil slice would be sent as NULL rather than an empty array
+		roomIDs = []int{}
+	}
+
+	tx, err := r.db.Begin(ctx)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback(ctx)
+
+	if _, err := tx.Exec(ctx, `
+		DELETE FROM room_occupancy_hourly
+		WHERE hour >= $1 AND hour < $2
+			AND (cardinality($3::integer[]) = 0 OR room_id = ANY($3::integer[]))`,
+		from, to, roomIDs); err != nil {
+		return 0, err
+	}
+
+	// Each sample starts a segment lasting until the next sample, capped at
+	// the max gap; segments are clipped to the hours they overlap
+	tag, err := tx.Exec(ctx, `
+		WITH samples AS (
+			SELECT room_id, occupied, occupant_count, occupied_confidence, sampled_at,
+				LEAD(sampled_at) OVER (PARTITION BY room_id ORDER BY sampled_at) AS next_at
+			FROM room_occupancy_samples
+			WHERE sampled_at >= $1::timestamp - $4::double precision * interval '1 second'
+				AND sampled_at < $2::timestamp + $4::double precision * interval '1 second'
+				AND (cardinality($3::integer[]) = 0 OR room_id = ANY($3::integer[]))
+		),
+		segments AS (
+			SELECT room_id, occupied, occupant_count, sampled_at AS seg_start,
+				LEAST(COALESCE(next_at, NOW()::timestamp),
+					sampled_at + $4::double precision * interval '1 second') AS seg_end
+			FROM samples
+		),
+		segment_hours AS (
+			SELECT s.room_id, h.hour,
+				CASE WHEN s.occupied THEN EXTRACT(EPOCH FROM
+					LEAST(s.seg_end, h.hour + interval '1 hour') - GREATEST(s.seg_start, h.hour))
+				ELSE 0 END AS occupied_seconds,
+				s.occupant_count
+			FROM segments s
+			CROSS JOIN LATERAL generate_series(
+				date_trunc('hour', s.seg_start), s.seg_end, interval '1 hour') AS h(hour)
+			WHERE s.seg_end > s.seg_start
+				AND h.hour < s.seg_end
+				AND h.hour >= $1 AND h.hour < $2
+		),
+		sample_hours AS (
+			SELECT room_id, date_trunc('hour', sampled_at) AS hour,
+				MAX(occupant_count) AS max_count,
+				SUM(occupied_confidence) AS confidence_sum,
+				COUNT(*) AS sample_count
+			FROM samples
+			WHERE sampled_at >= $1 AND sampled_at < $2
+			GROUP BY 1, 2
+		),
+		hours AS (
+			SELECT room_id, hour, SUM(occupied_seconds) AS occupied_seconds, MAX(occupant_count) AS max_count
+			FROM segment_hours
+			GROUP BY 1, 2
+		)
+		INSERT INTO room_occupancy_hourly (
+			room_id, hour, occupied_seconds, max_occupant_count, confidence_sum, sample_count
+		)
+		SELECT COALESCE(h.room_id, s.room_id), COALESCE(h.hour, s.hour),
+			COALESCE(h.occupied_seconds, 0),
+			GREATEST(COALESCE(h.max_count, 0), COALESCE(s.max_count, 0)),
+			COALESCE(s.confidence_sum, 0), COALESCE(s.sample_count, 0)
+		FROM hours h
+		FULL JOIN sample_hours s ON s.room_id = h.room_id AND s.hour = h.hour`,
+		from, to, roomIDs, r.maxGap.Seconds())
+	if err != nil {
+		return 0, err
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return 0, err
+	}
+	r.log.Info("Rebuilt occupancy rollups", "from", from, "to", to, "rooms", roomIDs, "hours", tag.RowsAffected())
+	return tag.RowsAffected(), nil
+}
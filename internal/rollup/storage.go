@@ -0,0 +1,551 @@
+package rollup
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"regexp"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+
+	"github.com/NieRVoid/emqx-pg-bridge/pkg/logger"
+)
+
+// Storage modes of the history tables
+const (
+	// ModePlain keeps the tables created by the migrations
+	ModePlain = "plain"
+	// ModeAuto uses TimescaleDB when the extension is installed and
+	// partitioned tables otherwise
+	ModeAuto = "auto"
+	// ModePartitioned range-partitions the samples by time
+	ModePartitioned = "partitioned"
+	// ModeTimescale is the resolved mode when TimescaleDB is used
+	ModeTimescale = "timescale"
+)
+
+// storageLockID is the advisory lock key serializing history table
+// conversion between bridge instances starting at the same time
+const storageLockID = 7244022
+
+// StorageOptions controls how the history tables are stored
+type StorageOptions struct {
+	Mode string
+	// ChunkInterval is the time span of a hypertable chunk or partition
+	ChunkInterval time.Duration
+	// CompressAfter is the age after which TimescaleDB compresses samples;
+	// zero disables compression
+	CompressAfter time.Duration
+	// Retention is how long samples are kept; zero keeps them forever.
+	// The hourly rollups are never dropped.
+	Retention time.Duration
+	// PartitionsAhead is the number of future partitions kept ready
+	PartitionsAhead int
+}
+
+// Storage converts the occupancy history tables to TimescaleDB hypertables
+// or partitioned tables and maintains them. The hourly rollups stay a table
+// written by the Recorder, since occupied time is derived from consecutive
+// samples; with TimescaleDB the daily rollups become a continuous aggregate
+// on top of them.
+type Storage struct {
+	db   *pgxpool.Pool
+	opts StorageOptions
+	mode string
+	log  *logger.Logger
+}
+
+// NewStorage creates the history storage manager
+func NewStorage(db *pgxpool.Pool, opts StorageOptions, log *logger.Logger) *Storage {
+	return &Storage{
+		db:   db,
+		opts: opts,
+		mode: ModePlain,
+		log:  log.Component("rollup.storage"),
+	}
+}
+
+// Mode returns the storage mode in use after Setup
+func (s *Storage) Mode() string {
+	return s.mode
+}
+
+// Setup resolves the storage mode and converts the history tables if they
+// are still plain tables. Converting existing samples copies them, which may
+// take a while on large tables.
+func (s *Storage) Setup(ctx context.Context) error {
+	if s.opts.Mode == "" || s.opts.Mode == ModePlain {
+		return nil
+	}
+
+	conn, err := s.db.Acquire(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Release()
+
+	// Session lock, TimescaleDB does not allow some of the statements
+	// below in a transaction block
+	if _, err := conn.Exec(ctx, `SELECT pg_advisory_lock($1)`, storageLockID); err != nil {
+		return err
+	}
+	defer conn.Exec(context.Background(), `SELECT pg_advisory_unlock($1)`, storageLockID)
+
+	layout, err := samplesLayout(ctx, conn.Conn())
+	if err != nil {
+		return err
+	}
+
+	mode := s.opts.Mode
+	if mode == ModeAuto {
+		var timescale bool
+		if err := conn.QueryRow(ctx,
+			`SELECT EXISTS (SELECT 1 FROM pg_extension WHERE extname = 'timescaledb')`,
+		).Scan(&timescale); err != nil {
+			return err
+		}
+		mode = ModePartitioned
+		if timescale {
+			mode = ModeTimescale
+		}
+	}
+
+	// An existing layout wins over the configured mode, converting between
+	// hypertables and partitioned tables is left to the operator
+	if layout != ModePlain && layout != mode {
+		s.log.Warn("History tables already use another storage mode, keeping it",
+			"configured", mode, "current", layout)
+		mode = layout
+	}
+
+	switch mode {
+	case ModeTimescale:
+		err = s.setupTimescale(ctx, conn.Conn(), layout == ModePlain)
+	case ModePartitioned:
+		if layout == ModePlain {
+			err = s.convertPartitioned(ctx, conn.Conn())
+		}
+	default:
+		return fmt.Errorf("invalid history storage mode: %s", mode)
+	}
+	if err != nil {
+		return err
+	}
+
+	s.mode = mode
+	s.log.Info("History storage ready", "mode", mode)
+	return nil
+}
+
+// samplesLayout returns how room_occupancy_samples is stored
+func samplesLayout(ctx context.Context, conn *pgx.Conn) (string, error) {
+	var partitioned, timescale bool
+	err := conn.QueryRow(ctx, `
+		SELECT
+			(SELECT relkind = 'p' FROM pg_class WHERE oid = 'room_occupancy_samples'::regclass),
+			EXISTS (SELECT 1 FROM pg_extension WHERE extname = 'timescaledb')`,
+	).Scan(&partitioned, &timescale)
+	if err != nil {
+		return "", err
+	}
+	if partitioned {
+		return ModePartitioned, nil
+	}
+	if !timescale {
+		return ModePlain, nil
+	}
+
+	var hypertable bool
+	err = conn.QueryRow(ctx, `
+		SELECT EXISTS (
+			SELECT 1 FROM timescaledb_information.hypertables
+			WHERE hypertable_name = 'room_occupancy_samples'
+		)`).Scan(&hypertable)
+	if err != nil {
+		return "", err
+	}
+	if hypertable {
+		return ModeTimescale, nil
+	}
+	return ModePlain, nil
+}
+
+// setupTimescale turns the samples and hourly rollups into hypertables, the
+// daily rollups into a continuous aggregate, and (re)applies the compression
+// and retention policies
+func (s *Storage) setupTimescale(ctx context.Context, conn *pgx.Conn, convert bool) error {
+	if convert {
+		s.log.Info("Converting occupancy history to hypertables")
+
+		// Unique indexes of a hypertable must include the time column
+		if _, err := conn.Exec(ctx, `
+			ALTER TABLE room_occupancy_samples DROP CONSTRAINT room_occupancy_samples_pkey;
+			ALTER TABLE room_occupancy_samples ADD PRIMARY KEY (id, sampled_at)`,
+			pgx.QueryExecModeSimpleProtocol); err != nil {
+			return fmt.Errorf("failed to change samples primary key: %w", err)
+		}
+		if _, err := conn.Exec(ctx, `
+			SELECT create_hypertable('room_occupancy_samples', 'sampled_at',
+				chunk_time_interval => $1::float8 * interval '1 second',
+				migrate_data => true, if_not_exists => true)`,
+			s.opts.ChunkInterval.Seconds()); err != nil {
+			return fmt.Errorf("failed to create samples hypertable: %w", err)
+		}
+		if _, err := conn.Exec(ctx, `
+			ALTER TABLE room_occupancy_samples SET (
+				timescaledb.compress,
+				timescaledb.compress_segmentby = 'room_id',
+				timescaledb.compress_orderby = 'sampled_at DESC'
+			)`); err != nil {
+			return fmt.Errorf("failed to enable samples compression: %w", err)
+		}
+	}
+
+	// Policies are replaced so configuration changes apply on restart
+	if _, err := conn.Exec(ctx, `
+		SELECT remove_compression_policy('room_occupancy_samples', if_exists => true)`); err != nil {
+		return err
+	}
+	if s.opts.CompressAfter > 0 {
+		if _, err := conn.Exec(ctx, `
+			SELECT add_compression_policy('room_occupancy_samples',
+				$1::float8 * interval '1 second')`, s.opts.CompressAfter.Seconds()); err != nil {
+			return fmt.Errorf("failed to add compression policy: %w", err)
+		}
+	}
+	if _, err := conn.Exec(ctx, `
+		SELECT remove_retention_policy('room_occupancy_samples', if_exists => true)`); err != nil {
+		return err
+	}
+	if s.opts.Retention > 0 {
+		if _, err := conn.Exec(ctx, `
+			SELECT add_retention_policy('room_occupancy_samples',
+				$1::float8 * interval '1 second')`, s.opts.Retention.Seconds()); err != nil {
+			return fmt.Errorf("failed to add retention policy: %w", err)
+		}
+	}
+
+	var hourlyConverted, dailyAggregate bool
+	if err := conn.QueryRow(ctx, `
+		SELECT
+			EXISTS (SELECT 1 FROM timescaledb_information.hypertables
+				WHERE hypertable_name = 'room_occupancy_hourly'),
+			EXISTS (SELECT 1 FROM timescaledb_information.continuous_aggregates
+				WHERE view_name = 'room_occupancy_daily')`,
+	).Scan(&hourlyConverted, &dailyAggregate); err != nil {
+		return err
+	}
+
+	if !dailyAggregate {
+		// The plain view depends on the hourly table and is replaced below
+		if _, err := conn.Exec(ctx, `DROP VIEW IF EXISTS room_occupancy_daily`); err != nil {
+			return err
+		}
+	}
+	if !hourlyConverted {
+		if _, err := conn.Exec(ctx, `
+			SELECT create_hypertable('room_occupancy_hourly', 'hour',
+				chunk_time_interval => interval '30 days',
+				migrate_data => true, if_not_exists => true)`); err != nil {
+			return fmt.Errorf("failed to create hourly rollup hypertable: %w", err)
+		}
+	}
+	if !dailyAggregate {
+		// Same columns as the plain view; day is a timestamp bucket here.
+		// Real-time aggregation includes hours not materialized yet.
+		if _, err := conn.Exec(ctx, `
+			CREATE MATERIALIZED VIEW room_occupancy_daily
+			WITH (timescaledb.continuous, timescaledb.materialized_only = false) AS
+			SELECT room_id,
+				time_bucket(interval '1 day', hour)                      AS day,
+				sum(occupied_minutes)                                    AS occupied_minutes,
+				sum(occupied_seconds) / 86400                            AS occupancy_rate,
+				max(max_occupant_count)                                  AS max_occupant_count,
+				sum(confidence_sum)::double precision / nullif(sum(sample_count), 0) AS avg_confidence,
+				sum(sample_count)                                        AS sample_count
+			FROM room_occupancy_hourly
+			GROUP BY room_id, time_bucket(interval '1 day', hour)
+			WITH NO DATA`); err != nil {
+			return fmt.Errorf("failed to create daily continuous aggregate: %w", err)
+		}
+		if _, err := conn.Exec(ctx,
+			`CALL refresh_continuous_aggregate('room_occupancy_daily', NULL, NULL)`); err != nil {
+			return fmt.Errorf("failed to materialize daily rollups: %w", err)
+		}
+	}
+	if _, err := conn.Exec(ctx, `
+		SELECT add_continuous_aggregate_policy('room_occupancy_daily',
+			start_offset => interval '3 days',
+			end_offset => interval '1 hour',
+			schedule_interval => interval '1 hour',
+			if_not_exists => true)`); err != nil {
+		return fmt.Errorf("failed to add continuous aggregate policy: %w", err)
+	}
+
+	return nil
+}
+
+// convertPartitioned replaces the plain samples table with one partitioned by
+// sampled_at and copies the existing samples over
+func (s *Storage) convertPartitioned(ctx context.Context, conn *pgx.Conn) error {
+	s.log.Info("Converting occupancy samples to a partitioned table")
+
+	tx, err := conn.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	// Partition keys must be part of the primary key
+	if _, err := tx.Exec(ctx, `
+		LOCK TABLE room_occupancy_samples IN ACCESS EXCLUSIVE MODE;
+		ALTER TABLE room_occupancy_samples RENAME TO room_occupancy_samples_unpartitioned;
+		ALTER TABLE room_occupancy_samples_unpartitioned
+			RENAME CONSTRAINT room_occupancy_samples_pkey TO room_occupancy_samples_unpartitioned_pkey;
+		ALTER INDEX room_occupancy_samples_room_id_sampled_at_idx
+			RENAME TO room_occupancy_samples_unpartitioned_room_id_sampled_at_idx;
+
+		CREATE TABLE room_occupancy_samples
+		(
+			id                  bigint    default nextval('room_occupancy_samples_id_seq') not null,
+			room_id             integer   not null
+				constraint room_occupancy_samples_room_id_rooms_id_fk
+					references rooms,
+			occupied            boolean   not null,
+			occupant_count      integer   not null,
+			occupied_confidence integer   not null,
+			count_confidence    integer   not null,
+			sampled_at          timestamp not null,
+			primary key (id, sampled_at)
+		) PARTITION BY RANGE (sampled_at);
+
+		CREATE INDEX room_occupancy_samples_room_id_sampled_at_idx
+			ON room_occupancy_samples (room_id, sampled_at);
+
+		-- Catches samples outside the prepared partitions
+		CREATE TABLE room_occupancy_samples_default
+			PARTITION OF room_occupancy_samples DEFAULT;
+
+		ALTER SEQUENCE room_occupancy_samples_id_seq OWNED BY room_occupancy_samples.id`,
+		pgx.QueryExecModeSimpleProtocol); err != nil {
+		return fmt.Errorf("failed to create partitioned samples table: %w", err)
+	}
+
+	var oldest *time.Time
+	if err := tx.QueryRow(ctx,
+		`SELECT min(sampled_at) FROM room_occupancy_samples_unpartitioned`).Scan(&oldest); err != nil {
+		return err
+	}
+	from := time.Now()
+	if oldest != nil {
+		from = *oldest
+	}
+	if err := s.createPartitions(ctx, tx, from); err != nil {
+		return err
+	}
+
+	tag, err := tx.Exec(ctx, `
+		INSERT INTO room_occupancy_samples (
+			id, room_id, occupied, occupant_count, occupied_confidence, count_confidence, sampled_at
+		)
+		SELECT id, room_id, occupied, occupant_count, occupied_confidence, count_confidence, sampled_at
+		FROM room_occupancy_samples_unpartitioned`)
+	if err != nil {
+		return fmt.Errorf("failed to copy samples: %w", err)
+	}
+	if _, err := tx.Exec(ctx, `DROP TABLE room_occupancy_samples_unpartitioned`); err != nil {
+		return err
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return err
+	}
+	s.log.Info("Copied occupancy samples into partitions", "samples", tag.RowsAffected())
+	return nil
+}
+
+// partitionStart aligns t to the partition interval
+func (s *Storage) partitionStart(t time.Time) time.Time {
+	return t.UTC().Truncate(s.opts.ChunkInterval)
+}
+
+// createPartitions makes sure partitions exist from the one holding from up
+// to PartitionsAhead intervals after the current one. Samples of a new
+// partition's range that went to the default partition are moved into it.
+func (s *Storage) createPartitions(ctx context.Context, tx pgx.Tx, from time.Time) error {
+	existing, err := listPartitions(ctx, tx)
+	if err != nil {
+		return err
+	}
+
+	last := s.partitionStart(time.Now()).Add(time.Duration(s.opts.PartitionsAhead) * s.opts.ChunkInterval)
+	for start := s.partitionStart(from); !start.After(last); start = start.Add(s.opts.ChunkInterval) {
+		end := start.Add(s.opts.ChunkInterval)
+		if overlapsAny(existing, start, end) {
+			continue
+		}
+
+		name := "room_occupancy_samples_p" + start.Format("20060102_15")
+		bounds := fmt.Sprintf("FROM ('%s') TO ('%s')",
+			start.Format(time.DateTime), end.Format(time.DateTime))
+
+		if _, err := tx.Exec(ctx, `
+			CREATE TABLE `+name+`
+				(LIKE room_occupancy_samples INCLUDING DEFAULTS INCLUDING CONSTRAINTS)`); err != nil {
+			return fmt.Errorf("failed to create partition %s: %w", name, err)
+		}
+		if _, err := tx.Exec(ctx, `
+			WITH moved AS (
+				DELETE FROM room_occupancy_samples_default
+				WHERE sampled_at >= $1 AND sampled_at < $2
+				RETURNING *
+			)
+			INSERT INTO `+name+` SELECT * FROM moved`, start, end); err != nil {
+			return fmt.Errorf("failed to fill partition %s: %w", name, err)
+		}
+		if _, err := tx.Exec(ctx, `
+			ALTER TABLE room_occupancy_samples ATTACH PARTITION `+name+` FOR VALUES `+bounds); err != nil {
+			return fmt.Errorf("failed to attach partition %s: %w", name, err)
+		}
+		existing = append(existing, partition{name: name, start: start, end: end})
+		s.log.Debug("Created samples partition", "partition", name, "from", start, "to", end)
+	}
+	return nil
+}
+
+// partition is a range partition of the samples table
+type partition struct {
+	name       string
+	start, end time.Time
+}
+
+func overlapsAny(parts []partition, start, end time.Time) bool {
+	for _, p := range parts {
+		if p.start.Before(end) && start.Before(p.end) {
+			return true
+		}
+	}
+	return false
+}
+
+var partitionBound = regexp.MustCompile(`FROM \('([^']+)'\) TO \('([^']+)'\)`)
+
+// listPartitions returns the range partitions of the samples table
+func listPartitions(ctx context.Context, tx pgx.Tx) ([]partition, error) {
+	rows, err := tx.Query(ctx, `
+		SELECT c.relname, pg_get_expr(c.relpartbound, c.oid)
+		FROM pg_inherits i
+		JOIN pg_class c ON c.oid = i.inhrelid
+		WHERE i.inhparent = 'room_occupancy_samples'::regclass`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var parts []partition
+	for rows.Next() {
+		var name, bound string
+		if err := rows.Scan(&name, &bound); err != nil {
+			return nil, err
+		}
+		m := partitionBound.FindStringSubmatch(bound)
+		if m == nil {
+			// The default partition
+			continue
+		}
+		start, err1 := parseBound(m[1])
+		end, err2 := parseBound(m[2])
+		if err := errors.Join(err1, err2); err != nil {
+			return nil, fmt.Errorf("partition %s: %w", name, err)
+		}
+		parts = append(parts, partition{name: name, start: start, end: end})
+	}
+	return parts, rows.Err()
+}
+
+func parseBound(s string) (time.Time, error) {
+	for _, layout := range []string{"2006-01-02 15:04:05.999999", time.DateTime, time.DateOnly} {
+		if t, err := time.Parse(layout, s); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("unexpected partition bound %q", s)
+}
+
+// Run maintains the partitioned samples table until ctx is cancelled:
+// upcoming partitions are created and expired ones dropped. TimescaleDB runs
+// its own policies, so there is nothing to do in the other modes.
+func (s *Storage) Run(ctx context.Context, interval time.Duration) {
+	if s.mode != ModePartitioned {
+		return
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := s.maintainPartitions(ctx); err != nil && ctx.Err() == nil {
+				s.log.Error("Failed to maintain samples partitions", "error", err)
+			}
+		}
+	}
+}
+
+func (s *Storage) maintainPartitions(ctx context.Context) error {
+	tx, err := s.db.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	if _, err := tx.Exec(ctx, `SELECT pg_advisory_xact_lock($1)`, storageLockID); err != nil {
+		return err
+	}
+	if err := s.createPartitions(ctx, tx, time.Now()); err != nil {
+		return err
+	}
+
+	if s.opts.Retention > 0 {
+		parts, err := listPartitions(ctx, tx)
+		if err != nil {
+			return err
+		}
+		cutoff := time.Now().UTC().Add(-s.opts.Retention)
+		for _, p := range parts {
+			if p.end.After(cutoff) {
+				continue
+			}
+			if _, err := tx.Exec(ctx, `DROP TABLE `+pgx.Identifier{p.name}.Sanitize()); err != nil {
+				return fmt.Errorf("failed to drop partition %s: %w", p.name, err)
+			}
+			s.log.Info("Dropped expired samples partition", "partition", p.name, "to", p.end)
+		}
+		if _, err := tx.Exec(ctx, `
+			DELETE FROM room_occupancy_samples_default WHERE sampled_at < $1`, cutoff); err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit(ctx)
+}
+
+// Refresh recomputes the daily continuous aggregate over [from, to) after
+// the hourly rollups were rebuilt. It does nothing unless TimescaleDB is used.
+func (s *Storage) Refresh(ctx context.Context, from, to time.Time) error {
+	if s.mode != ModeTimescale {
+		return nil
+	}
+
+	// The window must cover whole buckets
+	from = from.UTC().Truncate(24 * time.Hour)
+	to = to.UTC().Truncate(24 * time.Hour).Add(24 * time.Hour)
+	_, err := s.db.Exec(ctx, `CALL refresh_continuous_aggregate('room_occupancy_daily', $1::timestamp, $2::timestamp)`,
+		from, to)
+	return err
+}
@@ -0,0 +1,273 @@
+package shadow
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+
+	"github.com/NieRVoid/emqx-pg-bridge/internal/command"
+	"github.com/NieRVoid/emqx-pg-bridge/internal/processor"
+	"github.com/NieRVoid/emqx-pg-bridge/pkg/logger"
+)
+
+// Common errors
+var (
+	ErrDeviceNotFound  = errors.New("device not found")
+	ErrInvalidDesired  = errors.New("desired state must be a JSON object")
+	ErrVersionConflict = errors.New("shadow version does not match")
+)
+
+// Shadow is the desired and reported state of a device. Delta holds the
+// desired values the device has not reported yet.
+type Shadow struct {
+	DeviceID         int             `json:"deviceId"`
+	Desired          json.RawMessage `json:"desired"`
+	Reported         json.RawMessage `json:"reported"`
+	Delta            json.RawMessage `json:"delta"`
+	Version          int64           `json:"version"`
+	DesiredUpdatedAt *time.Time      `json:"desiredUpdatedAt,omitempty"`
+	ReportedAt       *time.Time      `json:"reportedAt,omitempty"`
+	LastSyncAt       *time.Time      `json:"lastSyncAt,omitempty"`
+	SyncAttempts     int             `json:"syncAttempts"`
+}
+
+// InSync reports whether the device has reported every desired value
+func (s *Shadow) InSync() bool {
+	return isEmptyObject(s.Delta)
+}
+
+const shadowColumns = `device_id, desired, reported, delta, version, desired_updated_at,
+	reported_at, last_sync_at, sync_attempts`
+
+// Statements of the shadow service
+var (
+	stmtGet = processor.Statement{Name: "device_shadow.get", SQL: `
+		SELECT ` + shadowColumns + ` FROM device_shadow_view
+		WHERE device_id = $1`}
+
+	stmtDeviceExists = processor.Statement{Name: "device_shadow.device_exists", SQL: `
+		SELECT EXISTS (SELECT 1 FROM devices WHERE id = $1)`}
+
+	stmtLockVersion = processor.Statement{Name: "device_shadow.lock_version", SQL: `
+		SELECT version FROM device_shadow WHERE device_id = $1 FOR UPDATE`}
+
+	stmtMergeDesired = processor.Statement{Name: "device_shadow.merge_desired", SQL: `
+		INSERT INTO device_shadow (device_id, desired, version)
+		VALUES ($1, jsonb_strip_nulls($2::jsonb), 1)
+		ON CONFLICT (device_id) DO UPDATE
+		SET desired = jsonb_strip_nulls(device_shadow.desired || $2::jsonb),
+			version = device_shadow.version + 1,
+			desired_updated_at = NOW(),
+			last_sync_at = NULL,
+			sync_attempts = 0`}
+
+	stmtSynced = processor.Statement{Name: "device_shadow.synced", SQL: `
+		UPDATE device_shadow
+		SET last_sync_at = NOW(), sync_attempts = sync_attempts + 1
+		WHERE device_id = $1
+		RETURNING last_sync_at, sync_attempts`}
+
+	stmtResetConverged = processor.Statement{Name: "device_shadow.reset_converged", SQL: `
+		UPDATE device_shadow s SET sync_attempts = 0
+		FROM device_shadow_view v
+		WHERE v.device_id = s.device_id
+			AND s.sync_attempts > 0
+			AND v.delta = '{}'::jsonb`}
+
+	stmtDiverged = processor.Statement{Name: "device_shadow.diverged", SQL: `
+		SELECT ` + shadowColumns + ` FROM device_shadow_view
+		WHERE delta <> '{}'::jsonb
+			AND sync_attempts < $1
+			AND (last_sync_at IS NULL OR last_sync_at < NOW() - $2::float8 * interval '1 second')
+		ORDER BY last_sync_at NULLS FIRST`}
+)
+
+func scanShadow(row pgx.Row) (*Shadow, error) {
+	var s Shadow
+	err := row.Scan(&s.DeviceID, &s.Desired, &s.Reported, &s.Delta, &s.Version,
+		&s.DesiredUpdatedAt, &s.ReportedAt, &s.LastSyncAt, &s.SyncAttempts)
+	if err != nil {
+		return nil, err
+	}
+	return &s, nil
+}
+
+// Service maintains device shadows and re-sends desired state to devices
+// that have not converged
+type Service struct {
+	db          *pgxpool.Pool
+	commands    *command.Service
+	resyncAfter time.Duration
+	maxAttempts int
+	log         *logger.Logger
+	stmts       *processor.StatementRegistry
+}
+
+// NewService creates a new shadow service. Desired state is delivered through
+// the command service so acknowledgements are tracked the same way.
+func NewService(db *pgxpool.Pool, commands *command.Service, resyncAfter time.Duration, maxAttempts int, log *logger.Logger) *Service {
+	return &Service{
+		db:          db,
+		commands:    commands,
+		resyncAfter: resyncAfter,
+		maxAttempts: maxAttempts,
+		log:         log.Component("shadow"),
+	}
+}
+
+// SetStatements registers the service statements, which are executed
+// prepared once the registry is validated
+func (s *Service) SetStatements(r *processor.StatementRegistry) {
+	r.Register(stmtGet, stmtDeviceExists, stmtLockVersion, stmtMergeDesired, stmtSynced,
+		stmtResetConverged, stmtDiverged)
+	s.stmts = r
+}
+
+// Get returns the shadow of a device. Devices without desired state have an
+// empty desired document and version 0.
+func (s *Service) Get(ctx context.Context, deviceID int) (*Shadow, error) {
+	shadow, err := scanShadow(s.db.QueryRow(ctx, s.stmts.Text(stmtGet), deviceID))
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, ErrDeviceNotFound
+	}
+	return shadow, err
+}
+
+// UpdateDesired merges patch into the desired document of a device; keys set
+// to null are removed. When expectedVersion is set the update only applies to
+// that version. Any resulting delta is sent to the device right away, the
+// returned command is nil when there was nothing to send.
+func (s *Service) UpdateDesired(ctx context.Context, deviceID int, patch json.RawMessage, expectedVersion *int64) (*Shadow, *command.Command, error) {
+	var obj map[string]interface{}
+	if err := json.Unmarshal(patch, &obj); err != nil || obj == nil {
+		return nil, nil, ErrInvalidDesired
+	}
+
+	tx, err := s.db.Begin(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer tx.Rollback(ctx)
+
+	var exists bool
+	if err := tx.QueryRow(ctx, s.stmts.Text(stmtDeviceExists), deviceID).Scan(&exists); err != nil {
+		return nil, nil, err
+	}
+	if !exists {
+		return nil, nil, ErrDeviceNotFound
+	}
+
+	var current int64
+	err = tx.QueryRow(ctx, s.stmts.Text(stmtLockVersion), deviceID).Scan(&current)
+	if err != nil && !errors.Is(err, pgx.ErrNoRows) {
+		return nil, nil, err
+	}
+	if expectedVersion != nil && *expectedVersion != current {
+		return nil, nil, ErrVersionConflict
+	}
+
+	if _, err := tx.Exec(ctx, s.stmts.Text(stmtMergeDesired), deviceID, patch); err != nil {
+		return nil, nil, err
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return nil, nil, err
+	}
+
+	shadow, err := s.Get(ctx, deviceID)
+	if err != nil {
+		return nil, nil, err
+	}
+	s.log.WithContext(ctx).Info("Desired state updated", "deviceId", deviceID, "version", shadow.Version)
+
+	if shadow.InSync() {
+		return shadow, nil, nil
+	}
+	cmd, err := s.sync(ctx, shadow)
+	if err != nil {
+		return nil, nil, err
+	}
+	return shadow, cmd, nil
+}
+
+// sync sends the delta of a shadow as a command and records the attempt
+func (s *Service) sync(ctx context.Context, shadow *Shadow) (*command.Command, error) {
+	cmd, err := s.commands.Create(ctx, shadow.DeviceID, shadow.Delta)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := s.db.QueryRow(ctx, s.stmts.Text(stmtSynced), shadow.DeviceID).
+		Scan(&shadow.LastSyncAt, &shadow.SyncAttempts); err != nil {
+		return nil, err
+	}
+	return cmd, nil
+}
+
+// Run reconciles diverged shadows every interval until ctx is cancelled
+func (s *Service) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := s.Reconcile(ctx); err != nil && ctx.Err() == nil {
+				s.log.Error("Shadow reconciliation failed", "error", err)
+			}
+		}
+	}
+}
+
+// Reconcile re-sends desired state to devices whose reported status still
+// diverges resyncAfter after the last attempt, up to maxAttempts times, and
+// resets the attempt counter of devices that have converged
+func (s *Service) Reconcile(ctx context.Context) error {
+	tag, err := s.db.Exec(ctx, s.stmts.Text(stmtResetConverged))
+	if err != nil {
+		return err
+	}
+	if tag.RowsAffected() > 0 {
+		s.log.Debug("Devices converged to desired state", "count", tag.RowsAffected())
+	}
+
+	rows, err := s.db.Query(ctx, s.stmts.Text(stmtDiverged), s.maxAttempts, s.resyncAfter.Seconds())
+	if err != nil {
+		return err
+	}
+	diverged, err := pgx.CollectRows(rows, func(row pgx.CollectableRow) (*Shadow, error) {
+		return scanShadow(row)
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, shadow := range diverged {
+		if ctx.Err() != nil {
+			return nil
+		}
+		cmd, err := s.sync(ctx, shadow)
+		if err != nil {
+			s.log.Error("Failed to re-send desired state", "deviceId", shadow.DeviceID, "error", err)
+			continue
+		}
+		log := s.log.With("deviceId", shadow.DeviceID, "commandId", cmd.ID, "attempt", shadow.SyncAttempts)
+		if shadow.SyncAttempts >= s.maxAttempts {
+			log.Warn("Re-sent desired state for the last time, device keeps diverging", "delta", shadow.Delta)
+		} else {
+			log.Info("Re-sent desired state to diverged device")
+		}
+	}
+	return nil
+}
+
+func isEmptyObject(raw json.RawMessage) bool {
+	var obj map[string]json.RawMessage
+	return json.Unmarshal(raw, &obj) == nil && len(obj) == 0
+}
@@ -0,0 +1,74 @@
+package sink
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+)
+
+// HTTPSink posts batches as a JSON array to an endpoint
+type HTTPSink struct {
+	name    string
+	url     string
+	headers map[string]string
+	client  *http.Client
+}
+
+// NewHTTPSink creates a sink posting to url with the given extra headers
+func NewHTTPSink(name, url string, headers map[string]string, timeout time.Duration) *HTTPSink {
+	return &HTTPSink{
+		name:    name,
+		url:     url,
+		headers: headers,
+		client:  &http.Client{Timeout: timeout},
+	}
+}
+
+// Name implements Sink
+func (s *HTTPSink) Name() string {
+	return s.name
+}
+
+// Write implements Sink. Client errors other than 408 and 429 are permanent.
+func (s *HTTPSink) Write(ctx context.Context, records []Record) error {
+	body, err := json.Marshal(records)
+	if err != nil {
+		return Permanent(err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.url, bytes.NewReader(body))
+	if err != nil {
+		return Permanent(err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range s.headers {
+		req.Header.Set(k, v)
+	}
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 4096))
+
+	switch {
+	case resp.StatusCode >= 200 && resp.StatusCode <= 299:
+		return nil
+	case resp.StatusCode == http.StatusRequestTimeout, resp.StatusCode == http.StatusTooManyRequests,
+		resp.StatusCode >= 500:
+		return fmt.Errorf("sink endpoint returned %d", resp.StatusCode)
+	default:
+		return Permanent(fmt.Errorf("sink endpoint returned %d", resp.StatusCode))
+	}
+}
+
+// Close implements Sink
+func (s *HTTPSink) Close() error {
+	s.client.CloseIdleConnections()
+	return nil
+}
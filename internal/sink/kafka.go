@@ -0,0 +1,60 @@
+package sink
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+
+	"github.com/segmentio/kafka-go"
+)
+
+// KafkaSink produces records to a topic of a Kafka-compatible log such as
+// Kafka or Redpanda, keyed by room or device so each one stays ordered
+type KafkaSink struct {
+	name   string
+	writer *kafka.Writer
+}
+
+// NewKafkaSink creates a producer for topic on the given brokers
+func NewKafkaSink(name string, brokers []string, topic string, timeout time.Duration) *KafkaSink {
+	return &KafkaSink{
+		name: name,
+		writer: &kafka.Writer{
+			Addr:         kafka.TCP(brokers...),
+			Topic:        topic,
+			Balancer:     &kafka.Hash{},
+			RequiredAcks: kafka.RequireAll,
+			// Batching and retries are done by the dispatcher
+			BatchTimeout: 10 * time.Millisecond,
+			MaxAttempts:  1,
+			WriteTimeout: timeout,
+		},
+	}
+}
+
+// Name implements Sink
+func (s *KafkaSink) Name() string {
+	return s.name
+}
+
+// Write implements Sink
+func (s *KafkaSink) Write(ctx context.Context, records []Record) error {
+	msgs := make([]kafka.Message, 0, len(records))
+	for i := range records {
+		value, err := json.Marshal(&records[i])
+		if err != nil {
+			return Permanent(err)
+		}
+		msgs = append(msgs, kafka.Message{
+			Key:   []byte(records[i].Key()),
+			Value: value,
+			Time:  records[i].ProcessedAt,
+		})
+	}
+	return s.writer.WriteMessages(ctx, msgs...)
+}
+
+// Close implements Sink
+func (s *KafkaSink) Close() error {
+	return s.writer.Close()
+}
@@ -0,0 +1,56 @@
+package sink
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+)
+
+// NDJSONSink appends records as newline-delimited JSON to a file
+type NDJSONSink struct {
+	name string
+	file *os.File
+}
+
+// NewNDJSONSink opens path for appending, creating it and its directory
+func NewNDJSONSink(name, path string) (*NDJSONSink, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	return &NDJSONSink{name: name, file: f}, nil
+}
+
+// Name implements Sink
+func (s *NDJSONSink) Name() string {
+	return s.name
+}
+
+// Write implements Sink. The batch is written with a single write call so
+// lines of concurrent writers to the same file do not interleave. A file
+// write cannot be interrupted, so ctx is only checked before it.
+func (s *NDJSONSink) Write(ctx context.Context, records []Record) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	for i := range records {
+		if err := enc.Encode(&records[i]); err != nil {
+			return Permanent(err)
+		}
+	}
+	_, err := s.file.Write(buf.Bytes())
+	return err
+}
+
+// Close implements Sink
+func (s *NDJSONSink) Close() error {
+	return s.file.Close()
+}
@@ -0,0 +1,80 @@
+package sink
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// PostgresSink copies records into a table of another PostgreSQL database
+type PostgresSink struct {
+	name  string
+	pool  *pgxpool.Pool
+	table pgx.Identifier
+}
+
+// NewPostgresSink connects to url and creates table (optionally schema
+// qualified) if it does not exist
+func NewPostgresSink(ctx context.Context, name, url, table string) (*PostgresSink, error) {
+	pool, err := pgxpool.New(ctx, url)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect sink database: %w", err)
+	}
+
+	s := &PostgresSink{
+		name:  name,
+		pool:  pool,
+		table: pgx.Identifier(strings.Split(table, ".")),
+	}
+
+	if _, err := pool.Exec(ctx, `
+		CREATE TABLE IF NOT EXISTS `+s.table.Sanitize()+` (
+			id           bigserial primary key,
+			device_type  text      not null,
+			source_table text      not null,
+			op           text      not null,
+			room_id      integer,
+			device_id    integer,
+			state        jsonb     not null,
+			processed_at timestamptz not null,
+			received_at  timestamptz default now() not null
+		)`); err != nil {
+		pool.Close()
+		return nil, fmt.Errorf("failed to create sink table: %w", err)
+	}
+	return s, nil
+}
+
+// Name implements Sink
+func (s *PostgresSink) Name() string {
+	return s.name
+}
+
+// Write implements Sink
+func (s *PostgresSink) Write(ctx context.Context, records []Record) error {
+	rows := make([][]interface{}, 0, len(records))
+	for _, r := range records {
+		var roomID, deviceID *int
+		if r.RoomID != 0 {
+			roomID = &r.RoomID
+		}
+		if r.DeviceID != 0 {
+			deviceID = &r.DeviceID
+		}
+		rows = append(rows, []interface{}{r.DeviceType, r.Table, r.Op, roomID, deviceID, r.State, r.ProcessedAt})
+	}
+
+	_, err := s.pool.CopyFrom(ctx, s.table,
+		[]string{"device_type", "source_table", "op", "room_id", "device_id", "state", "processed_at"},
+		pgx.CopyFromRows(rows))
+	return err
+}
+
+// Close implements Sink
+func (s *PostgresSink) Close() error {
+	s.pool.Close()
+	return nil
+}
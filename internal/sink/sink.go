@@ -0,0 +1,360 @@
+package sink
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/NieRVoid/emqx-pg-bridge/internal/backoff"
+	"github.com/NieRVoid/emqx-pg-bridge/internal/models"
+	"github.com/NieRVoid/emqx-pg-bridge/pkg/logger"
+)
+
+// Record is a committed state change forwarded to the sinks
+type Record struct {
+	DeviceType  string          `json:"deviceType"`
+	Table       string          `json:"table"`
+	Op          string          `json:"op"`
+	RoomID      int             `json:"roomId,omitempty"`
+	DeviceID    int             `json:"deviceId,omitempty"`
+	State       json.RawMessage `json:"state"`
+	ProcessedAt time.Time       `json:"processedAt"`
+}
+
+// Key identifies the row a record belongs to, e.g. for partitioning
+func (r *Record) Key() string {
+	if r.Table == "device_status" {
+		return "device/" + strconv.Itoa(r.DeviceID)
+	}
+	return "room/" + strconv.Itoa(r.RoomID)
+}
+
+// Sink is an additional output for processed records. Write receives batches
+// from a single goroutine.
+type Sink interface {
+	Name() string
+	Write(ctx context.Context, records []Record) error
+	Close() error
+}
+
+// permanentError marks a failure that retrying cannot fix
+type permanentError struct {
+	err error
+}
+
+func (e *permanentError) Error() string { return e.err.Error() }
+func (e *permanentError) Unwrap() error { return e.err }
+
+// Permanent wraps err so the batch is not retried
+func Permanent(err error) error {
+	return &permanentError{err: err}
+}
+
+// RetryPolicy controls how often a failed batch is retried
+type RetryPolicy struct {
+	MaxAttempts    int
+	InitialBackoff time.Duration
+	MaxBackoff     time.Duration
+}
+
+// backoff returns the jittered delay before the given retry (1-based)
+func (p RetryPolicy) backoff(retry int) time.Duration {
+	return backoff.Delay(retry, p.InitialBackoff, p.MaxBackoff)
+}
+
+// Options configures how a sink is fed
+type Options struct {
+	// DeviceTypes selects the processors whose records go to the sink;
+	// empty selects all of them
+	DeviceTypes []string
+	QueueSize   int
+	BatchSize   int
+	Retry       RetryPolicy
+	// Timeout bounds every write attempt
+	Timeout time.Duration
+}
+
+// Dispatcher fans records out to the sinks. Every sink has its own queue and
+// goroutine, so a slow or failing sink never delays processing or the
+// other sinks; when its queue is full, records for it are dropped.
+type Dispatcher struct {
+	workers []*worker
+	wg      sync.WaitGroup
+	log     *logger.Logger
+}
+
+// NewDispatcher creates an empty dispatcher
+func NewDispatcher(log *logger.Logger) *Dispatcher {
+	return &Dispatcher{log: log.Component("sink")}
+}
+
+// Add registers a sink. It must be called before Start.
+func (d *Dispatcher) Add(s Sink, opts Options) {
+	w := &worker{
+		sink:      s,
+		types:     make(map[string]bool, len(opts.DeviceTypes)),
+		queue:     make(chan Record, opts.QueueSize),
+		batchSize: opts.BatchSize,
+		retry:     opts.Retry,
+		timeout:   opts.Timeout,
+		log:       d.log.With("sink", s.Name()),
+	}
+	for _, t := range opts.DeviceTypes {
+		w.types[t] = true
+	}
+	d.workers = append(d.workers, w)
+}
+
+// Start runs the sink workers until Close
+func (d *Dispatcher) Start() {
+	for _, w := range d.workers {
+		d.wg.Add(1)
+		go func(w *worker) {
+			defer d.wg.Done()
+			w.run()
+		}(w)
+	}
+}
+
+// Close stops accepting records, waits until the queued ones are written or
+// ctx expires, and closes the sinks. Once ctx expired the records still queued
+// are abandoned; the sinks are only closed after their workers returned, so no
+// write is cut off mid-way.
+func (d *Dispatcher) Close(ctx context.Context) error {
+	for _, w := range d.workers {
+		w.stop(ctx)
+	}
+	d.wg.Wait()
+
+	for _, w := range d.workers {
+		if cerr := w.sink.Close(); cerr != nil {
+			w.log.Error("Failed to close sink", "error", cerr)
+		}
+	}
+	return ctx.Err()
+}
+
+// Abandoned returns the number of records not written because Close ran out
+// of time
+func (d *Dispatcher) Abandoned() int {
+	n := 0
+	for _, w := range d.workers {
+		n += int(w.abandoned.Load())
+	}
+	return n
+}
+
+// Selects reports whether any sink takes records of deviceType
+func (d *Dispatcher) Selects(deviceType string) bool {
+	for _, w := range d.workers {
+		if w.selects(deviceType) {
+			return true
+		}
+	}
+	return false
+}
+
+// Queue is the depth reporting view of a sink queue
+type Queue interface {
+	Name() string
+	Depth() int
+}
+
+// Queues returns the sink queues for depth reporting
+func (d *Dispatcher) Queues() []Queue {
+	queues := make([]Queue, len(d.workers))
+	for i, w := range d.workers {
+		queues[i] = w
+	}
+	return queues
+}
+
+// For returns a listener forwarding the committed writes of the processor
+// handling deviceType
+func (d *Dispatcher) For(deviceType string) *Emitter {
+	return &Emitter{dispatcher: d, deviceType: deviceType}
+}
+
+func (d *Dispatcher) emit(r Record) {
+	for _, w := range d.workers {
+		if w.selects(r.DeviceType) {
+			w.enqueue(r)
+		}
+	}
+}
+
+// Emitter implements processor.RoomStatusListener and
+// processor.DeviceStatusListener for one processor
+type Emitter struct {
+	dispatcher *Dispatcher
+	deviceType string
+}
+
+// RoomStatusChanged implements processor.RoomStatusListener
+func (e *Emitter) RoomStatusChanged(ctx context.Context, change *models.RoomStatusChange) {
+	state, err := json.Marshal(change.New)
+	if err != nil {
+		return
+	}
+	e.dispatcher.emit(Record{
+		DeviceType:  e.deviceType,
+		Table:       "room_status",
+		Op:          op(change.Old == nil),
+		RoomID:      change.New.RoomID,
+		State:       state,
+		ProcessedAt: time.Now(),
+	})
+}
+
+// DeviceStatusChanged implements processor.DeviceStatusListener
+func (e *Emitter) DeviceStatusChanged(ctx context.Context, change *models.DeviceStatusChange) {
+	state, err := json.Marshal(change.New)
+	if err != nil {
+		return
+	}
+	e.dispatcher.emit(Record{
+		DeviceType:  e.deviceType,
+		Table:       "device_status",
+		Op:          op(change.Old == nil),
+		DeviceID:    change.New.DeviceID,
+		State:       state,
+		ProcessedAt: time.Now(),
+	})
+}
+
+// worker feeds one sink from its queue
+type worker struct {
+	sink      Sink
+	types     map[string]bool
+	queue     chan Record
+	batchSize int
+	retry     RetryPolicy
+	timeout   time.Duration
+	log       *logger.Logger
+
+	mu        sync.RWMutex
+	closed    bool
+	dropped   atomic.Int64
+	abandoned atomic.Int64
+	// stopCtx bounds retries once Close has been called
+	stopCtx atomic.Pointer[context.Context]
+}
+
+// Name implements Queue
+func (w *worker) Name() string {
+	return "sink:" + w.sink.Name()
+}
+
+// Depth implements Queue
+func (w *worker) Depth() int {
+	return len(w.queue)
+}
+
+func (w *worker) selects(deviceType string) bool {
+	return len(w.types) == 0 || w.types[deviceType]
+}
+
+func (w *worker) enqueue(r Record) {
+	w.mu.RLock()
+	defer w.mu.RUnlock()
+	if w.closed {
+		return
+	}
+
+	select {
+	case w.queue <- r:
+	default:
+		n := w.dropped.Add(1)
+		w.log.Sampled("sink.drop").Warn("Sink queue full, dropping record", "dropped", n)
+	}
+}
+
+func (w *worker) stop(ctx context.Context) {
+	w.stopCtx.Store(&ctx)
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if !w.closed {
+		w.closed = true
+		close(w.queue)
+	}
+}
+
+func (w *worker) run() {
+	batch := make([]Record, 0, w.batchSize)
+	for r := range w.queue {
+		batch = append(batch[:0], r)
+		// Take whatever else is queued right now, up to the batch size
+	fill:
+		for len(batch) < w.batchSize {
+			select {
+			case r, ok := <-w.queue:
+				if !ok {
+					break fill
+				}
+				batch = append(batch, r)
+			default:
+				break fill
+			}
+		}
+		w.write(batch)
+	}
+}
+
+// write delivers a batch according to the retry policy
+func (w *worker) write(batch []Record) {
+	for attempt := 1; ; attempt++ {
+		ctx := context.Background()
+		if stopCtx := w.stopCtx.Load(); stopCtx != nil {
+			ctx = *stopCtx
+		}
+
+		// Past the Close deadline the batch is left, not written
+		if ctx.Err() != nil {
+			w.abandoned.Add(int64(len(batch)))
+			return
+		}
+
+		err := w.writeAttempt(ctx, batch)
+		if err == nil {
+			return
+		}
+
+		var perm *permanentError
+		if errors.As(err, &perm) || attempt >= w.retry.MaxAttempts || ctx.Err() != nil {
+			w.log.Error("Dropping records the sink failed to write",
+				"records", len(batch), "attempts", attempt, "error", err)
+			return
+		}
+
+		delay := w.retry.backoff(attempt)
+		w.log.Sampled("sink.retry").Warn("Sink write failed, retrying",
+			"records", len(batch), "attempt", attempt, "retryIn", delay, "error", err)
+
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+		}
+	}
+}
+
+// writeAttempt makes one write bounded by the sink timeout
+func (w *worker) writeAttempt(ctx context.Context, batch []Record) error {
+	if w.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, w.timeout)
+		defer cancel()
+	}
+	return w.sink.Write(ctx, batch)
+}
+
+func op(inserted bool) string {
+	if inserted {
+		return "insert"
+	}
+	return "update"
+}
@@ -0,0 +1,290 @@
+package spool
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/NieRVoid/emqx-pg-bridge/internal/models"
+	"github.com/NieRVoid/emqx-pg-bridge/pkg/logger"
+)
+
+// Entry is a webhook that could not be processed and was kept on disk
+type Entry struct {
+	ID string `json:"id"`
+	// Tenant is the tenant the webhook was resolved to, if any
+	Tenant     string             `json:"tenant,omitempty"`
+	DeviceType string             `json:"deviceType"`
+	ReceivedAt time.Time          `json:"receivedAt"`
+	Attempts   int                `json:"attempts"`
+	LastError  string             `json:"lastError"`
+	Data       models.WebhookData `json:"data"`
+}
+
+// DispatchFunc re-processes a spooled webhook
+type DispatchFunc func(ctx context.Context, deviceType string, data *models.WebhookData) error
+
+// ReplayResult summarizes a replay run
+type ReplayResult struct {
+	Replayed int `json:"replayed"`
+	Failed   int `json:"failed"`
+	// Quarantined entries failed for good and were moved out of the spool
+	Quarantined int `json:"quarantined"`
+	Remaining   int `json:"remaining"`
+}
+
+// quarantineDir is the subdirectory entries that can never be replayed are
+// moved to, for inspection
+const quarantineDir = "quarantine"
+
+// Spool is a directory backed store of webhooks, one JSON file per entry so
+// that entries survive restarts and can be removed individually on replay
+type Spool struct {
+	name     string
+	dir      string
+	seq      atomic.Uint64
+	replayMu sync.Mutex
+	log      *logger.Logger
+
+	// permanent and maxAttempts select the failed entries to quarantine
+	permanent   func(error) bool
+	maxAttempts int
+	// receivedAt marks the dispatch context with the receive time of an entry
+	receivedAt func(ctx context.Context, t time.Time) context.Context
+}
+
+// NewSpool creates the spool directory if needed
+func NewSpool(name, dir string, log *logger.Logger) (*Spool, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, fmt.Errorf("failed to create spool directory: %w", err)
+	}
+
+	return &Spool{
+		name: name,
+		dir:  dir,
+		log:  log.Component("spool." + name),
+	}, nil
+}
+
+// SetQuarantine moves entries whose replay fails with an error permanent
+// reports, or that failed maxAttempts times, to the quarantine subdirectory
+// instead of replaying them again; maxAttempts 0 keeps them. It must be
+// called before the spool is replayed.
+func (s *Spool) SetQuarantine(permanent func(error) bool, maxAttempts int) {
+	s.permanent = permanent
+	s.maxAttempts = maxAttempts
+}
+
+// SetReceivedAt hands the receive time of every replayed entry to its
+// dispatch through the context fn returns, e.g. so that state written since
+// is not overwritten. It must be called before the spool is replayed.
+func (s *Spool) SetReceivedAt(fn func(ctx context.Context, t time.Time) context.Context) {
+	s.receivedAt = fn
+}
+
+// Name returns the spool name
+func (s *Spool) Name() string {
+	return s.name
+}
+
+// Put writes a webhook of a tenant, empty without tenants, to the spool
+func (s *Spool) Put(tenant, deviceType string, data *models.WebhookData, cause error) error {
+	entry := Entry{
+		ID:         fmt.Sprintf("%020d-%06d", time.Now().UnixNano(), s.seq.Add(1)%1000000),
+		Tenant:     tenant,
+		DeviceType: deviceType,
+		ReceivedAt: time.Now(),
+		Attempts:   1,
+		Data:       *data,
+	}
+	if cause != nil {
+		entry.LastError = cause.Error()
+	}
+
+	if err := s.write(&entry); err != nil {
+		return err
+	}
+
+	s.log.Info("Spooled webhook", "id", entry.ID, "tenant", tenant, "deviceType", deviceType, "error", entry.LastError)
+	return nil
+}
+
+// Depth returns the number of entries waiting in the spool
+func (s *Spool) Depth() int {
+	files, err := s.files()
+	if err != nil {
+		return 0
+	}
+	return len(files)
+}
+
+// Replay dispatches every entry in arrival order. Entries that succeed are
+// removed; failures stay with their attempt count and last error updated,
+// unless they are quarantined.
+func (s *Spool) Replay(ctx context.Context, dispatch DispatchFunc) (ReplayResult, error) {
+	return s.replay(ctx, nil, dispatch)
+}
+
+// ReplayTenants replays the entries of the given tenants only, e.g. those
+// on a database that became available again; the others count as remaining
+func (s *Spool) ReplayTenants(ctx context.Context, tenants []string, dispatch DispatchFunc) (ReplayResult, error) {
+	match := make(map[string]bool, len(tenants))
+	for _, t := range tenants {
+		match[t] = true
+	}
+	return s.replay(ctx, match, dispatch)
+}
+
+// replay dispatches the entries of the tenants in match, or all of them if
+// match is nil
+func (s *Spool) replay(ctx context.Context, match map[string]bool, dispatch DispatchFunc) (ReplayResult, error) {
+	s.replayMu.Lock()
+	defer s.replayMu.Unlock()
+
+	var result ReplayResult
+	files, err := s.files()
+	if err != nil {
+		return result, err
+	}
+
+	for i, file := range files {
+		if err := ctx.Err(); err != nil {
+			result.Remaining += len(files) - i
+			return result, err
+		}
+
+		entry, err := s.read(file)
+		if err != nil {
+			s.log.Error("Failed to read spool entry", "file", file, "error", err)
+			result.Failed++
+			result.Remaining++
+			continue
+		}
+
+		if match != nil && !match[entry.Tenant] {
+			result.Remaining++
+			continue
+		}
+
+		dctx := ctx
+		if s.receivedAt != nil {
+			dctx = s.receivedAt(ctx, entry.ReceivedAt)
+		}
+		if err := dispatch(dctx, entry.DeviceType, &entry.Data); err != nil {
+			entry.Attempts++
+			entry.LastError = err.Error()
+			if s.quarantines(entry, err) {
+				qerr := s.quarantine(file, entry)
+				if qerr == nil {
+					result.Quarantined++
+					continue
+				}
+				s.log.Error("Failed to quarantine spool entry", "id", entry.ID, "error", qerr)
+			}
+			if werr := s.write(entry); werr != nil {
+				s.log.Error("Failed to update spool entry", "id", entry.ID, "error", werr)
+			}
+			result.Failed++
+			result.Remaining++
+			continue
+		}
+
+		if err := os.Remove(file); err != nil && !errors.Is(err, os.ErrNotExist) {
+			s.log.Error("Failed to remove replayed spool entry", "id", entry.ID, "error", err)
+		}
+		result.Replayed++
+	}
+
+	s.log.Info("Replayed spool",
+		"replayed", result.Replayed,
+		"failed", result.Failed,
+		"quarantined", result.Quarantined,
+		"remaining", result.Remaining)
+
+	return result, nil
+}
+
+// quarantines reports whether a failed entry is moved out of the spool
+func (s *Spool) quarantines(entry *Entry, err error) bool {
+	if s.permanent != nil && s.permanent(err) {
+		return true
+	}
+	return s.maxAttempts > 0 && entry.Attempts >= s.maxAttempts
+}
+
+// quarantine moves a failed entry to the quarantine directory
+func (s *Spool) quarantine(file string, entry *Entry) error {
+	dir := filepath.Join(s.dir, quarantineDir)
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return err
+	}
+	if err := writeEntry(dir, entry); err != nil {
+		return err
+	}
+	if err := os.Remove(file); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	s.log.Warn("Quarantined spool entry", "id", entry.ID, "deviceType", entry.DeviceType,
+		"attempts", entry.Attempts, "error", entry.LastError)
+	return nil
+}
+
+func (s *Spool) files() ([]string, error) {
+	dirEntries, err := os.ReadDir(s.dir)
+	if err != nil {
+		return nil, err
+	}
+
+	files := make([]string, 0, len(dirEntries))
+	for _, e := range dirEntries {
+		if !e.IsDir() && strings.HasSuffix(e.Name(), ".json") {
+			files = append(files, filepath.Join(s.dir, e.Name()))
+		}
+	}
+	sort.Strings(files)
+	return files, nil
+}
+
+func (s *Spool) read(file string) (*Entry, error) {
+	raw, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	var entry Entry
+	if err := json.Unmarshal(raw, &entry); err != nil {
+		return nil, err
+	}
+	return &entry, nil
+}
+
+// write stores the entry in the spool
+func (s *Spool) write(entry *Entry) error {
+	return writeEntry(s.dir, entry)
+}
+
+// writeEntry stores the entry in dir atomically via a temp file and rename
+func writeEntry(dir string, entry *Entry) error {
+	raw, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+
+	final := filepath.Join(dir, entry.ID+".json")
+	tmp := final + ".tmp"
+	if err := os.WriteFile(tmp, raw, 0o644); err != nil {
+		return fmt.Errorf("failed to write spool entry: %w", err)
+	}
+	if err := os.Rename(tmp, final); err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("failed to write spool entry: %w", err)
+	}
+	return nil
+}
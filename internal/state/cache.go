@@ -0,0 +1,356 @@
+package state
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+
+	"github.com/NieRVoid/emqx-pg-bridge/internal/models"
+	"github.com/NieRVoid/emqx-pg-bridge/pkg/logger"
+)
+
+// ErrNotFound is returned when a room or device is not known
+var ErrNotFound = errors.New("not found")
+
+// RoomEntry is a cached room with the version used for its ETag
+type RoomEntry struct {
+	Status  models.RoomStatus
+	Version uint64
+}
+
+// DeviceEntry is a cached device with the version used for its ETag
+type DeviceEntry struct {
+	Status  models.DeviceStatus
+	Version uint64
+}
+
+// Cache keeps the current room and device state in memory. It is loaded from
+// PostgreSQL at startup, updated by the processors after every committed write
+// and periodically refreshed to pick up changes made outside the bridge.
+type Cache struct {
+	db  *pgxpool.Pool
+	log *logger.Logger
+
+	mu      sync.RWMutex
+	rooms   map[int]*RoomEntry
+	devices map[int]*DeviceEntry
+	version uint64
+}
+
+// NewCache creates an empty cache
+func NewCache(db *pgxpool.Pool, log *logger.Logger) *Cache {
+	return &Cache{
+		db:      db,
+		log:     log.Component("state"),
+		rooms:   make(map[int]*RoomEntry),
+		devices: make(map[int]*DeviceEntry),
+	}
+}
+
+const roomsQuery = `
+	SELECT r.id, r.number, r.name, r.occupancy,
+		COALESCE(s.occupied, false), COALESCE(s.occupant_count, 0),
+		COALESCE(s.count_confidence, 0), COALESCE(s.occupied_confidence, 0),
+		COALESCE(s.count_source, 'unknown'), s.last_source_change,
+		s.temperature, s.humidity, s.air_quality, s.light_level, s.noise_level,
+		s.metadata, s.updated_at
+	FROM rooms r
+	LEFT JOIN room_status s ON s.room_id = r.id`
+
+// devicesQuery reads last_reported_at with the session time zone it was
+// written in, so that staleness compares it with the local clock
+const devicesQuery = `
+	SELECT d.id, d.uuid::text, d.name, d.type, d.room_id,
+		s.status, s.updated_at, s.last_reported_at::timestamptz
+	FROM devices d
+	LEFT JOIN device_status s ON s.device_id = d.id`
+
+func scanRoom(row pgx.Row) (*models.RoomStatus, error) {
+	var rs models.RoomStatus
+	err := row.Scan(&rs.RoomID, &rs.Number, &rs.Name, &rs.Occupancy,
+		&rs.Occupied, &rs.OccupantCount, &rs.CountConfidence, &rs.OccupiedConfidence,
+		&rs.CountSource, &rs.LastSourceChange, &rs.Temperature, &rs.Humidity,
+		&rs.AirQuality, &rs.LightLevel, &rs.NoiseLevel, &rs.Metadata, &rs.UpdatedAt)
+	if err != nil {
+		return nil, err
+	}
+	return &rs, nil
+}
+
+func scanDevice(row pgx.Row) (*models.DeviceStatus, error) {
+	var ds models.DeviceStatus
+	err := row.Scan(&ds.DeviceID, &ds.UUID, &ds.Name, &ds.Type, &ds.RoomID,
+		&ds.Status, &ds.UpdatedAt, &ds.LastReportedAt)
+	if err != nil {
+		return nil, err
+	}
+	return &ds, nil
+}
+
+// Load replaces the cache contents with the current database state. Entries
+// whose content did not change keep their version and therefore their ETag.
+func (c *Cache) Load(ctx context.Context) error {
+	rows, err := c.db.Query(ctx, roomsQuery)
+	if err != nil {
+		return err
+	}
+	rooms, err := pgx.CollectRows(rows, func(row pgx.CollectableRow) (*models.RoomStatus, error) {
+		return scanRoom(row)
+	})
+	if err != nil {
+		return err
+	}
+
+	rows, err = c.db.Query(ctx, devicesQuery)
+	if err != nil {
+		return err
+	}
+	devices, err := pgx.CollectRows(rows, func(row pgx.CollectableRow) (*models.DeviceStatus, error) {
+		return scanDevice(row)
+	})
+	if err != nil {
+		return err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	newRooms := make(map[int]*RoomEntry, len(rooms))
+	for _, rs := range rooms {
+		if old, ok := c.rooms[rs.RoomID]; ok && (roomEqual(&old.Status, rs) || newer(old.Status.UpdatedAt, rs.UpdatedAt)) {
+			newRooms[rs.RoomID] = old
+			continue
+		}
+		c.version++
+		newRooms[rs.RoomID] = &RoomEntry{Status: *rs, Version: c.version}
+	}
+	newDevices := make(map[int]*DeviceEntry, len(devices))
+	for _, ds := range devices {
+		if old, ok := c.devices[ds.DeviceID]; ok && (deviceEqual(&old.Status, ds) || newer(old.Status.UpdatedAt, ds.UpdatedAt)) {
+			newDevices[ds.DeviceID] = old
+			continue
+		}
+		c.version++
+		newDevices[ds.DeviceID] = &DeviceEntry{Status: *ds, Version: c.version}
+	}
+	if len(newRooms) != len(c.rooms) || len(newDevices) != len(c.devices) {
+		c.version++
+	}
+	c.rooms = newRooms
+	c.devices = newDevices
+
+	c.log.Debug("Loaded state cache", "rooms", len(newRooms), "devices", len(newDevices))
+	return nil
+}
+
+// Run refreshes the cache every interval until ctx is cancelled
+func (c *Cache) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := c.Load(ctx); err != nil && ctx.Err() == nil {
+				c.log.Error("Failed to refresh state cache", "error", err)
+			}
+		}
+	}
+}
+
+// RoomStatusChanged implements processor.RoomStatusListener
+func (c *Cache) RoomStatusChanged(ctx context.Context, change *models.RoomStatusChange) {
+	rs := *change.New
+
+	c.mu.Lock()
+	old, ok := c.rooms[rs.RoomID]
+	if !ok {
+		c.mu.Unlock()
+		c.loadRoom(ctx, rs.RoomID)
+		return
+	}
+	defer c.mu.Unlock()
+
+	// Concurrent writers may report their changes out of order
+	if newer(old.Status.UpdatedAt, rs.UpdatedAt) {
+		return
+	}
+
+	// The processors only know room_status; keep the rooms columns
+	rs.Number = old.Status.Number
+	rs.Name = old.Status.Name
+	rs.Occupancy = old.Status.Occupancy
+
+	c.version++
+	c.rooms[rs.RoomID] = &RoomEntry{Status: rs, Version: c.version}
+}
+
+// RoomOccupancyChanged implements occupancy.Listener
+func (c *Cache) RoomOccupancyChanged(ctx context.Context, t *models.OccupancyTransition) {
+	c.mu.Lock()
+	entry, ok := c.rooms[t.RoomID]
+	if !ok {
+		c.mu.Unlock()
+		c.loadRoom(ctx, t.RoomID)
+		return
+	}
+	defer c.mu.Unlock()
+
+	rs := entry.Status
+	rs.Occupancy = t.To
+	c.version++
+	c.rooms[t.RoomID] = &RoomEntry{Status: rs, Version: c.version}
+}
+
+// DeviceStatusChanged implements processor.DeviceStatusListener
+func (c *Cache) DeviceStatusChanged(ctx context.Context, change *models.DeviceStatusChange) {
+	ds := *change.New
+
+	c.mu.Lock()
+	old, ok := c.devices[ds.DeviceID]
+	if !ok {
+		c.mu.Unlock()
+		c.loadDevice(ctx, ds.DeviceID)
+		return
+	}
+	defer c.mu.Unlock()
+
+	if newer(old.Status.UpdatedAt, ds.UpdatedAt) {
+		return
+	}
+
+	ds.UUID = old.Status.UUID
+	ds.Name = old.Status.Name
+	ds.Type = old.Status.Type
+	ds.RoomID = old.Status.RoomID
+
+	c.version++
+	c.devices[ds.DeviceID] = &DeviceEntry{Status: ds, Version: c.version}
+}
+
+// loadRoom fetches a room the cache has not seen yet, e.g. one created after
+// the last refresh. The query runs without c.mu held so cached reads go on;
+// the result is not installed over a newer state cached meanwhile.
+func (c *Cache) loadRoom(ctx context.Context, roomID int) {
+	rs, err := scanRoom(c.db.QueryRow(ctx, roomsQuery+` WHERE r.id = $1`, roomID))
+	if err != nil {
+		c.log.Error("Failed to load room into state cache", "roomId", roomID, "error", err)
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if old, ok := c.rooms[roomID]; ok && (roomEqual(&old.Status, rs) || !newer(rs.UpdatedAt, old.Status.UpdatedAt)) {
+		return
+	}
+	c.version++
+	c.rooms[roomID] = &RoomEntry{Status: *rs, Version: c.version}
+}
+
+// loadDevice fetches a device the cache has not seen yet, like loadRoom
+func (c *Cache) loadDevice(ctx context.Context, deviceID int) {
+	ds, err := scanDevice(c.db.QueryRow(ctx, devicesQuery+` WHERE d.id = $1`, deviceID))
+	if err != nil {
+		c.log.Error("Failed to load device into state cache", "deviceId", deviceID, "error", err)
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if old, ok := c.devices[deviceID]; ok && (deviceEqual(&old.Status, ds) || !newer(ds.UpdatedAt, old.Status.UpdatedAt)) {
+		return
+	}
+	c.version++
+	c.devices[deviceID] = &DeviceEntry{Status: *ds, Version: c.version}
+}
+
+// Version returns the cache-wide version, which changes on every update
+func (c *Cache) Version() uint64 {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.version
+}
+
+// Room returns a cached room
+func (c *Cache) Room(roomID int) (RoomEntry, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	e, ok := c.rooms[roomID]
+	if !ok {
+		return RoomEntry{}, ErrNotFound
+	}
+	return *e, nil
+}
+
+// Device returns a cached device
+func (c *Cache) Device(deviceID int) (DeviceEntry, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	e, ok := c.devices[deviceID]
+	if !ok {
+		return DeviceEntry{}, ErrNotFound
+	}
+	return *e, nil
+}
+
+// RoomFilter selects rooms in a listing
+type RoomFilter struct {
+	Occupied *bool
+}
+
+// Rooms returns the rooms matching the filter ordered by id, together with the
+// cache version they were read at
+func (c *Cache) Rooms(f RoomFilter) ([]models.RoomStatus, uint64) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	rooms := make([]models.RoomStatus, 0, len(c.rooms))
+	for _, e := range c.rooms {
+		if f.Occupied != nil && e.Status.Occupied != *f.Occupied {
+			continue
+		}
+		rooms = append(rooms, e.Status)
+	}
+	sort.Slice(rooms, func(i, j int) bool { return rooms[i].RoomID < rooms[j].RoomID })
+	return rooms, c.version
+}
+
+// DeviceFilter selects devices in a listing
+type DeviceFilter struct {
+	RoomID *int
+	Type   string
+	// StaleBefore keeps only devices that have not reported since this time
+	StaleBefore *time.Time
+}
+
+// Devices returns the devices matching the filter ordered by id, together with
+// the cache version they were read at
+func (c *Cache) Devices(f DeviceFilter) ([]models.DeviceStatus, uint64) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	devices := make([]models.DeviceStatus, 0, len(c.devices))
+	for _, e := range c.devices {
+		if f.RoomID != nil && e.Status.RoomID != *f.RoomID {
+			continue
+		}
+		if f.Type != "" && e.Status.Type != f.Type {
+			continue
+		}
+		if f.StaleBefore != nil && e.Status.LastReportedAt != nil && !e.Status.LastReportedAt.Before(*f.StaleBefore) {
+			continue
+		}
+		devices = append(devices, e.Status)
+	}
+	sort.Slice(devices, func(i, j int) bool { return devices[i].DeviceID < devices[j].DeviceID })
+	return devices, c.version
+}
@@ -0,0 +1,40 @@
+package state
+
+import (
+	"bytes"
+	"encoding/json"
+	"reflect"
+	"time"
+
+	"github.com/NieRVoid/emqx-pg-bridge/internal/models"
+)
+
+// newer reports whether a is strictly later than b. The cache uses it to
+// keep entries written by a processor while a refresh query was in flight.
+func newer(a, b *time.Time) bool {
+	return a != nil && b != nil && a.After(*b)
+}
+
+func roomEqual(a, b *models.RoomStatus) bool {
+	ac, bc := *a, *b
+	ac.Metadata, bc.Metadata = nil, nil
+	return reflect.DeepEqual(ac, bc) && jsonEqual(a.Metadata, b.Metadata)
+}
+
+func deviceEqual(a, b *models.DeviceStatus) bool {
+	ac, bc := *a, *b
+	ac.Status, bc.Status = nil, nil
+	return reflect.DeepEqual(ac, bc) && jsonEqual(a.Status, b.Status)
+}
+
+// jsonEqual compares two JSON documents semantically
+func jsonEqual(a, b json.RawMessage) bool {
+	if bytes.Equal(a, b) {
+		return true
+	}
+	var av, bv interface{}
+	if json.Unmarshal(a, &av) != nil || json.Unmarshal(b, &bv) != nil {
+		return false
+	}
+	return reflect.DeepEqual(av, bv)
+}
@@ -0,0 +1,234 @@
+package stream
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/gorilla/websocket"
+
+	"github.com/NieRVoid/emqx-pg-bridge/pkg/logger"
+)
+
+// Handler serves the occupancy stream over SSE and WebSocket
+type Handler struct {
+	hub       *Hub
+	heartbeat time.Duration
+	upgrader  websocket.Upgrader
+	log       *logger.Logger
+}
+
+// NewHandler creates a new stream handler
+func NewHandler(hub *Hub, heartbeat time.Duration, allowedOrigins []string, log *logger.Logger) *Handler {
+	h := &Handler{
+		hub:       hub,
+		heartbeat: heartbeat,
+		log:       log.Component("stream"),
+	}
+	h.upgrader = websocket.Upgrader{
+		CheckOrigin: func(r *http.Request) bool {
+			return originAllowed(r, allowedOrigins)
+		},
+	}
+	return h
+}
+
+// Routes registers the stream endpoints. They must be mounted outside any
+// request timeout middleware since the connections are long-lived.
+func (h *Handler) Routes(r chi.Router) {
+	r.Get("/stream/rooms", h.ServeSSE)
+	r.Get("/stream/rooms/ws", h.ServeWebSocket)
+}
+
+// ServeSSE handles GET /stream/rooms?room_id=1,2 as Server-Sent Events.
+// Clients resume with the standard Last-Event-ID header or ?resume=<token>.
+func (h *Handler) ServeSSE(w http.ResponseWriter, r *http.Request) {
+	rooms, err := parseRooms(r.URL.Query()["room_id"])
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	resume := r.Header.Get("Last-Event-ID")
+	if resume == "" {
+		resume = r.URL.Query().Get("resume")
+	}
+
+	// The server's write timeout would otherwise cut the stream off
+	rc := http.NewResponseController(w)
+	if err := rc.SetWriteDeadline(time.Time{}); err != nil {
+		h.log.Debug("Could not clear write deadline for SSE stream", "error", err)
+	}
+
+	sub := h.hub.Subscribe(rooms, resume)
+	defer sub.Close()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+
+	if sub.Missed {
+		fmt.Fprint(w, "event: reset\ndata: {\"reason\":\"resume token expired\"}\n\n")
+	}
+	if err := rc.Flush(); err != nil {
+		return
+	}
+
+	log := h.log.With("remoteAddr", r.RemoteAddr, "transport", "sse")
+	log.Debug("Stream client connected", "rooms", rooms, "resume", resume)
+	defer log.Debug("Stream client disconnected")
+
+	ticker := time.NewTicker(h.heartbeat)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-ticker.C:
+			if _, err := fmt.Fprint(w, ": heartbeat\n\n"); err != nil {
+				return
+			}
+		case event, ok := <-sub.Events:
+			if !ok {
+				return
+			}
+			data, err := json.Marshal(event)
+			if err != nil {
+				log.Error("Failed to encode stream event", "error", err)
+				continue
+			}
+			if _, err := fmt.Fprintf(w, "id: %s\nevent: occupancy\ndata: %s\n\n", event.Token, data); err != nil {
+				return
+			}
+		}
+		if err := rc.Flush(); err != nil {
+			return
+		}
+	}
+}
+
+// wsMessage is the envelope of WebSocket frames
+type wsMessage struct {
+	Type   string          `json:"type"`
+	Event  *OccupancyEvent `json:"event,omitempty"`
+	Reason string          `json:"reason,omitempty"`
+}
+
+// ServeWebSocket handles GET /stream/rooms/ws?room_id=1,2&resume=<token>
+func (h *Handler) ServeWebSocket(w http.ResponseWriter, r *http.Request) {
+	rooms, err := parseRooms(r.URL.Query()["room_id"])
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	resume := r.URL.Query().Get("resume")
+
+	conn, err := h.upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		// Upgrade has already written the error response
+		h.log.Debug("WebSocket upgrade failed", "error", err)
+		return
+	}
+	defer conn.Close()
+
+	sub := h.hub.Subscribe(rooms, resume)
+	defer sub.Close()
+
+	log := h.log.With("remoteAddr", r.RemoteAddr, "transport", "websocket")
+	log.Debug("Stream client connected", "rooms", rooms, "resume", resume)
+	defer log.Debug("Stream client disconnected")
+
+	// Read in the background only to notice close frames and dead peers
+	closed := make(chan struct{})
+	conn.SetReadLimit(1024)
+	conn.SetReadDeadline(time.Now().Add(2 * h.heartbeat))
+	conn.SetPongHandler(func(string) error {
+		return conn.SetReadDeadline(time.Now().Add(2 * h.heartbeat))
+	})
+	go func() {
+		defer close(closed)
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}()
+
+	write := func(msg wsMessage) error {
+		conn.SetWriteDeadline(time.Now().Add(h.heartbeat))
+		return conn.WriteJSON(msg)
+	}
+
+	if sub.Missed {
+		if err := write(wsMessage{Type: "reset", Reason: "resume token expired"}); err != nil {
+			return
+		}
+	}
+
+	ticker := time.NewTicker(h.heartbeat)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-closed:
+			return
+		case <-r.Context().Done():
+			return
+		case <-ticker.C:
+			deadline := time.Now().Add(h.heartbeat)
+			if err := conn.WriteControl(websocket.PingMessage, nil, deadline); err != nil {
+				return
+			}
+		case event, ok := <-sub.Events:
+			if !ok {
+				conn.WriteControl(websocket.CloseMessage,
+					websocket.FormatCloseMessage(websocket.CloseGoingAway, "stream closed"),
+					time.Now().Add(time.Second))
+				return
+			}
+			if err := write(wsMessage{Type: "occupancy", Event: &event}); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// parseRooms accepts repeated and comma separated room_id parameters
+func parseRooms(values []string) ([]int, error) {
+	var rooms []int
+	for _, v := range values {
+		for _, part := range strings.Split(v, ",") {
+			part = strings.TrimSpace(part)
+			if part == "" {
+				continue
+			}
+			id, err := strconv.Atoi(part)
+			if err != nil {
+				return nil, fmt.Errorf("invalid room_id: %s", part)
+			}
+			rooms = append(rooms, id)
+		}
+	}
+	return rooms, nil
+}
+
+// originAllowed permits same-origin requests, requests without an Origin
+// header (non-browser clients) and the configured origins ("*" for any)
+func originAllowed(r *http.Request, allowed []string) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" || origin == "http://"+r.Host || origin == "https://"+r.Host {
+		return true
+	}
+	for _, a := range allowed {
+		if a == "*" || strings.EqualFold(a, origin) {
+			return true
+		}
+	}
+	return false
+}
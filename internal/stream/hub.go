@@ -0,0 +1,239 @@
+package stream
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/NieRVoid/emqx-pg-bridge/internal/models"
+	"github.com/NieRVoid/emqx-pg-bridge/pkg/logger"
+)
+
+// OccupancyEvent is pushed to clients whenever a room's occupied flag or
+// occupant count changes
+type OccupancyEvent struct {
+	Token             string    `json:"token"`
+	RoomID            int       `json:"roomId"`
+	Occupied          bool      `json:"occupied"`
+	OccupantCount     int       `json:"occupantCount"`
+	PrevOccupied      *bool     `json:"prevOccupied,omitempty"`
+	PrevOccupantCount *int      `json:"prevOccupantCount,omitempty"`
+	Source            string    `json:"source"`
+	Time              time.Time `json:"time"`
+
+	seq uint64
+}
+
+// Subscription receives events for the rooms it was created with
+type Subscription struct {
+	// Events delivers matching events; it is closed when the subscriber
+	// falls too far behind or the hub shuts down
+	Events <-chan OccupancyEvent
+	// Missed is true when the resume token could not be honoured because
+	// the events after it are no longer buffered
+	Missed bool
+
+	events chan OccupancyEvent
+	rooms  map[int]bool
+	hub    *Hub
+}
+
+// Close unsubscribes
+func (s *Subscription) Close() {
+	s.hub.unsubscribe(s)
+}
+
+func (s *Subscription) wants(roomID int) bool {
+	return len(s.rooms) == 0 || s.rooms[roomID]
+}
+
+// Hub fans occupancy changes out to stream subscribers and keeps the most
+// recent events in a ring buffer so reconnecting clients can resume
+type Hub struct {
+	// epoch distinguishes tokens issued by a previous process, whose
+	// sequence numbers mean nothing to this one
+	epoch      string
+	bufferSize int
+	sendBuffer int
+	log        *logger.Logger
+
+	mu     sync.Mutex
+	seq    uint64
+	ring   []OccupancyEvent
+	next   int
+	filled bool
+	subs   map[*Subscription]struct{}
+	closed bool
+}
+
+// NewHub creates a hub buffering the last bufferSize events
+func NewHub(bufferSize int, log *logger.Logger) *Hub {
+	return &Hub{
+		epoch:      strconv.FormatInt(time.Now().UnixNano(), 36),
+		bufferSize: bufferSize,
+		sendBuffer: 64,
+		ring:       make([]OccupancyEvent, bufferSize),
+		subs:       make(map[*Subscription]struct{}),
+		log:        log.Component("stream"),
+	}
+}
+
+// RoomStatusChanged implements processor.RoomStatusListener and publishes an
+// event only when occupied or occupant_count actually changed
+func (h *Hub) RoomStatusChanged(ctx context.Context, change *models.RoomStatusChange) {
+	if !change.OccupancyChanged() {
+		return
+	}
+
+	event := OccupancyEvent{
+		RoomID:        change.New.RoomID,
+		Occupied:      change.New.Occupied,
+		OccupantCount: change.New.OccupantCount,
+		Source:        change.New.CountSource,
+		Time:          time.Now(),
+	}
+	if change.Old != nil {
+		event.PrevOccupied = &change.Old.Occupied
+		event.PrevOccupantCount = &change.Old.OccupantCount
+	}
+	h.Publish(event)
+}
+
+// Publish assigns the event its resume token, buffers it and delivers it to
+// all interested subscribers
+func (h *Hub) Publish(event OccupancyEvent) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.closed {
+		return
+	}
+
+	h.seq++
+	event.seq = h.seq
+	event.Token = h.token(h.seq)
+
+	h.ring[h.next] = event
+	h.next = (h.next + 1) % h.bufferSize
+	if h.next == 0 {
+		h.filled = true
+	}
+
+	for sub := range h.subs {
+		if !sub.wants(event.RoomID) {
+			continue
+		}
+		select {
+		case sub.events <- event:
+		default:
+			// A stalled client must not block the processors; it can
+			// reconnect with its last token and catch up from the buffer
+			h.log.Warn("Dropping slow stream subscriber")
+			delete(h.subs, sub)
+			close(sub.events)
+		}
+	}
+}
+
+// Subscribe registers a subscriber for the given rooms (all rooms when
+// empty). When resumeToken is set, buffered events after it are delivered first.
+func (h *Hub) Subscribe(rooms []int, resumeToken string) *Subscription {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	sub := &Subscription{
+		events: make(chan OccupancyEvent, h.sendBuffer+h.bufferSize),
+		rooms:  make(map[int]bool, len(rooms)),
+		hub:    h,
+	}
+	sub.Events = sub.events
+	for _, id := range rooms {
+		sub.rooms[id] = true
+	}
+
+	if resumeToken != "" {
+		backlog, ok := h.since(resumeToken)
+		sub.Missed = !ok
+		for _, e := range backlog {
+			if sub.wants(e.RoomID) {
+				sub.events <- e
+			}
+		}
+	}
+
+	if h.closed {
+		close(sub.events)
+		return sub
+	}
+	h.subs[sub] = struct{}{}
+	return sub
+}
+
+// Close disconnects every subscriber
+func (h *Hub) Close() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.closed {
+		return
+	}
+	h.closed = true
+	for sub := range h.subs {
+		delete(h.subs, sub)
+		close(sub.events)
+	}
+}
+
+// Subscribers returns the number of connected subscribers
+func (h *Hub) Subscribers() int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return len(h.subs)
+}
+
+func (h *Hub) unsubscribe(sub *Subscription) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if _, ok := h.subs[sub]; ok {
+		delete(h.subs, sub)
+		close(sub.events)
+	}
+}
+
+func (h *Hub) token(seq uint64) string {
+	return fmt.Sprintf("%s-%d", h.epoch, seq)
+}
+
+// since returns the buffered events after token in order. ok is false when
+// the token is from another process or older than the buffer, in which case
+// the client has missed events and should reload the full state.
+func (h *Hub) since(token string) (events []OccupancyEvent, ok bool) {
+	epoch, seqStr, found := strings.Cut(token, "-")
+	seq, err := strconv.ParseUint(seqStr, 10, 64)
+	if !found || err != nil || epoch != h.epoch || seq > h.seq {
+		return h.buffered(), false
+	}
+
+	buffered := h.buffered()
+	if len(buffered) > 0 && buffered[0].seq > seq+1 {
+		return buffered, false
+	}
+	for i, e := range buffered {
+		if e.seq > seq {
+			return buffered[i:], true
+		}
+	}
+	return nil, true
+}
+
+// buffered returns the ring buffer contents oldest first
+func (h *Hub) buffered() []OccupancyEvent {
+	if !h.filled {
+		return append([]OccupancyEvent(nil), h.ring[:h.next]...)
+	}
+	out := make([]OccupancyEvent, 0, h.bufferSize)
+	out = append(out, h.ring[h.next:]...)
+	return append(out, h.ring[:h.next]...)
+}
@@ -0,0 +1,130 @@
+package tenant
+
+import (
+	"context"
+	"crypto/subtle"
+	"errors"
+
+	"github.com/NieRVoid/emqx-pg-bridge/internal/database"
+	"github.com/NieRVoid/emqx-pg-bridge/internal/models"
+	"github.com/NieRVoid/emqx-pg-bridge/internal/parser"
+	"github.com/NieRVoid/emqx-pg-bridge/internal/processor"
+	"github.com/NieRVoid/emqx-pg-bridge/pkg/logger"
+)
+
+// ErrUnknownTenant is returned for webhooks no tenant is resolved for
+var ErrUnknownTenant = errors.New("unknown tenant")
+
+// Tenant is one property served by the bridge, with its own processor set
+// and possibly its own database or schema
+type Tenant struct {
+	ID       string
+	Registry *processor.ProcessorRegistry
+	// Presence records the activity of publishing clients; nil when presence
+	// is not tracked for the tenant
+	Presence *processor.PresenceProcessor
+	// Breaker guards the database of the tenant; nil when disabled
+	Breaker *database.Breaker
+	// AuthKeys are the bearer keys accepted on webhooks of the tenant; none
+	// accepts webhooks without a key
+	AuthKeys []string
+}
+
+// Authorize reports whether key may send webhooks for the tenant
+func (t *Tenant) Authorize(key string) bool {
+	if len(t.AuthKeys) == 0 {
+		return true
+	}
+	for _, k := range t.AuthKeys {
+		if subtle.ConstantTimeCompare([]byte(key), []byte(k)) == 1 {
+			return true
+		}
+	}
+	return false
+}
+
+// Resolver resolves the tenant of a webhook from the tenant user property,
+// the EMQX username or the first topic level, in this order. Webhooks
+// matching none go to the fallback tenant, if any.
+type Resolver struct {
+	property   string
+	tenants    []*Tenant
+	byID       map[string]*Tenant
+	byUsername map[string]*Tenant
+	byPrefix   map[string]*Tenant
+	fallback   *Tenant
+}
+
+// NewResolver creates a resolver reading the tenant id from the user
+// property named property
+func NewResolver(property string) *Resolver {
+	return &Resolver{
+		property:   property,
+		byID:       make(map[string]*Tenant),
+		byUsername: make(map[string]*Tenant),
+		byPrefix:   make(map[string]*Tenant),
+	}
+}
+
+// Add registers a tenant with the topic prefixes and EMQX usernames that
+// identify it. It must be called before the resolver is used.
+func (r *Resolver) Add(t *Tenant, topicPrefixes, usernames []string) {
+	r.tenants = append(r.tenants, t)
+	r.byID[t.ID] = t
+	for _, prefix := range topicPrefixes {
+		r.byPrefix[prefix] = t
+	}
+	for _, username := range usernames {
+		r.byUsername[username] = t
+	}
+}
+
+// SetFallback selects the tenant of webhooks no tenant is resolved for;
+// without one they are rejected
+func (r *Resolver) SetFallback(t *Tenant) {
+	r.fallback = t
+}
+
+// Tenants returns the registered tenants in registration order
+func (r *Resolver) Tenants() []*Tenant {
+	return r.tenants
+}
+
+// Get returns the tenant with the given id
+func (r *Resolver) Get(id string) (*Tenant, bool) {
+	t, ok := r.byID[id]
+	return t, ok
+}
+
+// Resolve returns the tenant of a webhook
+func (r *Resolver) Resolve(data *models.WebhookData) (*Tenant, error) {
+	if id := data.GetUserProperty(r.property); id != "" {
+		if t, ok := r.byID[id]; ok {
+			return t, nil
+		}
+		// An explicit but unknown tenant must not land in another one
+		return nil, ErrUnknownTenant
+	}
+	if t, ok := r.byUsername[data.Username]; ok && data.Username != "" {
+		return t, nil
+	}
+	if info, err := parser.SplitTopic(data.Topic); err == nil {
+		if t, ok := r.byPrefix[info.Prefix]; ok {
+			return t, nil
+		}
+	}
+	if r.fallback != nil {
+		return r.fallback, nil
+	}
+	return nil, ErrUnknownTenant
+}
+
+// Dispatch resolves the tenant of a webhook and hands it to the tenant's
+// processors, for replays of the dead-letter spool
+func (r *Resolver) Dispatch(ctx context.Context, deviceType string, data *models.WebhookData) error {
+	t, err := r.Resolve(data)
+	if err != nil {
+		return err
+	}
+	return t.Registry.Dispatch(logger.ContextWith(ctx, "tenant", t.ID), deviceType, data)
+}
@@ -0,0 +1,144 @@
+package tracing
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+
+	"github.com/NieRVoid/emqx-pg-bridge/internal/config"
+	"github.com/NieRVoid/emqx-pg-bridge/internal/models"
+	"github.com/NieRVoid/emqx-pg-bridge/pkg/logger"
+)
+
+// InstrumentationName identifies spans created by the bridge
+const InstrumentationName = "github.com/NieRVoid/emqx-pg-bridge"
+
+// ShutdownFunc flushes and stops the tracer provider
+type ShutdownFunc func(ctx context.Context) error
+
+// Setup installs the global tracer provider and W3C propagator. When tracing
+// is disabled a no-op provider stays in place and the shutdown func does nothing.
+func Setup(ctx context.Context, cfg *config.Config, log *logger.Logger) (ShutdownFunc, error) {
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(
+		propagation.TraceContext{},
+		propagation.Baggage{},
+	))
+
+	if !cfg.Tracing.Enabled {
+		return func(context.Context) error { return nil }, nil
+	}
+
+	var (
+		exporter sdktrace.SpanExporter
+		file     *os.File
+		err      error
+	)
+
+	switch strings.ToLower(cfg.Tracing.Exporter) {
+	case "otlp":
+		opts := []otlptracehttp.Option{otlptracehttp.WithEndpoint(cfg.Tracing.Endpoint)}
+		if cfg.Tracing.Insecure {
+			opts = append(opts, otlptracehttp.WithInsecure())
+		}
+		exporter, err = otlptracehttp.New(ctx, opts...)
+	case "file":
+		file, err = os.OpenFile(cfg.Tracing.FilePath, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open trace file: %w", err)
+		}
+		exporter, err = stdouttrace.New(stdouttrace.WithWriter(file))
+	default:
+		return nil, fmt.Errorf("unsupported trace exporter: %s", cfg.Tracing.Exporter)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to create trace exporter: %w", err)
+	}
+
+	res := resource.NewSchemaless(
+		attribute.String("service.name", cfg.Tracing.ServiceName),
+		attribute.String("service.version", cfg.Meta.Version),
+	)
+
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(res),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(cfg.Tracing.SampleRatio))),
+	)
+	otel.SetTracerProvider(provider)
+
+	log.Info("Tracing enabled",
+		"exporter", cfg.Tracing.Exporter,
+		"endpoint", cfg.Tracing.Endpoint,
+		"file", cfg.Tracing.FilePath,
+		"sampleRatio", cfg.Tracing.SampleRatio)
+
+	return func(ctx context.Context) error {
+		err := provider.Shutdown(ctx)
+		if file != nil {
+			file.Close()
+		}
+		return err
+	}, nil
+}
+
+// Tracer returns the bridge's tracer from the global provider
+func Tracer() trace.Tracer {
+	return otel.Tracer(InstrumentationName)
+}
+
+// ExtractHTTP returns ctx with the trace context carried by the request headers
+func ExtractHTTP(ctx context.Context, header http.Header) context.Context {
+	return otel.GetTextMapPropagator().Extract(ctx, propagation.HeaderCarrier(header))
+}
+
+// ExtractWebhook falls back to the traceparent/tracestate MQTT user
+// properties of the message when ctx does not already carry a remote parent
+// from the HTTP headers
+func ExtractWebhook(ctx context.Context, data *models.WebhookData) context.Context {
+	if trace.SpanContextFromContext(ctx).IsValid() {
+		return ctx
+	}
+	return otel.GetTextMapPropagator().Extract(ctx, userPropertyCarrier{data: data})
+}
+
+// userPropertyCarrier reads propagation fields from MQTT user properties
+type userPropertyCarrier struct {
+	data *models.WebhookData
+}
+
+func (c userPropertyCarrier) Get(key string) string {
+	return c.data.GetUserProperty(key)
+}
+
+func (c userPropertyCarrier) Set(string, string) {}
+
+func (c userPropertyCarrier) Keys() []string {
+	keys := make([]string, 0, len(c.data.PubProps.UserProperty)+len(c.data.PubProps.UserPropertyPairs))
+	for k := range c.data.PubProps.UserProperty {
+		keys = append(keys, k)
+	}
+	for _, p := range c.data.PubProps.UserPropertyPairs {
+		keys = append(keys, p.Key)
+	}
+	return keys
+}
+
+// TraceID returns the hex trace id of the span in ctx, or "" if there is none
+func TraceID(ctx context.Context) string {
+	sc := trace.SpanContextFromContext(ctx)
+	if !sc.HasTraceID() {
+		return ""
+	}
+	return sc.TraceID().String()
+}
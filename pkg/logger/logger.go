@@ -1,98 +1,305 @@
 package logger
 
 import (
+	"context"
 	"fmt"
-	"log"
+	"io"
+	"log/slog"
 	"os"
+	"runtime"
 	"strings"
+	"time"
 )
 
-// Logger provides a simple logging interface
+// Logger provides a simple key/value logging interface on top of log/slog
 type Logger struct {
-	infoLogger  *log.Logger
-	errorLogger *log.Logger
-	debugLogger *log.Logger
-	level       LogLevel
-	format      string
+	sl      *slog.Logger
+	level   *slog.LevelVar
+	sampler *Sampler
+	class   string
+}
+
+// Options configures a Logger beyond level and format
+type Options struct {
+	Level     string
+	Format    string
+	Out       io.Writer
+	ErrOut    io.Writer
+	Sampling  map[string]SamplingRule
+	Redaction RedactionPolicy
 }
 
 // LogLevel represents logging levels
-type LogLevel int
+type LogLevel = slog.Level
 
 const (
-	DebugLevel LogLevel = iota
-	InfoLevel
-	ErrorLevel
+	DebugLevel LogLevel = slog.LevelDebug
+	InfoLevel  LogLevel = slog.LevelInfo
+	WarnLevel  LogLevel = slog.LevelWarn
+	ErrorLevel LogLevel = slog.LevelError
 )
 
-// NewLogger creates a new Logger
+// NewLogger creates a new Logger writing info and below to stdout and
+// warnings and errors to stderr
 func NewLogger(level, format string) *Logger {
-	infoLogger := log.New(os.Stdout, "INFO: ", log.Ldate|log.Ltime)
-	errorLogger := log.New(os.Stderr, "ERROR: ", log.Ldate|log.Ltime|log.Lshortfile)
-	debugLogger := log.New(os.Stdout, "DEBUG: ", log.Ldate|log.Ltime|log.Lshortfile)
-	
-	logLevel := InfoLevel
-	switch strings.ToLower(level) {
+	return New(os.Stdout, os.Stderr, level, format)
+}
+
+// New creates a new Logger with explicit writers for low (debug/info) and
+// high (warn/error) severity records
+func New(out, errOut io.Writer, level, format string) *Logger {
+	return NewWithOptions(Options{Level: level, Format: format, Out: out, ErrOut: errOut})
+}
+
+// NewWithOptions creates a new Logger with sampling and redaction applied
+func NewWithOptions(opts Options) *Logger {
+	if opts.Out == nil {
+		opts.Out = os.Stdout
+	}
+	if opts.ErrOut == nil {
+		opts.ErrOut = os.Stderr
+	}
+
+	lv := new(slog.LevelVar)
+	if parsed, err := ParseLevel(opts.Level); err == nil {
+		lv.Set(parsed)
+	}
+
+	jsonFormat := strings.ToLower(opts.Format) == "json"
+	redactor := NewRedactor(opts.Redaction, jsonFormat)
+
+	lowOpts := &slog.HandlerOptions{Level: lv}
+	highOpts := &slog.HandlerOptions{Level: lv, AddSource: true}
+	if redactor != nil {
+		lowOpts.ReplaceAttr = redactor.replaceAttr
+		highOpts.ReplaceAttr = redactor.replaceAttr
+	}
+
+	var low, high slog.Handler
+	if jsonFormat {
+		low = slog.NewJSONHandler(opts.Out, lowOpts)
+		high = slog.NewJSONHandler(opts.ErrOut, highOpts)
+	} else {
+		low = slog.NewTextHandler(opts.Out, lowOpts)
+		high = slog.NewTextHandler(opts.ErrOut, highOpts)
+	}
+
+	var sampler *Sampler
+	if len(opts.Sampling) > 0 {
+		sampler = NewSampler(opts.Sampling)
+	}
+
+	return &Logger{
+		sl:      slog.New(&splitHandler{low: low, high: high}),
+		level:   lv,
+		sampler: sampler,
+	}
+}
+
+// ParseLevel converts a level name into a LogLevel
+func ParseLevel(level string) (LogLevel, error) {
+	switch strings.ToLower(strings.TrimSpace(level)) {
 	case "debug":
-		logLevel = DebugLevel
-	case "info":
-		logLevel = InfoLevel
+		return DebugLevel, nil
+	case "info", "":
+		return InfoLevel, nil
+	case "warn", "warning":
+		return WarnLevel, nil
 	case "error":
-		logLevel = ErrorLevel
+		return ErrorLevel, nil
 	}
-	
-	return &Logger{
-		infoLogger:  infoLogger,
-		errorLogger: errorLogger,
-		debugLogger: debugLogger,
-		level:       logLevel,
-		format:      format,
+	return InfoLevel, fmt.Errorf("unknown log level: %q", level)
+}
+
+// SetLevel changes the minimum level at runtime. The change applies to this
+// logger and every child derived from it.
+func (l *Logger) SetLevel(level string) error {
+	parsed, err := ParseLevel(level)
+	if err != nil {
+		return err
 	}
+	l.level.Set(parsed)
+	return nil
 }
 
-// formatMessage formats a log message with key-value pairs
-func formatMessage(msg string, keyValues ...interface{}) string {
-	if len(keyValues) == 0 {
-		return msg
+// Level returns the current minimum level name
+func (l *Logger) Level() string {
+	return strings.ToLower(l.level.Level().String())
+}
+
+// With returns a child logger that adds the given key/value pairs to every record
+func (l *Logger) With(keyValues ...interface{}) *Logger {
+	attrs := normalize(keyValues)
+	if len(attrs) == 0 {
+		return l
 	}
-	
-	builder := strings.Builder{}
-	builder.WriteString(msg)
-	
-	for i := 0; i < len(keyValues); i += 2 {
-		if i+1 < len(keyValues) {
-			builder.WriteString(", ")
-			builder.WriteString(keyValues[i].(string))
-			builder.WriteString("=")
-			builder.WriteString(fmt.Sprintf("%v", keyValues[i+1]))
-		}
+	args := make([]any, len(attrs))
+	for i, a := range attrs {
+		args[i] = a
 	}
-	
-	return builder.String()
+	child := *l
+	child.sl = l.sl.With(args...)
+	return &child
+}
+
+// Component returns a child logger labelled with the given component name
+func (l *Logger) Component(name string) *Logger {
+	return l.With("component", name)
+}
+
+// WithContext returns a child logger carrying the fields stored in ctx by
+// ContextWith, such as the request id
+func (l *Logger) WithContext(ctx context.Context) *Logger {
+	if ctx == nil {
+		return l
+	}
+	kv, _ := ctx.Value(fieldsKey{}).([]interface{})
+	if len(kv) == 0 {
+		return l
+	}
+	return l.With(kv...)
+}
+
+// Slog exposes the underlying slog.Logger
+func (l *Logger) Slog() *slog.Logger {
+	return l.sl
 }
 
 // Debug logs a debug message
 func (l *Logger) Debug(msg string, keyValues ...interface{}) {
-	if l.level <= DebugLevel {
-		l.debugLogger.Println(formatMessage(msg, keyValues...))
-	}
+	l.log(DebugLevel, msg, keyValues)
 }
 
 // Info logs an info message
 func (l *Logger) Info(msg string, keyValues ...interface{}) {
-	if l.level <= InfoLevel {
-		l.infoLogger.Println(formatMessage(msg, keyValues...))
-	}
+	l.log(InfoLevel, msg, keyValues)
+}
+
+// Warn logs a warning message
+func (l *Logger) Warn(msg string, keyValues ...interface{}) {
+	l.log(WarnLevel, msg, keyValues)
 }
 
 // Error logs an error message
 func (l *Logger) Error(msg string, keyValues ...interface{}) {
-	if l.level <= ErrorLevel {
-		l.errorLogger.Println(formatMessage(msg, keyValues...))
-	}
+	l.log(ErrorLevel, msg, keyValues)
 }
 
 // Fatal logs an error message and exits
 func (l *Logger) Fatal(msg string, keyValues ...interface{}) {
-	l.errorLogger.Fatalln(formatMessage(msg, keyValues...))
-}
\ No newline at end of file
+	l.log(ErrorLevel, msg, keyValues)
+	os.Exit(1)
+}
+
+// log builds the record itself so that the source location points at the
+// caller of Debug/Info/Warn/Error rather than at this package
+func (l *Logger) log(level LogLevel, msg string, keyValues []interface{}) {
+	ctx := context.Background()
+	if !l.sl.Enabled(ctx, level) {
+		return
+	}
+
+	now := time.Now()
+	dropped := 0
+	if l.class != "" {
+		var ok bool
+		if ok, dropped = l.sampler.Allow(l.class, now); !ok {
+			return
+		}
+	}
+
+	var pcs [1]uintptr
+	runtime.Callers(3, pcs[:])
+	r := slog.NewRecord(now, level, msg, pcs[0])
+	r.AddAttrs(normalize(keyValues)...)
+	if dropped > 0 {
+		r.AddAttrs(slog.String("log_class", l.class), slog.Int("sampled_dropped", dropped))
+	}
+	_ = l.sl.Handler().Handle(ctx, r)
+}
+
+// normalize turns a loose key/value list into attributes. Non-string keys are
+// stringified and a trailing key without a value is kept under its own name
+// with a "!MISSING" marker instead of being dropped or panicking.
+func normalize(keyValues []interface{}) []slog.Attr {
+	if len(keyValues) == 0 {
+		return nil
+	}
+
+	attrs := make([]slog.Attr, 0, (len(keyValues)+1)/2)
+	for i := 0; i < len(keyValues); i += 2 {
+		if attr, ok := keyValues[i].(slog.Attr); ok {
+			attrs = append(attrs, attr)
+			i--
+			continue
+		}
+
+		key := keyString(keyValues[i])
+		if i+1 >= len(keyValues) {
+			attrs = append(attrs, slog.String(key, "!MISSING"))
+			break
+		}
+		attrs = append(attrs, slog.Any(key, keyValues[i+1]))
+	}
+	return attrs
+}
+
+func keyString(k interface{}) string {
+	switch v := k.(type) {
+	case string:
+		if v == "" {
+			return "!EMPTY"
+		}
+		return v
+	case nil:
+		return "!NIL"
+	case fmt.Stringer:
+		return v.String()
+	default:
+		return fmt.Sprint(v)
+	}
+}
+
+type fieldsKey struct{}
+
+// ContextWith returns a context carrying key/value pairs that WithContext
+// attaches to log records, e.g. the request id of the current webhook
+func ContextWith(ctx context.Context, keyValues ...interface{}) context.Context {
+	if len(keyValues) == 0 {
+		return ctx
+	}
+	existing, _ := ctx.Value(fieldsKey{}).([]interface{})
+	merged := make([]interface{}, 0, len(existing)+len(keyValues))
+	merged = append(merged, existing...)
+	merged = append(merged, keyValues...)
+	return context.WithValue(ctx, fieldsKey{}, merged)
+}
+
+// splitHandler sends warnings and errors to one handler and everything else
+// to another, mirroring the old stdout/stderr split
+type splitHandler struct {
+	low  slog.Handler
+	high slog.Handler
+}
+
+func (h *splitHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	if level >= slog.LevelWarn {
+		return h.high.Enabled(ctx, level)
+	}
+	return h.low.Enabled(ctx, level)
+}
+
+func (h *splitHandler) Handle(ctx context.Context, r slog.Record) error {
+	if r.Level >= slog.LevelWarn {
+		return h.high.Handle(ctx, r)
+	}
+	return h.low.Handle(ctx, r)
+}
+
+func (h *splitHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return &splitHandler{low: h.low.WithAttrs(attrs), high: h.high.WithAttrs(attrs)}
+}
+
+func (h *splitHandler) WithGroup(name string) slog.Handler {
+	return &splitHandler{low: h.low.WithGroup(name), high: h.high.WithGroup(name)}
+}
@@ -0,0 +1,180 @@
+package logger
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"strings"
+)
+
+// RedactedValue replaces sensitive values in logged payloads
+const RedactedValue = "[REDACTED]"
+
+// RedactionPolicy describes what must never reach the logs
+type RedactionPolicy struct {
+	// Fields are dot separated paths into JSON payloads, "*" matches any
+	// object key or array element (e.g. "occupied", "guests.*.name")
+	Fields []string
+	// UserProperties are MQTT user property keys whose values are masked
+	UserProperties []string
+	// Keys are the log attribute keys whose values are treated as payloads
+	// or webhook data. Defaults to "payload" and "webhook".
+	Keys []string
+}
+
+// Redactor applies a RedactionPolicy to log attributes
+type Redactor struct {
+	fields    [][]string
+	attrKeys  map[string]bool
+	userProps map[string]bool
+	keys      map[string]bool
+	json      bool
+}
+
+// NewRedactor builds a redactor; it returns nil when the policy is empty
+func NewRedactor(policy RedactionPolicy, jsonFormat bool) *Redactor {
+	if len(policy.Fields) == 0 && len(policy.UserProperties) == 0 {
+		return nil
+	}
+
+	r := &Redactor{
+		attrKeys:  make(map[string]bool),
+		userProps: make(map[string]bool),
+		keys:      make(map[string]bool),
+		json:      jsonFormat,
+	}
+	for _, f := range policy.Fields {
+		if f = strings.TrimSpace(f); f != "" {
+			r.fields = append(r.fields, strings.Split(f, "."))
+			// Single-segment fields also mask log attributes of the same name,
+			// so "occupied" covers both the payload and the processor's own logs
+			if !strings.Contains(f, ".") && f != "*" {
+				r.attrKeys[f] = true
+			}
+		}
+	}
+	for _, k := range policy.UserProperties {
+		r.userProps[k] = true
+	}
+	keys := policy.Keys
+	if len(keys) == 0 {
+		keys = []string{"payload", "webhook"}
+	}
+	for _, k := range keys {
+		r.keys[k] = true
+	}
+	return r
+}
+
+// replaceAttr is installed as slog.HandlerOptions.ReplaceAttr
+func (r *Redactor) replaceAttr(groups []string, a slog.Attr) slog.Attr {
+	if r == nil {
+		return a
+	}
+	if len(groups) == 0 && r.attrKeys[a.Key] {
+		return slog.String(a.Key, RedactedValue)
+	}
+	if !r.keys[a.Key] {
+		return a
+	}
+
+	v := a.Value.Resolve()
+	if v.Kind() == slog.KindString {
+		return slog.String(a.Key, r.Payload(v.String()))
+	}
+
+	raw, err := json.Marshal(v.Any())
+	if err != nil {
+		return slog.String(a.Key, RedactedValue)
+	}
+	var doc interface{}
+	if err := json.Unmarshal(raw, &doc); err != nil {
+		return slog.String(a.Key, RedactedValue)
+	}
+	out, err := json.Marshal(r.webhook(doc))
+	if err != nil {
+		return slog.String(a.Key, RedactedValue)
+	}
+	if r.json {
+		return slog.Any(a.Key, json.RawMessage(out))
+	}
+	return slog.String(a.Key, string(out))
+}
+
+// Payload redacts the configured field paths in a JSON payload string.
+// Payloads that are not valid JSON cannot be inspected and are masked whole.
+func (r *Redactor) Payload(payload string) string {
+	if r == nil || len(r.fields) == 0 {
+		return payload
+	}
+
+	var doc interface{}
+	if err := json.Unmarshal([]byte(payload), &doc); err != nil {
+		return fmt.Sprintf("[REDACTED non-JSON payload, %d bytes]", len(payload))
+	}
+	for _, path := range r.fields {
+		doc = redactPath(doc, path)
+	}
+	out, err := json.Marshal(doc)
+	if err != nil {
+		return RedactedValue
+	}
+	return string(out)
+}
+
+// webhook redacts a decoded EMQX webhook document: the embedded payload
+// string and the user properties in both of their encodings
+func (r *Redactor) webhook(doc interface{}) interface{} {
+	obj, ok := doc.(map[string]interface{})
+	if !ok {
+		return doc
+	}
+
+	if payload, ok := obj["payload"].(string); ok {
+		obj["payload"] = r.Payload(payload)
+	}
+
+	if props, ok := obj["pub_props"].(map[string]interface{}); ok && len(r.userProps) > 0 {
+		if m, ok := props["User-Property"].(map[string]interface{}); ok {
+			for k := range m {
+				if r.userProps[k] {
+					m[k] = RedactedValue
+				}
+			}
+		}
+		if pairs, ok := props["User-Property-Pairs"].([]interface{}); ok {
+			for _, p := range pairs {
+				if pair, ok := p.(map[string]interface{}); ok {
+					if key, _ := pair["key"].(string); r.userProps[key] {
+						pair["value"] = RedactedValue
+					}
+				}
+			}
+		}
+	}
+	return obj
+}
+
+func redactPath(node interface{}, path []string) interface{} {
+	if len(path) == 0 {
+		return RedactedValue
+	}
+
+	switch n := node.(type) {
+	case map[string]interface{}:
+		if path[0] == "*" {
+			for k, v := range n {
+				n[k] = redactPath(v, path[1:])
+			}
+		} else if v, ok := n[path[0]]; ok {
+			n[path[0]] = redactPath(v, path[1:])
+		}
+	case []interface{}:
+		if path[0] == "*" {
+			for i, v := range n {
+				n[i] = redactPath(v, path[1:])
+			}
+		}
+	}
+	return node
+}
@@ -0,0 +1,98 @@
+package logger
+
+import (
+	"sync"
+	"time"
+)
+
+// SamplingRule limits how many records of one message class are written per
+// period: the first First records are always written, after that only every
+// Thereafter-th record is (0 drops the rest of the period).
+type SamplingRule struct {
+	First      int
+	Thereafter int
+	Period     time.Duration
+}
+
+// Sampler applies per-class sampling rules. Classes without a rule are never
+// sampled.
+type Sampler struct {
+	mu     sync.Mutex
+	rules  map[string]SamplingRule
+	counts map[string]*sampleWindow
+}
+
+type sampleWindow struct {
+	start   time.Time
+	seen    int
+	dropped int
+}
+
+// NewSampler creates a sampler from a class to rule mapping
+func NewSampler(rules map[string]SamplingRule) *Sampler {
+	normalized := make(map[string]SamplingRule, len(rules))
+	for class, rule := range rules {
+		if rule.Period <= 0 {
+			rule.Period = time.Second
+		}
+		if rule.First < 0 {
+			rule.First = 0
+		}
+		normalized[class] = rule
+	}
+
+	return &Sampler{
+		rules:  normalized,
+		counts: make(map[string]*sampleWindow),
+	}
+}
+
+// Allow reports whether a record of the given class should be written. When
+// it is the first record written after some were dropped, dropped holds the
+// number of records suppressed since the last one that got through.
+func (s *Sampler) Allow(class string, now time.Time) (ok bool, dropped int) {
+	if s == nil {
+		return true, 0
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	rule, found := s.rules[class]
+	if !found {
+		return true, 0
+	}
+
+	w := s.counts[class]
+	if w == nil {
+		w = &sampleWindow{start: now}
+		s.counts[class] = w
+	}
+	if now.Sub(w.start) >= rule.Period {
+		w.start = now
+		w.seen = 0
+	}
+
+	w.seen++
+	allowed := w.seen <= rule.First
+	if !allowed && rule.Thereafter > 0 {
+		allowed = (w.seen-rule.First)%rule.Thereafter == 0
+	}
+
+	if !allowed {
+		w.dropped++
+		return false, 0
+	}
+
+	dropped = w.dropped
+	w.dropped = 0
+	return true, dropped
+}
+
+// Sampled returns a child logger whose records belong to the given message
+// class and are subject to that class's sampling rule
+func (l *Logger) Sampled(class string) *Logger {
+	child := *l
+	child.class = class
+	return &child
+}